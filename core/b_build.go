@@ -0,0 +1,151 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+)
+
+// the default fill factor of the nodes built by a bulk load.
+// some free space is left so that the first updates don't split every node.
+const BULK_FILL_DEFAULT = 0.9
+
+// treeBuilder builds a tree bottom-up from KVs sorted by key.
+// The nodes are filled to `limit` bytes in key order, so the pages are
+// allocated sequentially, and each full node adds a key to its parent level.
+// Only one unfinished node per level is kept in memory.
+type treeBuilder struct {
+	tree   *BTree
+	limit  int          // the target node size in bytes
+	levels []buildLevel // levels[0] is the leaf level
+	last   []byte       // the last key added
+}
+
+// the unfinished node of a level.
+type buildLevel struct {
+	keys  [][]byte
+	vals  [][]byte // leaf nodes only
+	big   []bool   // the value is stored in overflow pages
+	ptrs  []uint64 // internal nodes only
+	cnts  []uint64 // internal nodes only, the subtree counts with the flags
+	size  int      // the total size of the KVs, as in the KV area of the node
+	nodes int      // the number of nodes already written at this level
+}
+
+// the tree must be empty. `fill` is the fill factor of the nodes, in (0, 1].
+func newTreeBuilder(tree *BTree, fill float64) (*treeBuilder, error) {
+	if !(0 < fill && fill <= 1) {
+		return nil, fmt.Errorf("bad fill factor %v", fill)
+	}
+	b := &treeBuilder{tree: tree, limit: int(fill * BTREE_PAGE_SIZE)}
+	// the dummy key, see BTree.Insert()
+	err := b.addKV(0, nil, 0, 0, nil, false)
+	return b, err
+}
+
+// add a KV, the keys must be added in ascending order.
+func (b *treeBuilder) add(key []byte, val []byte) error {
+	if err := checkKV(key, val); err != nil {
+		return err
+	}
+	if b.last != nil && b.tree.cmp.compare(key, b.last) <= 0 {
+		return errors.New("keys are not sorted")
+	}
+	b.last = append(b.last[:0], key...)
+	big, stored, err := leafValue(b.tree, val)
+	if err != nil {
+		return err
+	}
+	return b.addKV(0, append([]byte(nil), key...), 0, 0, append([]byte(nil), stored...), big)
+}
+
+// write the unfinished nodes and set the root of the tree.
+func (b *treeBuilder) finish() error {
+	for level := 0; ; level++ {
+		if level == len(b.levels)-1 && b.levels[level].nodes == 0 {
+			// the only node of the top level
+			root, _, err := b.writeNode(level)
+			b.tree.root = root
+			return err
+		}
+		if err := b.flush(level); err != nil {
+			return err
+		}
+	}
+}
+
+// `ptr` and `count` are for internal nodes and `val` and `big` are for leaf nodes.
+func (b *treeBuilder) addKV(level int, key []byte, ptr uint64, count uint64, val []byte, big bool) error {
+	if level == len(b.levels) {
+		b.levels = append(b.levels, buildLevel{})
+	}
+	if len(b.levels[level].keys) > 0 && b.nodeSize(level, key, val) > b.limit {
+		// can add a level, `b.levels` is only indexed after it
+		if err := b.flush(level); err != nil {
+			return err
+		}
+	}
+	lv := &b.levels[level]
+	lv.keys = append(lv.keys, key)
+	lv.size += len(key)
+	if level == 0 {
+		lv.vals = append(lv.vals, val)
+		lv.big = append(lv.big, big)
+		lv.size += 2 + len(val) // klen and val
+	} else {
+		lv.ptrs = append(lv.ptrs, ptr)
+		lv.cnts = append(lv.cnts, count)
+	}
+	return nil
+}
+
+// the node size of the level after adding the KV.
+// the keys are sorted, so the prefix of the node is shared by the first and the new key.
+func (b *treeBuilder) nodeSize(level int, key []byte, val []byte) int {
+	lv := &b.levels[level]
+	btype, kv := uint16(BNODE_LEAF), lv.size+2+len(key)+len(val)
+	if level > 0 {
+		btype, kv = BNODE_NODE, lv.size+len(key)
+	}
+	n := len(lv.keys) + 1
+	plen := len(nodePrefix(b.tree.cmp, lv.keys[0], key))
+	kv -= n * plen
+	return HEADER + 2 + plen + int(keyOverhead(btype))*n + kv
+}
+
+// write the unfinished node of the level and add it to the parent level.
+func (b *treeBuilder) flush(level int) error {
+	first := b.levels[level].keys[0]
+	ptr, count, err := b.writeNode(level)
+	if err != nil {
+		return err
+	}
+	b.levels[level].nodes++
+	return b.addKV(level+1, first, ptr, count, nil, false)
+}
+
+// returns the pointer and the count of the node, see nodeCountFlags().
+func (b *treeBuilder) writeNode(level int) (uint64, uint64, error) {
+	lv := &b.levels[level]
+	nkeys := uint16(len(lv.keys))
+	node := BNode{data: make([]byte, BTREE_PAGE_SIZE)}
+	if level == 0 {
+		node.setHeader(BNODE_LEAF, nkeys)
+	} else {
+		node.setHeader(BNODE_NODE, nkeys)
+	}
+	node.setPrefix(nodePrefix(b.tree.cmp, lv.keys[0], lv.keys[nkeys-1]))
+	for i := uint16(0); i < nkeys; i++ {
+		if level == 0 {
+			nodeAppendKV(node, i, 0, lv.keys[i], lv.vals[i])
+			if lv.big[i] {
+				leafSetOverflow(node, i)
+			}
+		} else {
+			nodeAppendKV(node, i, lv.ptrs[i], lv.keys[i], nil)
+			node.setCount(i, lv.cnts[i])
+		}
+	}
+	*lv = buildLevel{nodes: lv.nodes}
+	ptr, err := b.tree.new(node)
+	return ptr, nodeCountFlags(node), err
+}
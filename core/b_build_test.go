@@ -0,0 +1,94 @@
+package core
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// a SortedIter over a slice of keys
+type sliceIter struct {
+	keys []string
+	vals []string
+	pos  int
+}
+
+func (iter *sliceIter) Valid() bool   { return iter.pos < len(iter.keys) }
+func (iter *sliceIter) Key() []byte   { return []byte(iter.keys[iter.pos]) }
+func (iter *sliceIter) Value() []byte { return []byte(iter.vals[iter.pos]) }
+func (iter *sliceIter) Next()         { iter.pos++ }
+func (iter *sliceIter) Err() error    { return nil }
+
+func (c *C) build(t *testing.T, fill float64, keys []string, vals []string) {
+	builder, err := newTreeBuilder(&c.tree, fill)
+	assert.Nil(t, err)
+	for i := range keys {
+		assert.Nil(t, builder.add([]byte(keys[i]), []byte(vals[i])))
+		c.ref[keys[i]] = vals[i]
+	}
+	assert.Nil(t, builder.finish())
+}
+
+func TestBuildTree(t *testing.T) {
+	var keys, vals []string
+	for i := 0; i < 20000; i++ {
+		keys = append(keys, fmt.Sprintf("key%08d", i))
+		vals = append(vals, fmt.Sprint(i))
+	}
+	full := newC(t)
+	full.build(t, 1, keys, vals)
+	half := newC(t)
+	half.build(t, 0.5, keys, vals)
+	assert.Less(t, len(full.pages)*18/10, len(half.pages))
+
+	c := full
+	for key, val := range c.ref {
+		treeVal, ok := c.get(key)
+		assert.True(t, ok)
+		assert.Equal(t, val, treeVal)
+	}
+	// the iterator skips the dummy key
+	iter := c.tree.Seek(nil, CMP_GT)
+	for i := range keys {
+		assert.True(t, iter.Valid())
+		assert.Equal(t, keys[i], string(iter.Key()))
+		iter.Next()
+	}
+	assert.False(t, iter.Valid())
+
+	// the tree can be updated as usual
+	for i := 0; i < len(keys); i += 2 {
+		assert.True(t, c.del(keys[i]))
+	}
+	c.add("key", "new")
+	for key, val := range c.ref {
+		treeVal, ok := c.get(key)
+		assert.True(t, ok)
+		assert.Equal(t, val, treeVal)
+	}
+}
+
+func TestBuildTreeEmpty(t *testing.T) {
+	c := newC(t)
+	c.build(t, BULK_FILL_DEFAULT, nil, nil)
+	assert.Equal(t, 1, c.height())
+	assert.False(t, c.tree.Seek(nil, CMP_GT).Valid())
+	c.add("a", "1")
+	val, ok := c.get("a")
+	assert.True(t, ok)
+	assert.Equal(t, "1", val)
+}
+
+func TestBuildTreeBadInput(t *testing.T) {
+	_, err := newTreeBuilder(&BTree{}, 1.5)
+	assert.NotNil(t, err)
+
+	c := newC(t)
+	builder, err := newTreeBuilder(&c.tree, 1)
+	assert.Nil(t, err)
+	assert.Nil(t, builder.add([]byte("b"), nil))
+	assert.NotNil(t, builder.add([]byte("a"), nil))
+	assert.NotNil(t, builder.add([]byte("b"), nil))
+	assert.NotNil(t, builder.add(nil, nil))
+}
@@ -0,0 +1,168 @@
+package core
+
+// BIter is a cursor over the leaf level of a BTree.
+// It records the path from the root to the current leaf,
+// so moving to a sibling leaf only re-reads the nodes that change.
+//
+// The dummy key (the empty key at the start of the leftmost leaf)
+// is never exposed: an iterator positioned on it is not valid,
+// and Next() moves it onto the first real key.
+//
+// The iterators of KV.Seek() and KV.Select() hold a KVReader,
+// they must be closed by Close(), see KV.Seek().
+type BIter struct {
+	tree *BTree
+	path []BNode  // from root to leaf
+	pos  []uint16 // indexes into nodes
+	err  error    // a page couldn't be read while moving
+	// the reader owned by the iterator of KV.Seek() and KV.Select()
+	reader *KVReader
+}
+
+// find the closest position that is less or equal to the input key
+func (tree *BTree) SeekLE(key []byte) *BIter {
+	iter := &BIter{tree: tree}
+	for ptr := tree.root; ptr != 0; {
+		node, err := tree.get(ptr)
+		if err != nil {
+			iter.err = err
+			return iter
+		}
+		idx := nodeLookupLE(tree.cmp, node, key)
+		iter.path = append(iter.path, node)
+		iter.pos = append(iter.pos, idx)
+		if node.btype() == BNODE_NODE {
+			ptr = node.getPtr(idx)
+		} else {
+			ptr = 0
+		}
+	}
+	return iter
+}
+
+// is the iterator positioned on a key?
+func (iter *BIter) Valid() bool {
+	if iter.err != nil || len(iter.path) == 0 {
+		return false // empty tree, or a page couldn't be read
+	}
+	leaf := len(iter.path) - 1
+	if iter.pos[leaf] >= iter.path[leaf].nkeys() {
+		return false // past the last key
+	}
+	return !iter.onDummy()
+}
+
+// the dummy key is the first key of the leftmost leaf.
+func (iter *BIter) onDummy() bool {
+	for _, pos := range iter.pos {
+		if pos != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// release the reader owned by the iterator, the iterator is invalid afterwards.
+// it does nothing for the iterators of a BTree or a KVReader.
+func (iter *BIter) Close() {
+	if iter.reader == nil {
+		return
+	}
+	iter.reader.Close()
+	iter.reader = nil
+	iter.path, iter.pos = nil, nil
+}
+
+// the error that made the iterator invalid, if any.
+func (iter *BIter) Err() error {
+	return iter.err
+}
+
+// get the current KV pair. only call it when Valid() is true.
+func (iter *BIter) Key() []byte {
+	leaf := len(iter.path) - 1
+	return iter.path[leaf].getKey(iter.pos[leaf])
+}
+
+// a big value is read from its overflow pages,
+// nil is returned if one of them can't be read, check Err() for it.
+func (iter *BIter) Value() []byte {
+	leaf := len(iter.path) - 1
+	val, err := leafGetVal(iter.tree, iter.path[leaf], iter.pos[leaf])
+	if err != nil {
+		iter.err = err
+		return nil
+	}
+	return val
+}
+
+// move forward. past the last key the iterator becomes invalid.
+func (iter *BIter) Next() {
+	if !iter.movable() {
+		return
+	}
+	leaf := len(iter.path) - 1
+	if !iterNext(iter, leaf) && iter.err == nil {
+		iter.pos[leaf] = iter.path[leaf].nkeys() // past the last key
+	}
+}
+
+// move backward. before the first key the iterator becomes invalid.
+func (iter *BIter) Prev() {
+	if !iter.movable() {
+		return
+	}
+	leaf := len(iter.path) - 1
+	if iter.pos[leaf] >= iter.path[leaf].nkeys() {
+		// past the last key, step back onto it
+		iter.pos[leaf] = iter.path[leaf].nkeys() - 1
+		return
+	}
+	iterPrev(iter, leaf)
+}
+
+func (iter *BIter) movable() bool {
+	return iter.err == nil && len(iter.path) > 0
+}
+
+// move the position at `level` to the next one,
+// the nodes below it are reloaded from the new position.
+// returns false if `level` is already at the end of the tree,
+// or if a node can't be read, which is recorded in `iter.err`.
+func iterNext(iter *BIter, level int) bool {
+	if iter.pos[level]+1 < iter.path[level].nkeys() {
+		iter.pos[level]++ // move within this node
+	} else if level == 0 || !iterNext(iter, level-1) {
+		return false // this is the last node of the level
+	}
+	// 父节点的位置变了，子节点要重新加载，并且从第一个 key 开始
+	if level+1 < len(iter.path) {
+		kid, err := iter.tree.get(iter.path[level].getPtr(iter.pos[level]))
+		if err != nil {
+			iter.err = err
+			return false
+		}
+		iter.path[level+1] = kid
+		iter.pos[level+1] = 0
+	}
+	return true
+}
+
+// the mirror of iterNext(), the nodes below are positioned at their last key.
+func iterPrev(iter *BIter, level int) bool {
+	if iter.pos[level] > 0 {
+		iter.pos[level]-- // move within this node
+	} else if level == 0 || !iterPrev(iter, level-1) {
+		return false // this is the first node of the level
+	}
+	if level+1 < len(iter.path) {
+		kid, err := iter.tree.get(iter.path[level].getPtr(iter.pos[level]))
+		if err != nil {
+			iter.err = err
+			return false
+		}
+		iter.path[level+1] = kid
+		iter.pos[level+1] = kid.nkeys() - 1
+	}
+	return true
+}
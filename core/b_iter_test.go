@@ -0,0 +1,130 @@
+package core
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIterEmptyTree(t *testing.T) {
+	c := newC(t)
+	iter := c.tree.SeekLE([]byte("a"))
+	assert.False(t, iter.Valid())
+	iter.Next()
+	assert.False(t, iter.Valid())
+	iter.Prev()
+	assert.False(t, iter.Valid())
+}
+
+func TestIterSeekLE(t *testing.T) {
+	c := newC(t)
+	for i := 0; i < 1000; i++ {
+		c.add(fmt.Sprintf("key%06d", i*2), fmt.Sprintf("val%d", i))
+	}
+
+	// exact match
+	iter := c.tree.SeekLE([]byte("key000100"))
+	assert.True(t, iter.Valid())
+	assert.Equal(t, "key000100", string(iter.Key()))
+	assert.Equal(t, "val50", string(iter.Value()))
+
+	// between two keys
+	iter = c.tree.SeekLE([]byte("key000101"))
+	assert.True(t, iter.Valid())
+	assert.Equal(t, "key000100", string(iter.Key()))
+
+	// before the first key, lands on the dummy key
+	iter = c.tree.SeekLE([]byte("a"))
+	assert.False(t, iter.Valid())
+	iter.Next()
+	assert.True(t, iter.Valid())
+	assert.Equal(t, "key000000", string(iter.Key()))
+	iter.Prev()
+	assert.False(t, iter.Valid())
+
+	// after the last key
+	iter = c.tree.SeekLE([]byte("z"))
+	assert.True(t, iter.Valid())
+	assert.Equal(t, "key001998", string(iter.Key()))
+	iter.Next()
+	assert.False(t, iter.Valid())
+	iter.Prev()
+	assert.True(t, iter.Valid())
+	assert.Equal(t, "key001998", string(iter.Key()))
+}
+
+func TestIterWalk(t *testing.T) {
+	c := newC(t)
+	for i := 0; i < 2000; i++ {
+		key, err := generateRandomString(1 + i%64)
+		assert.Nil(t, err)
+		c.add(key, fmt.Sprintf("%d", i))
+	}
+	keys := make([]string, 0, len(c.ref))
+	for k := range c.ref {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	// forward
+	iter := c.tree.SeekLE(nil)
+	got := []string{}
+	for iter.Next(); iter.Valid(); iter.Next() {
+		assert.Equal(t, c.ref[string(iter.Key())], string(iter.Value()))
+		got = append(got, string(iter.Key()))
+	}
+	assert.Equal(t, keys, got)
+
+	// backward
+	iter = c.tree.SeekLE([]byte(keys[len(keys)-1]))
+	got = got[:0]
+	for ; iter.Valid(); iter.Prev() {
+		got = append(got, string(iter.Key()))
+	}
+	assert.Equal(t, len(keys), len(got))
+	for i := range got {
+		assert.Equal(t, keys[len(keys)-1-i], got[i])
+	}
+}
+
+func TestIterSeekCmp(t *testing.T) {
+	c := newC(t)
+	for i := 0; i < 1000; i++ {
+		c.add(fmt.Sprintf("key%06d", i*2), fmt.Sprintf("val%d", i))
+	}
+
+	cases := []struct {
+		key   string
+		cmp   int
+		valid bool
+		want  string
+	}{
+		{"key000100", CMP_GE, true, "key000100"},
+		{"key000100", CMP_GT, true, "key000102"},
+		{"key000100", CMP_LE, true, "key000100"},
+		{"key000100", CMP_LT, true, "key000098"},
+		{"key000101", CMP_GE, true, "key000102"},
+		{"key000101", CMP_GT, true, "key000102"},
+		{"key000101", CMP_LE, true, "key000100"},
+		{"key000101", CMP_LT, true, "key000100"},
+		{"a", CMP_GE, true, "key000000"},
+		{"a", CMP_LT, false, ""},
+		{"key000000", CMP_LT, false, ""},
+		{"z", CMP_LT, true, "key001998"},
+		{"z", CMP_GT, false, ""},
+		{"key001998", CMP_GT, false, ""},
+	}
+	for _, tc := range cases {
+		iter := c.tree.Seek([]byte(tc.key), tc.cmp)
+		assert.Equal(t, tc.valid, iter.Valid(), "%s %d", tc.key, tc.cmp)
+		if tc.valid {
+			assert.Equal(t, tc.want, string(iter.Key()), "%s %d", tc.key, tc.cmp)
+		}
+	}
+
+	iter := c.tree.SeekLast()
+	assert.True(t, iter.Valid())
+	assert.Equal(t, "key001998", string(iter.Key()))
+}
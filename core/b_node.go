@@ -3,7 +3,6 @@ package core
 import (
 	"bytes"
 	"encoding/binary"
-	"fmt"
 )
 
 const (
@@ -11,13 +10,49 @@ const (
 	BNODE_LEAF = 2 // leaf nodes with values
 )
 
+// a flag in the type field, the node has a shared key prefix (since "BuildYourOwnDB08").
+const BNODE_PREFIX = 1 << 8
+
+// a flag in the type field, the internal node has subtree counts (since "BuildYourOwnDB09").
+const BNODE_COUNTS = 1 << 9
+
+// a flag in a subtree count, no value under the kid is in overflow pages (since "BuildYourOwnDB12").
+const COUNT_NO_OVERFLOW = 1 << 63
+
 /*
-a node's data formate:
-| type | nkeys | pointers   | offsets    | key-values
-| 2B   | 2B    | nkeys * 8B | nkeys * 2B | ...
-This is the format of the KV pair. Lengths followed by data.
-| klen | vlen | key | val |
-| 2B   | 2B   | ... | ... |
+Leaf nodes and internal nodes use different formats (since "BuildYourOwnDB07").
+Leaf nodes do not need pointers and internal nodes do not need values.
+The checksum is stamped by the KV when the page is written, see pageSetChecksum().
+
+The keys of a node often share a long prefix, it's stored once after the header
+and only the rest of each key is stored in the KV area. The prefix is the common
+prefix of the first and the last key (capped at BTREE_MAX_PREFIX_SIZE),
+it may end earlier depending on the key order, see Comparator.PrefixStop.
+The nodes of "BuildYourOwnDB07" don't have the BNODE_PREFIX flag and the prefix part.
+| plen | prefix |
+| 2B   | ...    |
+
+An internal node stores the number of leaf KVs under each child (the dummy key
+included), so the rank of a key can be found without visiting the leaves.
+The internal nodes before "BuildYourOwnDB09" don't have the BNODE_COUNTS flag and the counts.
+The high bit of a count is the COUNT_NO_OVERFLOW flag, so that a subtree deleted
+as a whole doesn't read the leaves without overflow pages to free, see freeSubtree().
+The counts before "BuildYourOwnDB12" don't have the flag, their leaves are read.
+
+a leaf node's data formate:
+| type | nkeys | checksum | prefix | offsets    | key-values
+| 2B   | 2B    | 4B       | ...    | nkeys * 2B | ...
+The vlen is not stored, it's inferred from the offset of the next KV pair.
+The high bit of klen marks a value stored in overflow pages, see overflow.go.
+| klen | key | val |
+| 2B   | ... | ... |
+
+an internal node's data formate:
+| type | nkeys | checksum | prefix | pointers   | counts     | offsets    | keys
+| 2B   | 2B    | 4B       | ...    | nkeys * 8B | nkeys * 8B | nkeys * 2B | ...
+The klen is not stored either, a key ends where the next key begins.
+
+The formats before it are in legacy.go, they are only read to upgrade old files.
 */
 type BNode struct {
 	data []byte // can be dumped to the disk
@@ -25,7 +60,7 @@ type BNode struct {
 
 // header
 func (node BNode) btype() uint16 {
-	return binary.LittleEndian.Uint16(node.data)
+	return binary.LittleEndian.Uint16(node.data) &^ (BNODE_PREFIX | BNODE_COUNTS)
 }
 func (node BNode) nkeys() uint16 {
 	return binary.LittleEndian.Uint16(node.data[2:4])
@@ -33,24 +68,114 @@ func (node BNode) nkeys() uint16 {
 
 // A fixed-sized header containing the type of the node
 // (leaf node or internal node) and the number of keys.
+// The prefix is empty until setPrefix() is called.
 func (node BNode) setHeader(btype uint16, nkeys uint16) {
-	binary.LittleEndian.PutUint16(node.data[0:2], btype)
+	flags := uint16(BNODE_PREFIX)
+	if btype == BNODE_NODE {
+		flags |= BNODE_COUNTS
+	}
+	binary.LittleEndian.PutUint16(node.data[0:2], btype|flags)
 	binary.LittleEndian.PutUint16(node.data[2:4], nkeys)
+	binary.LittleEndian.PutUint16(node.data[HEADER:], 0)
+}
+
+// prefix
+func (node BNode) getPrefix() []byte {
+	if binary.LittleEndian.Uint16(node.data)&BNODE_PREFIX == 0 {
+		return nil
+	}
+	plen := binary.LittleEndian.Uint16(node.data[HEADER:])
+	return node.data[HEADER+2:][:plen]
+}
+
+// must be called after setHeader() and before adding any keys.
+func (node BNode) setPrefix(prefix []byte) {
+	binary.LittleEndian.PutUint16(node.data[HEADER:], uint16(len(prefix)))
+	copy(node.data[HEADER+2:], prefix)
+}
+
+// where the pointers (or the offsets for leaf nodes) start.
+func (node BNode) bodyPos() uint16 {
+	if binary.LittleEndian.Uint16(node.data)&BNODE_PREFIX == 0 {
+		return HEADER
+	}
+	return HEADER + 2 + binary.LittleEndian.Uint16(node.data[HEADER:])
+}
+
+// the bytes taken by each key besides the KV data in a new node:
+// the pointer and the count (internal nodes only) and the offset.
+func keyOverhead(btype uint16) uint16 {
+	if btype == BNODE_NODE {
+		return 8 + 8 + 2
+	}
+	return 2
+}
+
+// keyOverhead() of this node, which can be an older internal node without counts.
+func (node BNode) overhead() uint16 {
+	flags := binary.LittleEndian.Uint16(node.data)
+	if node.btype() == BNODE_NODE && flags&BNODE_COUNTS == 0 {
+		return 8 + 2
+	}
+	return keyOverhead(node.btype())
 }
 
-// pointers
+// pointers, internal nodes only
 func (node BNode) getPtr(idx uint16) uint64 {
 	// 获取指向子节点的指针
 	//assert(idx < node.nkeys()) todo:增加err处理
-	pos := HEADER + 8*idx
+	pos := node.bodyPos() + 8*idx
 	return binary.LittleEndian.Uint64(node.data[pos:])
 }
 func (node BNode) setPtr(idx uint16, val uint64) {
 	//assert(idx < node.nkeys())
-	pos := HEADER + 8*idx
+	pos := node.bodyPos() + 8*idx
 	binary.LittleEndian.PutUint64(node.data[pos:], val)
 }
 
+// subtree counts, internal nodes only
+func (node BNode) getCount(idx uint16) uint64 {
+	return node.getCountFlags(idx) &^ COUNT_NO_OVERFLOW
+}
+
+// the count with the COUNT_NO_OVERFLOW flag, it's copied as is for an unchanged kid.
+func (node BNode) getCountFlags(idx uint16) uint64 {
+	pos := node.bodyPos() + 8*node.nkeys() + 8*idx
+	return binary.LittleEndian.Uint64(node.data[pos:])
+}
+
+// the count can have the COUNT_NO_OVERFLOW flag, see nodeCountFlags().
+func (node BNode) setCount(idx uint16, count uint64) {
+	pos := node.bodyPos() + 8*node.nkeys() + 8*idx
+	binary.LittleEndian.PutUint64(node.data[pos:], count)
+}
+
+// the number of leaf KVs under the node.
+func nodeTotal(node BNode) uint64 {
+	if node.btype() == BNODE_LEAF {
+		return uint64(node.nkeys())
+	}
+	total := uint64(0)
+	for i := uint16(0); i < node.nkeys(); i++ {
+		total += node.getCount(i)
+	}
+	return total
+}
+
+// the count of the node with the flags, as stored in its parent.
+func nodeCountFlags(node BNode) uint64 {
+	flags := uint64(COUNT_NO_OVERFLOW)
+	for i := uint16(0); i < node.nkeys(); i++ {
+		if node.btype() == BNODE_LEAF && leafIsOverflow(node, i) {
+			flags = 0
+		}
+		if node.btype() == BNODE_NODE {
+			flags &= node.getCountFlags(i)
+		}
+	}
+	return nodeTotal(node) | flags
+}
+
 // The offset is relative to the position of the first KV pair.
 // The offset of the first KV pair is always zero, so it is not stored in the list.
 // We store the offset to the end of the last KV pair in the offset list,
@@ -60,10 +185,10 @@ func offsetPos(node BNode, idx uint16) uint16 {
 	//	assert(1 <= idx && idx <= node.nkeys())
 	// 每个偏移量占用2个字节，所以乘以2
 	// 这里的计算都是以Byte为单位的
-	// 8*node.nkeys()就是pointers的位置，因为一个指针8Bytes
+	// 8*node.nkeys()就是pointers的位置，因为一个指针8Bytes，叶子节点没有pointers
 	// 这里是计算出offet字节的位置，然后再根据offet对应的值来算出对应的kvs的位置
 	// 因为idx=0的话，偏移量就是0，所以offset从idx=1开始存储
-	return HEADER + 8*node.nkeys() + 2*(idx-1)
+	return node.bodyPos() + (node.overhead()-2)*node.nkeys() + 2*(idx-1)
 }
 
 // 这个函数来获取offet字节数组存储的值
@@ -81,22 +206,46 @@ func (node BNode) setOffset(idx uint16, offset uint16) {
 // 注意这些偏移量，可以非常快速地定位kv
 func (node BNode) kvPos(idx uint16) uint16 {
 	//assert(idx <= node.nkeys())
-	return HEADER + 8*node.nkeys() + 2*node.nkeys() + node.getOffset(idx)
+	return node.bodyPos() + node.overhead()*node.nkeys() + node.getOffset(idx)
 }
-func (node BNode) getKey(idx uint16) []byte {
+
+// the klen of a leaf KV, without the overflow flag.
+func (node BNode) leafKlen(pos uint16) uint16 {
+	return binary.LittleEndian.Uint16(node.data[pos:]) &^ LEAF_VAL_OVERFLOW
+}
+
+// the stored part of a key, without the node prefix.
+func (node BNode) getSuffix(idx uint16) []byte {
 	//assert(idx < node.nkeys())
 	pos := node.kvPos(idx)
+	if node.btype() == BNODE_NODE {
+		// 内部节点只有 key，下一个 key 的位置就是这个 key 的结尾
+		return node.data[pos:node.kvPos(idx+1)]
+	}
 	// 获取key的字节长度(2 bytes for key)
-	klen := binary.LittleEndian.Uint16(node.data[pos:])
-	// pos+4是跳过klen+vlen
-	return node.data[pos+4:][:klen]
+	klen := node.leafKlen(pos)
+	// pos+2是跳过klen
+	return node.data[pos+2:][:klen]
 }
+
+// the full key. it's a copy if the node has a prefix.
+func (node BNode) getKey(idx uint16) []byte {
+	prefix := node.getPrefix()
+	suffix := node.getSuffix(idx)
+	if len(prefix) == 0 {
+		return suffix
+	}
+	key := make([]byte, 0, len(prefix)+len(suffix))
+	return append(append(key, prefix...), suffix...)
+}
+
+// leaf nodes only
 func (node BNode) getVal(idx uint16) []byte {
 	//assert(idx < node.nkeys())
 	pos := node.kvPos(idx)
-	klen := binary.LittleEndian.Uint16(node.data[pos+0:])
-	vlen := binary.LittleEndian.Uint16(node.data[pos+2:])
-	return node.data[pos+4+klen:][:vlen]
+	klen := node.leafKlen(pos)
+	// vlen 没有存储，value 的结尾就是下一个 KV 的开始
+	return node.data[pos+2+klen : node.kvPos(idx+1)]
 }
 
 // node size in bytes
@@ -110,19 +259,28 @@ func (node BNode) nbytes() uint16 {
 // returns the first kid node whose range intersects the key. (kid[i] <= key)
 // TODO: bisect
 // The lookup works for both leaf nodes and internal nodes.
-func nodeLookupLE(node BNode, key []byte) uint16 {
+func nodeLookupLE(cmp *Comparator, node BNode, key []byte) uint16 {
 	nkeys := node.nkeys()
 	found := uint16(0)
+	// all keys in the node share the prefix, compare it only once
+	prefix := node.getPrefix()
+	if !bytes.HasPrefix(key, prefix) {
+		if cmp.compare(key, prefix) < 0 {
+			return 0 // less than all keys
+		}
+		return nkeys - 1 // greater than all keys
+	}
+	key = key[len(prefix):]
 	// the first key is a copy from the parent node,
 	// thus it's always less than or equal to the key.
 	// Note that the first key is skipped for comparison,
 	//  since it has already been compared from the parent node
 	for i := uint16(1); i < nkeys; i++ {
-		cmp := bytes.Compare(node.getKey(i), key)
-		if cmp <= 0 {
+		r := cmp.compare(node.getSuffix(i), key)
+		if r <= 0 {
 			found = i
 		}
-		if cmp >= 0 {
+		if r >= 0 {
 			break
 		}
 	}
@@ -131,6 +289,7 @@ func nodeLookupLE(node BNode, key []byte) uint16 {
 
 // add a new key to a leaf node
 func leafInsert(
+	cmp *Comparator,
 	new BNode,
 	old BNode,
 	idx uint16,
@@ -138,6 +297,14 @@ func leafInsert(
 	val []byte,
 ) {
 	new.setHeader(BNODE_LEAF, old.nkeys()+1)
+	first, last := key, key
+	if idx > 0 {
+		first = old.getKey(0)
+	}
+	if idx < old.nkeys() {
+		last = old.getKey(old.nkeys() - 1)
+	}
+	new.setPrefix(nodePrefix(cmp, first, last))
 	nodeAppendRange(new, old, 0, 0, idx)
 	nodeAppendKV(new, idx, 0, key, val)
 	// idx右边的key右移
@@ -157,10 +324,26 @@ func nodeAppendRange(
 	if n == 0 {
 		return
 	}
+	if !bytes.Equal(new.getPrefix(), old.getPrefix()) {
+		// 前缀不一样，不能直接复制，要把 key 一个一个重新编码
+		for i := uint16(0); i < n; i++ {
+			if old.btype() == BNODE_NODE {
+				nodeAppendKV(new, dstNew+i, old.getPtr(srcOld+i), old.getKey(srcOld+i), nil)
+				new.setCount(dstNew+i, old.getCountFlags(srcOld+i))
+				continue
+			}
+			nodeAppendKV(new, dstNew+i, 0, old.getKey(srcOld+i), old.getVal(srcOld+i))
+			if leafIsOverflow(old, srcOld+i) {
+				leafSetOverflow(new, dstNew+i)
+			}
+		}
+		return
+	}
 	// pointers
 	// 注意是小于n
-	for i := uint16(0); i < n; i++ {
+	for i := uint16(0); old.btype() == BNODE_NODE && i < n; i++ {
 		new.setPtr(dstNew+i, old.getPtr(srcOld+i))
+		new.setCount(dstNew+i, old.getCountFlags(srcOld+i))
 	}
 
 	// 复制offset
@@ -175,33 +358,38 @@ func nodeAppendRange(
 	// KVs
 	begin := old.kvPos(srcOld)
 	end := old.kvPos(srcOld + n)
-	//todo:这里报错了,既然能超出边界，那说明在merge的时候可能创建了一个超大节点
-	fmt.Println("new.kvPos(dstNew):", new.kvPos(dstNew))
-	fmt.Println("begin:", begin, "end:", end)
-	fmt.Println("len(new.data):", len(new.data))
-	fmt.Println("len(old.data[begin:end]):", len(old.data[begin:end]))
 	copy(new.data[new.kvPos(dstNew):], old.data[begin:end])
 }
 
-// copy a KV into the position
+// copy a KV into the position.
+// `ptr` is for internal nodes and `val` is for leaf nodes, the other one is ignored.
+// the key must start with the node prefix, only the rest of it is stored.
 func nodeAppendKV(new BNode, idx uint16, ptr uint64, key []byte, val []byte) {
-	// ptrs
-	new.setPtr(idx, ptr)
-	// KVs
+	key = key[len(new.getPrefix()):]
 	pos := new.kvPos(idx)
+	if new.btype() == BNODE_NODE {
+		// ptrs
+		new.setPtr(idx, ptr)
+		// keys
+		copy(new.data[pos:], key)
+		new.setOffset(idx+1, new.getOffset(idx)+uint16(len(key)))
+		return
+	}
+	// KVs
 	binary.LittleEndian.PutUint16(new.data[pos+0:], uint16(len(key)))
-	binary.LittleEndian.PutUint16(new.data[pos+2:], uint16(len(val)))
-	copy(new.data[pos+4:], key)
-	copy(new.data[pos+4+uint16(len(key)):], val)
+	copy(new.data[pos+2:], key)
+	copy(new.data[pos+2+uint16(len(key)):], val)
 	// the offset of the next key
-	// 计算当前键值对（键长度、值长度、键和值本身）的总字节数，作为下一个键值对的偏移量
+	// 计算当前键值对（键长度、键和值本身）的总字节数，作为下一个键值对的偏移量
 	// 因为当前键值对的存储过程会直接影响下一个键值对的存储位置
-	new.setOffset(idx+1, new.getOffset(idx)+4+uint16((len(key)+len(val))))
+	new.setOffset(idx+1, new.getOffset(idx)+2+uint16((len(key)+len(val))))
 }
 
-func leafUpdate(new BNode, old BNode, idx uint16, key []byte, val []byte) {
+func leafUpdate(cmp *Comparator, new BNode, old BNode, idx uint16, key []byte, val []byte) {
 	// 更新叶子节点的键值对数量（数量保持不变）
 	new.setHeader(BNODE_LEAF, old.nkeys())
+	// key 没有变，所以前缀也不变
+	new.setPrefix(nodePrefix(cmp, old.getKey(0), old.getKey(old.nkeys()-1)))
 
 	// 1. 复制 `idx` 之前的键值对
 	nodeAppendRange(new, old, 0, 0, idx)
@@ -222,88 +410,126 @@ func nodeInsert(
 	tree *BTree,
 	new BNode, node BNode,
 	idx uint16,
-	key []byte,
-	val []byte,
-) {
-	// get and deallocate the kid node
+	req *UpdateReq,
+) error {
+	// get the kid node
 	kptr := node.getPtr(idx)
-	knode := tree.get(kptr)
-	tree.del(kptr)
+	knode, err := tree.get(kptr)
+	if err != nil {
+		return err
+	}
 	// recursive insertion to the kid node
-	knode = treeInsert(tree, knode, key, val)
+	if knode, err = treeInsert(tree, knode, req); err != nil || len(knode.data) == 0 {
+		return err // not updated
+	}
+	// deallocate the kid node
+	if err := tree.del(kptr); err != nil {
+		return err
+	}
 	// split the result
-	nsplit, splited := nodeSplit3(knode)
+	nsplit, splited := nodeSplit3(tree.cmp, knode)
 	// update the kid links
 	// 这里的new和node变量，都是分裂出来的字节点的父节点
-	nodeReplaceKidN(tree, new, node, idx, splited[:nsplit]...)
+	return nodeReplaceKidN(tree, new, node, idx, splited[:nsplit]...)
 }
 
 // split a bigger-than-allowed node into two.
 // the second node always fits on a page.
 // 这个函数是我自己实现的，一定要加单测
-func nodeSplit2(left BNode, right BNode, old BNode) {
-	// [splitIdx,...)为右节点,[0,idx)是左节点，注意是左闭右开
-	splitIdx := old.nkeys()
-	tryIdx := splitIdx - 1
-
-	// 动态调整分裂点，确保右节点大小符合页面限制
-	for {
-		// 计算右节点的大小
-		rightSize := old.nbytes() - old.kvPos(tryIdx)
-		if rightSize <= BTREE_PAGE_SIZE {
-			if tryIdx == 1 {
-				splitIdx = tryIdx
-				break // 已经无法再向左调整，不然左节点就是空节点了
-			}
-			if rightSize == BTREE_PAGE_SIZE {
-				splitIdx = tryIdx
-				break
-			}
-			// 还有空间可以放
-			splitIdx = tryIdx
-			tryIdx--
-			continue
-		}
-		// 到达极限了
-		splitIdx = tryIdx + 1
-		if splitIdx == old.nkeys() { // 到达这一步，那就是右节点会是空节点
-			panic("Cannot split: no valid split point found")
-		}
-		break
+// 之前的实现是尽量把 key 都放进右节点，结果左节点几乎总是只有 1 个 key，
+// 顺序插入时树会退化成每个节点只有一个 key。现在从中间开始找分裂点。
+func nodeSplit2(cmp *Comparator, left BNode, right BNode, old BNode) {
+	// [0, nleft) 为左节点，[nleft, nkeys) 为右节点
+	nleft := old.nkeys() / 2
+	if nleft == 0 {
+		panic("Cannot split: no valid split point found")
+	}
+	nkeys := old.nkeys()
+	// 左右节点的大小（header + prefix + pointers + offsets + KVs）
+	// 分裂后每个节点都有自己的前缀，所以大小要按新的前缀来算
+	leftBytes := func() int {
+		return nodeRangeBytes(cmp, old, 0, nleft)
+	}
+	rightBytes := func() int {
+		return nodeRangeBytes(cmp, old, nleft, nkeys)
 	}
+	// 先保证左节点不超过一页（左节点之后还可以再分裂，这里只是尽量平均）
+	for nleft > 1 && leftBytes() > BTREE_PAGE_SIZE {
+		nleft--
+	}
+	// 右节点一定要放得进一页
+	for nleft < nkeys && rightBytes() > BTREE_PAGE_SIZE {
+		nleft++
+	}
+	if nleft >= nkeys { // 到达这一步，那就是右节点会是空节点
+		panic("Cannot split: no valid split point found")
+	}
+
+	nodeSplitAt(cmp, left, right, old, nleft)
+}
 
+// split a node into [0, nleft) and [nleft, nkeys).
+func nodeSplitAt(cmp *Comparator, left BNode, right BNode, old BNode, nleft uint16) {
+	nkeys := old.nkeys()
 	// 设置左节点和右节点的头部
-	left.setHeader(old.btype(), splitIdx)
-	right.setHeader(old.btype(), old.nkeys()-splitIdx)
+	left.setHeader(old.btype(), nleft)
+	left.setPrefix(nodePrefix(cmp, old.getKey(0), old.getKey(nleft-1)))
+	right.setHeader(old.btype(), nkeys-nleft)
+	right.setPrefix(nodePrefix(cmp, old.getKey(nleft), old.getKey(nkeys-1)))
 
 	// 将数据复制到左节点
-	// 注意是左闭右开，splitIdx至少要等于1，不然左节点是空的
-	nodeAppendRange(left, old, 0, 0, splitIdx)
+	// 注意是左闭右开，nleft 至少要等于1，不然左节点是空的
+	nodeAppendRange(left, old, 0, 0, nleft)
 
 	// 将数据复制到右节点
-	nodeAppendRange(right, old, 0, splitIdx, old.nkeys()-splitIdx)
+	nodeAppendRange(right, old, 0, nleft, nkeys-nleft)
+}
+
+// the size of a node holding the keys [begin, end) of `old`,
+// with the prefix shared by those keys.
+func nodeRangeBytes(cmp *Comparator, old BNode, begin uint16, end uint16) int {
+	plen := len(nodePrefix(cmp, old.getKey(begin), old.getKey(end-1)))
+	n := int(end - begin)
+	return HEADER + 2 + plen + int(keyOverhead(old.btype()))*n + nodeKVBytes(old, begin, end, plen)
+}
+
+// the size of the KVs [begin, end) of a node if its prefix length were `plen`.
+// a shorter prefix makes every key longer.
+func nodeKVBytes(node BNode, begin uint16, end uint16, plen int) int {
+	kv := int(node.getOffset(end)) - int(node.getOffset(begin))
+	return kv + int(end-begin)*(len(node.getPrefix())-plen)
+}
+
+// the buffer size for a node built from `old` that might be bigger than a page.
+// if the prefix becomes shorter, every key grows by up to the old prefix length.
+func nodeBufSize(old BNode) int {
+	return 2*BTREE_PAGE_SIZE + int(old.nkeys())*len(old.getPrefix())
 }
 
 // split a node if it's too big. the results are 1~3 nodes.
 // 检查子节点是否需要分裂。如果子节点的大小超出了限制，则将其分裂为 2 或 3 个新节点
-func nodeSplit3(old BNode) (uint16, [3]BNode) {
+func nodeSplit3(cmp *Comparator, old BNode) (uint16, [3]BNode) {
 	if old.nbytes() <= BTREE_PAGE_SIZE {
 		old.data = old.data[:BTREE_PAGE_SIZE]
 		return 1, [3]BNode{old}
 	}
 	// 这里的逻辑是，确保right节点一定在page size范围内
-	left := BNode{make([]byte, 2*BTREE_PAGE_SIZE)} // might be split later
+	// 左节点的 key 是 old 的一部分，前缀只会更长，所以不会比 old 大
+	left := BNode{make([]byte, len(old.data))} // might be split later
 	right := BNode{make([]byte, BTREE_PAGE_SIZE)}
-	nodeSplit2(left, right, old)
+	nodeSplit2(cmp, left, right, old)
 	if left.nbytes() <= BTREE_PAGE_SIZE {
 		left.data = left.data[:BTREE_PAGE_SIZE]
 		return 2, [3]BNode{left, right}
 	}
 	// the left node is still too large
-	leftleft := BNode{make([]byte, BTREE_PAGE_SIZE)}
+	leftleft := BNode{make([]byte, len(left.data))}
 	middle := BNode{make([]byte, BTREE_PAGE_SIZE)}
-	nodeSplit2(leftleft, middle, left)
-	//assert(leftleft.nbytes() <= BTREE_PAGE_SIZE)
+	nodeSplit2(cmp, leftleft, middle, left)
+	if leftleft.nbytes() > BTREE_PAGE_SIZE {
+		panic("Cannot split: the node doesn't fit in 3 pages")
+	}
+	leftleft.data = leftleft.data[:BTREE_PAGE_SIZE]
 	return 3, [3]BNode{leftleft, middle, right}
 }
 
@@ -311,67 +537,162 @@ func nodeSplit3(old BNode) (uint16, [3]BNode) {
 func nodeReplaceKidN(
 	tree *BTree, new BNode, old BNode, idx uint16,
 	kids ...BNode,
-) {
+) error {
+	return nodeReplaceKids(tree, new, old, idx, 1, kids...)
+}
+
+// replace the `nold` links from idx with multiple links
+func nodeReplaceKids(
+	tree *BTree, new BNode, old BNode, idx uint16, nold uint16,
+	kids ...BNode,
+) error {
 	// 分裂出来的字节点数（如果是1，那就是没分裂）
 	inc := uint16(len(kids))
-	// 减去 1 是因为我们正在替换原来一个子节点
-	new.setHeader(BNODE_NODE, old.nkeys()+inc-1)
+	// 减去 nold 是因为我们正在替换原来的子节点
+	new.setHeader(BNODE_NODE, old.nkeys()+inc-nold)
+	first, last := kids[0].getKey(0), kids[inc-1].getKey(0)
+	if idx > 0 {
+		first = old.getKey(0)
+	}
+	if idx+nold < old.nkeys() {
+		last = old.getKey(old.nkeys() - 1)
+	}
+	new.setPrefix(nodePrefix(tree.cmp, first, last))
 	// 注意是左闭右开，所以这里的idx是不包括被复制的
 	nodeAppendRange(new, old, 0, 0, idx)
 	for i, kNode := range kids {
 		// 从idx这里的位置开始，开始放置分裂后的字节点
 		// 	node.getKey(0) 是为了获取 新子节点 的第一个键，这个键会用于更新父节点中指向该子节点的指针
-		nodeAppendKV(new, idx+uint16(i), tree.new(kNode), kNode.getKey(0), nil)
+		ptr, err := tree.new(kNode)
+		if err != nil {
+			return err
+		}
+		nodeAppendKV(new, idx+uint16(i), ptr, kNode.getKey(0), nil)
+		new.setCount(idx+uint16(i), nodeCountFlags(kNode))
 	}
-	// 从 old 节点中复制从 idx + 1 到最后的所有元素
+	// 从 old 节点中复制从 idx + nold 到最后的所有元素
 	// 新节点从idx+inc开始填放，因为上面的遍历kids里面，最后一个放置的字节点的位置是idx+inc-1
-	nodeAppendRange(new, old, idx+inc, idx+1, old.nkeys()-(idx+1))
+	nodeAppendRange(new, old, idx+inc, idx+nold, old.nkeys()-(idx+nold))
+	return nil
 }
 
 // remove a key from a leaf node
-func leafDelete(new BNode, old BNode, idx uint16) {
-	new.setHeader(BNODE_LEAF, old.nkeys()-1)
-	nodeAppendRange(new, old, 0, 0, idx)
-	nodeAppendRange(new, old, idx, idx+1, old.nkeys()-(idx+1))
+func leafDelete(cmp *Comparator, new BNode, old BNode, idx uint16) {
+	nodeRemove(cmp, new, old, idx)
+}
+
+// remove a key from a node of either type
+func nodeRemove(cmp *Comparator, new BNode, old BNode, idx uint16) {
+	nodeRemoveRange(cmp, new, old, idx, idx+1)
+}
+
+// remove the keys [begin, end) from a node of either type
+func nodeRemoveRange(cmp *Comparator, new BNode, old BNode, begin uint16, end uint16) {
+	nkeys := old.nkeys() - (end - begin)
+	new.setHeader(old.btype(), nkeys)
+	if nkeys > 0 {
+		first, last := old.getKey(0), old.getKey(old.nkeys()-1)
+		if begin == 0 {
+			first = old.getKey(end)
+		}
+		if end == old.nkeys() {
+			last = old.getKey(begin - 1)
+		}
+		// 删掉第一个或最后一个 key 之后，前缀可能会变长
+		new.setPrefix(nodePrefix(cmp, first, last))
+	}
+	nodeAppendRange(new, old, 0, 0, begin)
+	nodeAppendRange(new, old, begin, end, old.nkeys()-end)
 }
 
 // part of the treeDelete()
-func nodeDelete(tree *BTree, node BNode, idx uint16, key []byte) BNode {
+func nodeDelete(tree *BTree, node BNode, idx uint16, key []byte) (BNode, error) {
 	// recurse into the kid
 	kptr := node.getPtr(idx)
+	kid, err := tree.get(kptr)
+	if err != nil {
+		return BNode{}, err
+	}
 	// 这里返回的updated就是已经更新过的叶子节点
-	updated := treeDelete(tree, tree.get(kptr), key)
-	if len(updated.data) == 0 {
-		return BNode{} // not found
+	updated, err := treeDelete(tree, kid, key)
+	if err != nil || len(updated.data) == 0 {
+		return BNode{}, err // not found
+	}
+	if err := tree.del(kptr); err != nil {
+		return BNode{}, err
 	}
-	tree.del(kptr)
 	// 注意，这里的new是代替node，而node是中间节点
-	new := BNode{data: make([]byte, BTREE_PAGE_SIZE)}
+	// 子节点的第一个 key 变了之后，new 可能会比 node 大（key 变长或者前缀变短），
+	// 超过一页的话由上一层来分裂
+	new := BNode{data: make([]byte, nodeBufSize(node))}
 	// check for merging
-	mergeDir, sibling := shouldMerge(tree, node, idx, updated)
+	mergeDir, sibling, err := shouldMerge(tree, node, idx, updated)
+	if err != nil {
+		return BNode{}, err
+	}
 	switch {
 	case mergeDir < 0: // left
 		merged := BNode{data: make([]byte, BTREE_PAGE_SIZE)}
-		nodeMerge(merged, sibling, updated)
-		tree.del(node.getPtr(idx - 1))
-		nodeReplace2Kid(new, node, idx-1, tree.new(merged), merged.getKey(0))
+		nodeMerge(tree.cmp, merged, sibling, updated)
+		if err := nodeMergeKid(tree, new, node, idx-1, node.getPtr(idx-1), merged); err != nil {
+			return BNode{}, err
+		}
 	case mergeDir > 0: // right
 		merged := BNode{data: make([]byte, BTREE_PAGE_SIZE)}
-		nodeMerge(merged, updated, sibling)
-		tree.del(node.getPtr(idx + 1))
-		nodeReplace2Kid(new, node, idx, tree.new(merged), merged.getKey(0))
-	case mergeDir == 0: // no need to merge
-		//assert(updated.nkeys() > 0)
-		nodeReplaceKidN(tree, new, node, idx, updated)
+		nodeMerge(tree.cmp, merged, updated, sibling)
+		if err := nodeMergeKid(tree, new, node, idx, node.getPtr(idx+1), merged); err != nil {
+			return BNode{}, err
+		}
+	case updated.nkeys() == 0:
+		// an empty kid that can't be merged, this happens when it's the only kid.
+		// remove it, an empty node is then merged or removed by its parent.
+		nodeRemove(tree.cmp, new, node, idx)
+	case sibling.data != nil:
+		// too big to merge, move some keys from the sibling instead
+		ok, err := nodeRedistribute(tree, new, node, idx, updated, sibling)
+		if err != nil {
+			return BNode{}, err
+		}
+		if ok {
+			break
+		}
+		fallthrough
+	default: // no need to merge
+		nsplit, splited := nodeSplit3(tree.cmp, updated)
+		if err := nodeReplaceKidN(tree, new, node, idx, splited[:nsplit]...); err != nil {
+			return BNode{}, err
+		}
 	}
-	return new
+	return new, nil
+}
+
+// replace the kids at idx and idx+1 with the merged node and deallocate the sibling.
+func nodeMergeKid(tree *BTree, new BNode, node BNode, idx uint16, sibling uint64, merged BNode) error {
+	if err := tree.del(sibling); err != nil {
+		return err
+	}
+	ptr, err := tree.new(merged)
+	if err != nil {
+		return err
+	}
+	nodeReplace2Kid(tree.cmp, new, node, idx, ptr, merged.getKey(0), nodeCountFlags(merged))
+	return nil
 }
 
 // new代表父节点,node代表原来的父节点
 // idx 代表 合并后子节点在父节点中的索引位置。
-func nodeReplace2Kid(new, node BNode, idx uint16, u2 uint64, b []byte) {
+// count 是合并后子节点的 KV 数量
+func nodeReplace2Kid(cmp *Comparator, new, node BNode, idx uint16, u2 uint64, b []byte, count uint64) {
 	// 更新父节点的头部，新的子节点数量为原节点子节点数量 - 1（因为我们替换了一个原有的子节点）
 	new.setHeader(BNODE_NODE, node.nkeys()-1) // 更新新的父节点的子节点数量
+	first, last := b, b
+	if idx > 0 {
+		first = node.getKey(0)
+	}
+	if idx+2 < node.nkeys() {
+		last = node.getKey(node.nkeys() - 1)
+	}
+	new.setPrefix(nodePrefix(cmp, first, last))
 
 	// 2. 将原节点 `node` 中的 idx 之前的子节点复制到 `new` 中
 	// `nodeAppendRange` 将原节点中的子节点指针从索引 0 到 idx（不包括 idx）复制到 `new` 中
@@ -382,45 +703,132 @@ func nodeReplace2Kid(new, node BNode, idx uint16, u2 uint64, b []byte) {
 	// `nodeAppendKV` 将新子节点的指针 `u2` 插入到新节点 `new` 中，并在父节点中更新相应的键 `b`
 	// `u2` 是新的子节点的指针，`b` 是新子节点的第一个键
 	nodeAppendKV(new, idx, u2, b, nil) // 插入新的子节点指针 `u2` 和相应的键 `b` 到父节点中
-
-	// 4. 将 `node` 中 idx 之后的子节点复制到 `new` 中
-	// dstNew := idx+1：目标节点 new 中，插入数据的起始位置是 idx+1。这个位置是用来接收 父节点中 idx+1 之后的所有子节点。即我们要从源节点 node 中复制的数据会插入到 new 的第 idx+1 位置开始。
-	// srcOld := idx+1：源节点 node 中，复制的数据从 idx+1 开始，也就是从父节点 node 中的 第 idx+1 个子节点开始。这是因为我们刚刚删除了 idx 位置的子节点，因此需要将 idx+1 之后的所有子节点指针复制到新的父节点
-	nodeAppendRange(new, node, idx+1, idx+1, node.nkeys()-(idx+1)) // 将原节点中 idx 之后的子节点复制到新节点
+	new.setCount(idx, count)
+
+	// 4. 将 `node` 中 idx+1 之后的子节点复制到 `new` 中
+	// dstNew := idx+1：目标节点 new 中，插入数据的起始位置是 idx+1。
+	// srcOld := idx+2：原节点中 idx 和 idx+1 这两个子节点已经被合并成了上面的 u2，
+	// 所以要从 idx+2 开始复制，数量是 node.nkeys()-(idx+2)。
+	// 之前这里写成了 idx+1，会多复制一个子节点，导致 new 越界（readme 里提到的 del bug）
+	nodeAppendRange(new, node, idx+1, idx+2, node.nkeys()-(idx+2)) // 将原节点中 idx+1 之后的子节点复制到新节点
 }
 
 // merge 2 nodes into 1
-func nodeMerge(new BNode, left BNode, right BNode) {
+func nodeMerge(cmp *Comparator, new BNode, left BNode, right BNode) {
 	new.setHeader(left.btype(), left.nkeys()+right.nkeys())
+	new.setPrefix(nodeMergedPrefix(cmp, left, right))
 	nodeAppendRange(new, left, 0, 0, left.nkeys())
 	nodeAppendRange(new, right, left.nkeys(), 0, right.nkeys())
 }
 
+// the prefix of the merged node, one of the nodes can be empty after a deletion.
+func nodeMergedPrefix(cmp *Comparator, left BNode, right BNode) []byte {
+	switch {
+	case left.nkeys() == 0 && right.nkeys() == 0:
+		return nil
+	case left.nkeys() == 0:
+		return nodePrefix(cmp, right.getKey(0), right.getKey(right.nkeys()-1))
+	case right.nkeys() == 0:
+		return nodePrefix(cmp, left.getKey(0), left.getKey(left.nkeys()-1))
+	default:
+		return nodePrefix(cmp, left.getKey(0), right.getKey(right.nkeys()-1))
+	}
+}
+
+// the size of the merged node, the merged prefix can be shorter than both.
+func nodeMergedBytes(cmp *Comparator, left BNode, right BNode) int {
+	plen := len(nodeMergedPrefix(cmp, left, right))
+	n := int(left.nkeys()) + int(right.nkeys())
+	kv := nodeKVBytes(left, 0, left.nkeys(), plen) + nodeKVBytes(right, 0, right.nkeys(), plen)
+	return HEADER + 2 + plen + int(keyOverhead(left.btype()))*n + kv
+}
+
 // should the updated kid be merged with a sibling?
+// if it's too small but can't be merged, the left (or the right) sibling
+// is returned with the direction 0, see nodeRedistribute().
 func shouldMerge(
 	tree *BTree, node BNode,
 	idx uint16, updated BNode,
-) (int, BNode) {
-	if updated.nbytes() > BTREE_PAGE_SIZE/4 {
-		return 0, BNode{}
+) (int, BNode, error) {
+	if updated.nbytes() >= BTREE_MIN_FILL {
+		return 0, BNode{}, nil
 	}
+	var fallback BNode
 	//idx 是当前子节点在父节点中的索引。idx 表示当前子节点在父节点中的位置是 idx。
 	//idx > 0 检查当前子节点是否是父节点的 第一个子节点。
 	//如果 idx > 0，说明当前子节点左边有一个兄弟节点，即 有左邻居，可以考虑将当前子节点和左邻居子节点合并。
 	//如果 idx == 0，说明当前子节点是父节点的 第一个子节点，没有左邻居节点，此时不能与左邻居合并，只能考虑与右邻居节点合并。
 	if idx > 0 {
-		leftSibling := tree.get(node.getPtr(idx - 1))
-		merged := leftSibling.nbytes() + updated.nbytes() - HEADER
+		leftSibling, err := tree.get(node.getPtr(idx - 1))
+		if err != nil {
+			return 0, BNode{}, err
+		}
+		merged := nodeMergedBytes(tree.cmp, leftSibling, updated)
 		if merged <= BTREE_PAGE_SIZE {
-			return -1, leftSibling
+			return -1, leftSibling, nil
 		}
+		fallback = leftSibling
 	}
 	if idx+1 < node.nkeys() {
-		rightSibling := tree.get(node.getPtr(idx + 1))
-		merged := rightSibling.nbytes() + updated.nbytes() - HEADER
+		rightSibling, err := tree.get(node.getPtr(idx + 1))
+		if err != nil {
+			return 0, BNode{}, err
+		}
+		merged := nodeMergedBytes(tree.cmp, updated, rightSibling)
 		if merged <= BTREE_PAGE_SIZE {
-			return +1, rightSibling
+			return +1, rightSibling, nil
+		}
+		if fallback.data == nil {
+			fallback = rightSibling
+		}
+	}
+	return 0, fallback, nil
+}
+
+// move keys from a sibling to the small updated kid at idx, so that both
+// are at least BTREE_MIN_FILL. the sibling is the left one if idx > 0.
+// returns false if the keys can't be split that way, nothing is changed then.
+func nodeRedistribute(tree *BTree, new BNode, node BNode, idx uint16, updated BNode, sibling BNode) (bool, error) {
+	first, left, right := idx, updated, sibling
+	if idx > 0 {
+		first, left, right = idx-1, sibling, updated
+	}
+	merged := BNode{data: make([]byte, nodeMergedBytes(tree.cmp, left, right))}
+	nodeMerge(tree.cmp, merged, left, right)
+	nleft, ok := nodeSplitEven(tree.cmp, merged)
+	if !ok {
+		return false, nil
+	}
+	kids := [2]BNode{
+		{data: make([]byte, BTREE_PAGE_SIZE)},
+		{data: make([]byte, BTREE_PAGE_SIZE)},
+	}
+	nodeSplitAt(tree.cmp, kids[0], kids[1], merged, nleft)
+	sptr := node.getPtr(idx + 1)
+	if idx > 0 {
+		sptr = node.getPtr(idx - 1)
+	}
+	if err := tree.del(sptr); err != nil {
+		return false, err
+	}
+	return true, nodeReplaceKids(tree, new, node, first, 2, kids[:]...)
+}
+
+// the split point of a node that makes the 2 halves about the same size.
+// returns false if one of them is out of [BTREE_MIN_FILL, BTREE_PAGE_SIZE].
+func nodeSplitEven(cmp *Comparator, old BNode) (uint16, bool) {
+	nkeys := old.nkeys()
+	nleft := uint16(1)
+	for nleft+1 < nkeys && nodeRangeBytes(cmp, old, 0, nleft) < nodeRangeBytes(cmp, old, nleft, nkeys) {
+		nleft++
+	}
+	fits := func(size int) bool {
+		return BTREE_MIN_FILL <= size && size <= BTREE_PAGE_SIZE
+	}
+	for _, n := range []uint16{nleft, nleft - 1} {
+		if 0 < n && n < nkeys && fits(nodeRangeBytes(cmp, old, 0, n)) && fits(nodeRangeBytes(cmp, old, n, nkeys)) {
+			return n, true
 		}
 	}
-	return 0, BNode{}
+	return 0, false
 }
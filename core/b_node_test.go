@@ -1,6 +1,8 @@
 package core
 
 import (
+	"fmt"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -10,7 +12,7 @@ func TestLeafInsert(t *testing.T) {
 	root := BNode{data: make([]byte, BTREE_PAGE_SIZE)}
 	newNode := BNode{data: make([]byte, BTREE_MAX_VAL_SIZE)}
 	root.setHeader(BNODE_LEAF, 0)
-	leafInsert(newNode, root, 0, []byte("date"), []byte("2024-11-30"))
+	leafInsert(CmpBinary, newNode, root, 0, []byte("date"), []byte("2024-11-30"))
 	key := newNode.getKey(0)
 	val := newNode.getVal(0)
 	assert.Equal(t, []byte("date"), key)
@@ -20,3 +22,77 @@ func TestLeafInsert(t *testing.T) {
 	assert.Equal(t, uint16(0), root.nkeys())
 	assert.Equal(t, uint16(1), newNode.nkeys())
 }
+
+func TestNodePrefix(t *testing.T) {
+	old := BNode{data: make([]byte, BTREE_PAGE_SIZE)}
+	old.setHeader(BNODE_LEAF, 0)
+	keys := []string{"user/alice", "user/bob", "user/carol"}
+	for i, key := range keys {
+		new := BNode{data: make([]byte, BTREE_PAGE_SIZE)}
+		leafInsert(CmpBinary, new, old, uint16(i), []byte(key), []byte(fmt.Sprint(i)))
+		old = new
+	}
+	assert.Equal(t, []byte("user/"), old.getPrefix())
+	for i, key := range keys {
+		assert.Equal(t, []byte(key), old.getKey(uint16(i)))
+		assert.Equal(t, []byte(key[len("user/"):]), old.getSuffix(uint16(i)))
+		assert.Equal(t, []byte(fmt.Sprint(i)), old.getVal(uint16(i)))
+	}
+	// keys without the prefix
+	assert.Equal(t, uint16(0), nodeLookupLE(CmpBinary, old, []byte("a")))
+	assert.Equal(t, uint16(2), nodeLookupLE(CmpBinary, old, []byte("z")))
+	assert.Equal(t, uint16(1), nodeLookupLE(CmpBinary, old, []byte("user/bz")))
+
+	// a new key makes the prefix shorter
+	new := BNode{data: make([]byte, BTREE_PAGE_SIZE)}
+	leafInsert(CmpBinary, new, old, 0, []byte("u"), nil)
+	assert.Equal(t, []byte("u"), new.getPrefix())
+	assert.Equal(t, []byte("user/bob"), new.getKey(2))
+
+	// deleting it makes the prefix longer again
+	old = new
+	new = BNode{data: make([]byte, BTREE_PAGE_SIZE)}
+	leafDelete(CmpBinary, new, old, 0)
+	assert.Equal(t, []byte("user/"), new.getPrefix())
+	assert.Equal(t, []byte("user/alice"), new.getKey(0))
+}
+
+func TestNodePrefixSplitMerge(t *testing.T) {
+	old := BNode{data: make([]byte, 2*BTREE_PAGE_SIZE)}
+	old.setHeader(BNODE_LEAF, 0)
+	var keys []string
+	for i := 0; i < 100; i++ {
+		keys = append(keys, fmt.Sprintf("a/%03d", i))
+	}
+	for i := 0; i < 100; i++ {
+		keys = append(keys, fmt.Sprintf("b/%03d", i))
+	}
+	for i, key := range keys {
+		new := BNode{data: make([]byte, 2*BTREE_PAGE_SIZE)}
+		leafInsert(CmpBinary, new, old, uint16(i), []byte(key), []byte(strings.Repeat("v", 30)))
+		old = new
+	}
+	assert.Empty(t, old.getPrefix())
+	assert.Greater(t, int(old.nbytes()), BTREE_PAGE_SIZE)
+
+	nsplit, split := nodeSplit3(CmpBinary, old)
+	assert.Equal(t, uint16(2), nsplit)
+	left, right := split[0], split[1]
+	assert.Equal(t, []byte("a/0"), left.getPrefix())
+	assert.Equal(t, []byte("b/0"), right.getPrefix())
+	assert.Equal(t, len(keys), int(left.nkeys()+right.nkeys()))
+	for i := range keys {
+		node, idx := left, uint16(i)
+		if idx >= left.nkeys() {
+			node, idx = right, idx-left.nkeys()
+		}
+		assert.Equal(t, []byte(keys[i]), node.getKey(idx))
+	}
+	assert.Equal(t, int(left.nbytes()), nodeRangeBytes(CmpBinary, old, 0, left.nkeys()))
+	assert.Equal(t, int(right.nbytes()), nodeRangeBytes(CmpBinary, old, left.nkeys(), old.nkeys()))
+
+	merged := BNode{data: make([]byte, 2*BTREE_PAGE_SIZE)}
+	nodeMerge(CmpBinary, merged, left, right)
+	assert.Equal(t, int(merged.nbytes()), nodeMergedBytes(CmpBinary, left, right))
+	assert.Equal(t, old.data[:old.nbytes()], merged.data[:merged.nbytes()])
+}
@@ -0,0 +1,268 @@
+package core
+
+// Range deletion. A kid of an internal node that is fully covered by the range
+// is deallocated as a whole, only the nodes on the paths to the 2 ends of the
+// range are rewritten. The rewritten kids are merged with a sibling if they
+// become small, like nodeDelete() does for a single key.
+
+// delete the keys in the half-open range [start, end), a nil `end` means no upper bound.
+// returns the number of deleted keys.
+func (tree *BTree) DeleteRange(start []byte, end []byte) (uint64, error) {
+	if tree.root == 0 || (end != nil && tree.cmp.compare(start, end) >= 0) {
+		return 0, nil
+	}
+	root, err := tree.get(tree.root)
+	if err != nil {
+		return 0, err
+	}
+	height, err := treeHeight(tree, root)
+	if err != nil {
+		return 0, err
+	}
+	updated, deleted, err := treeDeleteRange(tree, root, height, start, end, nil)
+	if err != nil || len(updated.data) == 0 {
+		return 0, err // nothing in the range
+	}
+	if err := tree.del(tree.root); err != nil {
+		return 0, err
+	}
+	// the dummy key is never deleted, so the root can't be empty.
+	// remove the levels with a single kid.
+	for updated.btype() == BNODE_NODE && updated.nkeys() == 1 {
+		kptr := updated.getPtr(0)
+		if updated, err = tree.get(kptr); err != nil {
+			return 0, err
+		}
+		if err := tree.del(kptr); err != nil {
+			return 0, err
+		}
+	}
+	return deleted, treeSetRoot(tree, updated)
+}
+
+// the number of levels, from the leftmost path of the root.
+func treeHeight(tree *BTree, node BNode) (int, error) {
+	height := 1
+	for node.btype() == BNODE_NODE {
+		var err error
+		if node, err = tree.get(node.getPtr(0)); err != nil {
+			return 0, err
+		}
+		height++
+	}
+	return height, nil
+}
+
+// a kid of the internal node rebuilt by treeDeleteRange().
+type rangeKid struct {
+	ptr   uint64 // an unchanged kid
+	key   []byte
+	count uint64 // with the flags, see nodeCountFlags()
+	node  BNode  // a rewritten kid that is not allocated yet, if `ptr` is 0
+}
+
+// delete the keys in [start, end) from the node holding keys less than `upper`
+// (nil for no bound), `height` is the number of levels from the node to the leaves.
+// the result might be empty or bigger than a page.
+// an empty BNode{} is returned if no key is in the range.
+func treeDeleteRange(tree *BTree, node BNode, height int, start []byte, end []byte, upper []byte) (BNode, uint64, error) {
+	switch node.btype() {
+	case BNODE_LEAF:
+		return leafDeleteRange(tree, node, start, end)
+	case BNODE_NODE:
+	default:
+		return BNode{}, 0, ErrBadNode
+	}
+
+	kids := []rangeKid{}
+	deleted, changed := uint64(0), false
+	for i := uint16(0); i < node.nkeys(); i++ {
+		kid := rangeKid{ptr: node.getPtr(i), key: node.getKey(i), count: node.getCountFlags(i)}
+		// the kid holds the keys in [key, hi)
+		hi := upper
+		if i+1 < node.nkeys() {
+			hi = node.getKey(i + 1)
+		}
+		before := hi != nil && tree.cmp.compare(hi, start) <= 0
+		after := end != nil && tree.cmp.compare(kid.key, end) >= 0
+		covered := len(kid.key) > 0 && // not the kid with the dummy key
+			tree.cmp.compare(start, kid.key) <= 0 &&
+			(end == nil || (hi != nil && tree.cmp.compare(hi, end) <= 0))
+		switch {
+		case before || after:
+			kids = append(kids, kid)
+		case covered:
+			if err := freeSubtree(tree, kid.ptr, height-1, kid.count); err != nil {
+				return BNode{}, 0, err
+			}
+			deleted += kid.count &^ COUNT_NO_OVERFLOW
+			changed = true
+		default:
+			// a boundary kid
+			knode, err := tree.get(kid.ptr)
+			if err != nil {
+				return BNode{}, 0, err
+			}
+			updated, n, err := treeDeleteRange(tree, knode, height-1, start, end, hi)
+			if err != nil {
+				return BNode{}, 0, err
+			}
+			if len(updated.data) == 0 {
+				kids = append(kids, kid) // nothing deleted in it
+				continue
+			}
+			if err := tree.del(kid.ptr); err != nil {
+				return BNode{}, 0, err
+			}
+			deleted += n
+			changed = true
+			if updated.nkeys() > 0 {
+				kids = append(kids, rangeKid{node: updated})
+			}
+		}
+	}
+	if !changed {
+		return BNode{}, 0, nil
+	}
+	kids, err := rangeMergeKids(tree, kids)
+	if err != nil {
+		return BNode{}, 0, err
+	}
+	new, err := rangeBuildNode(tree, kids)
+	return new, deleted, err
+}
+
+// delete the keys in [start, end) from a leaf, except the dummy key.
+func leafDeleteRange(tree *BTree, node BNode, start []byte, end []byte) (BNode, uint64, error) {
+	nkeys := node.nkeys()
+	begin := uint16(0)
+	for begin < nkeys {
+		key := node.getKey(begin)
+		if len(key) > 0 && tree.cmp.compare(key, start) >= 0 {
+			break
+		}
+		begin++
+	}
+	stop := begin
+	for stop < nkeys && (end == nil || tree.cmp.compare(node.getKey(stop), end) < 0) {
+		stop++
+	}
+	if begin == stop {
+		return BNode{}, 0, nil
+	}
+	for i := begin; i < stop; i++ {
+		if err := leafFreeVal(tree, node, i); err != nil {
+			return BNode{}, 0, err
+		}
+	}
+	new := BNode{data: make([]byte, BTREE_PAGE_SIZE)}
+	nodeRemoveRange(tree.cmp, new, node, begin, stop)
+	return new, uint64(stop - begin), nil
+}
+
+// deallocate a subtree of `height` levels that is deleted as a whole, `count` is
+// its count in the parent. the leaves are only read for the overflow values,
+// the ones with the COUNT_NO_OVERFLOW flag are freed without reading them.
+func freeSubtree(tree *BTree, ptr uint64, height int, count uint64) error {
+	if height == 1 && count&COUNT_NO_OVERFLOW != 0 {
+		return tree.del(ptr)
+	}
+	node, err := tree.get(ptr)
+	if err != nil {
+		return err
+	}
+	for i := uint16(0); i < node.nkeys(); i++ {
+		switch node.btype() {
+		case BNODE_NODE:
+			err = freeSubtree(tree, node.getPtr(i), height-1, node.getCountFlags(i))
+		case BNODE_LEAF:
+			err = leafFreeVal(tree, node, i)
+		default:
+			err = ErrBadNode
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return tree.del(ptr)
+}
+
+// merge the small rewritten kids with a sibling, see shouldMerge().
+func rangeMergeKids(tree *BTree, kids []rangeKid) ([]rangeKid, error) {
+	for i := 0; i < len(kids); i++ {
+		if kids[i].ptr != 0 || kids[i].node.nbytes() >= BTREE_MIN_FILL {
+			continue
+		}
+		for _, j := range []int{i - 1, i + 1} { // left, then right
+			if j < 0 || j >= len(kids) {
+				continue
+			}
+			sibling := kids[j].node
+			if kids[j].ptr != 0 {
+				var err error
+				if sibling, err = tree.get(kids[j].ptr); err != nil {
+					return nil, err
+				}
+			}
+			left, right := sibling, kids[i].node
+			if j > i {
+				left, right = right, left
+			}
+			if nodeMergedBytes(tree.cmp, left, right) > BTREE_PAGE_SIZE {
+				continue
+			}
+			if kids[j].ptr != 0 {
+				if err := tree.del(kids[j].ptr); err != nil {
+					return nil, err
+				}
+			}
+			merged := BNode{data: make([]byte, BTREE_PAGE_SIZE)}
+			nodeMerge(tree.cmp, merged, left, right)
+			lo := min(i, j)
+			kids[lo] = rangeKid{node: merged}
+			kids = append(kids[:lo+1], kids[lo+2:]...)
+			i = lo - 1 // the merged node can still be small
+			break
+		}
+	}
+	return kids, nil
+}
+
+// allocate the rewritten kids and build the internal node.
+func rangeBuildNode(tree *BTree, kids []rangeKid) (BNode, error) {
+	links := []rangeKid{}
+	for _, kid := range kids {
+		if kid.ptr != 0 {
+			links = append(links, kid)
+			continue
+		}
+		// an internal kid can be bigger than a page with longer keys
+		nsplit, split := nodeSplit3(tree.cmp, kid.node)
+		for _, knode := range split[:nsplit] {
+			ptr, err := tree.new(knode)
+			if err != nil {
+				return BNode{}, err
+			}
+			links = append(links, rangeKid{ptr: ptr, key: knode.getKey(0), count: nodeCountFlags(knode)})
+		}
+	}
+	nkeys := uint16(len(links))
+	if nkeys == 0 {
+		new := BNode{data: make([]byte, BTREE_PAGE_SIZE)}
+		new.setHeader(BNODE_NODE, 0)
+		return new, nil
+	}
+	prefix := nodePrefix(tree.cmp, links[0].key, links[nkeys-1].key)
+	size := HEADER + 2 + len(prefix)
+	for _, link := range links {
+		size += int(keyOverhead(BNODE_NODE)) + len(link.key) - len(prefix)
+	}
+	new := BNode{data: make([]byte, max(size, BTREE_PAGE_SIZE))}
+	new.setHeader(BNODE_NODE, nkeys)
+	new.setPrefix(prefix)
+	for i, link := range links {
+		nodeAppendKV(new, uint16(i), link.ptr, link.key, nil)
+		new.setCount(uint16(i), link.count)
+	}
+	return new, nil
+}
@@ -0,0 +1,166 @@
+package core
+
+import (
+	"fmt"
+	mrand "math/rand"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// the pages reachable from the root, including the overflow pages.
+// every leaf must be at the same depth.
+func (c *C) reachable(t *testing.T, ptr uint64, depth int, leafDepth *int) int {
+	node := c.node(ptr)
+	if node.btype() == BNODE_LEAF {
+		if *leafDepth < 0 {
+			*leafDepth = depth
+		}
+		assert.Equal(t, *leafDepth, depth)
+		n := 1
+		for i := uint16(0); i < node.nkeys(); i++ {
+			if leafIsOverflow(node, i) {
+				size := len(c.ref[string(node.getKey(i))])
+				n += (size + OVERFLOW_CAP - 1) / OVERFLOW_CAP
+			}
+		}
+		return n
+	}
+	n := 1
+	for i := uint16(0); i < node.nkeys(); i++ {
+		assert.Equal(t, node.getKey(i), c.node(node.getPtr(i)).getKey(0))
+		n += c.reachable(t, node.getPtr(i), depth+1, leafDepth)
+	}
+	return n
+}
+
+func (c *C) deleteRange(t *testing.T, start, end string) {
+	var endKey []byte
+	if end != "" {
+		endKey = []byte(end)
+	}
+	expected := uint64(0)
+	for key := range c.ref {
+		if key >= start && (end == "" || key < end) {
+			delete(c.ref, key)
+			expected++
+		}
+	}
+	deleted, err := c.tree.DeleteRange([]byte(start), endKey)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, deleted)
+
+	// no page is leaked
+	leafDepth := -1
+	assert.Equal(t, len(c.pages), c.reachable(t, c.tree.root, 0, &leafDepth))
+	c.checkRank(t)
+}
+
+func TestDeleteRange(t *testing.T) {
+	c := newC(t)
+	deleted, err := c.tree.DeleteRange(nil, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), deleted)
+
+	for i := 0; i < 20000; i++ {
+		c.add(fmt.Sprintf("k%05d", i), fmt.Sprintf("%0100d", i))
+	}
+	assert.Equal(t, 3, c.height())
+	c.deleteRange(t, "k00100", "k00100") // empty range
+	c.deleteRange(t, "k00100", "k00101") // a single key
+	// only the 2 boundary paths are rewritten
+	allocated, alloc := 0, c.tree.new
+	c.tree.new = func(node BNode) (uint64, error) {
+		allocated++
+		return alloc(node)
+	}
+	c.deleteRange(t, "k00500", "k15000") // many subtrees
+	assert.LessOrEqual(t, allocated, 2*c.height())
+	c.tree.new = alloc
+	c.deleteRange(t, "k14000", "k16000") // partially deleted already
+	c.deleteRange(t, "k19990", "")       // no upper bound
+	c.deleteRange(t, "", "k00050")       // from the first key
+	for key, val := range c.ref {
+		treeVal, ok := c.get(key)
+		assert.True(t, ok)
+		assert.Equal(t, val, treeVal)
+	}
+
+	// everything, only the dummy key is left
+	c.deleteRange(t, "", "")
+	assert.Equal(t, 1, c.height())
+	assert.Equal(t, 1, len(c.pages))
+	c.add("a", "1")
+	val, ok := c.get("a")
+	assert.True(t, ok)
+	assert.Equal(t, "1", val)
+}
+
+// the covered leaves are only read for their overflow values.
+func TestDeleteRangeReads(t *testing.T) {
+	c := newC(t)
+	for i := 0; i < 20000; i++ {
+		c.add(fmt.Sprintf("k%05d", i), strings.Repeat("v", 100))
+	}
+	big := strings.Repeat("x", BTREE_MAX_VAL_SIZE+1)
+	for i := 0; i < 10; i++ {
+		c.add(fmt.Sprintf("k1%04d-big", i*500), big)
+	}
+	internal, leaves := 0, 0
+	for _, node := range c.pages {
+		switch node.btype() {
+		case BNODE_NODE:
+			internal++
+		case BNODE_LEAF:
+			leaves++
+		}
+	}
+	height, err := treeHeight(&c.tree, c.node(c.tree.root))
+	assert.Nil(t, err)
+
+	get, reads := c.tree.get, 0
+	c.tree.get = func(ptr uint64) (BNode, error) {
+		reads++
+		return get(ptr)
+	}
+	deleted, err := c.tree.DeleteRange([]byte("k00100"), []byte("k19900"))
+	c.tree.get = get
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(19800+10), deleted)
+	// the internal nodes, the leaves with the big values and the paths to the ends,
+	// plus the overflow pages and the merged siblings
+	assert.True(t, reads <= internal+10*2+4*height, "%d reads, %d internal nodes", reads, internal)
+	assert.True(t, reads < leaves/10, "%d reads, %d leaves", reads, leaves)
+
+	for key := range c.ref {
+		if key >= "k00100" && key < "k19900" {
+			delete(c.ref, key)
+		}
+	}
+	leafDepth := -1
+	assert.Equal(t, len(c.pages), c.reachable(t, c.tree.root, 0, &leafDepth))
+	c.checkRank(t)
+}
+
+func TestRandomDeleteRange(t *testing.T) {
+	c := newC(t)
+	r := mrand.New(mrand.NewSource(5))
+	key := func() string {
+		return fmt.Sprintf("%s%04d", strings.Repeat("p", r.Intn(3)*100), r.Intn(3000))
+	}
+	for round := 0; round < 30; round++ {
+		for i := 0; i < 1000; i++ {
+			val := fmt.Sprintf("%0*d", r.Intn(200), i)
+			if r.Intn(50) == 0 {
+				val = strings.Repeat("big", 2000) // overflow pages
+			}
+			c.add(key(), val)
+		}
+		start, end := key(), key()
+		if start > end {
+			start, end = end, start
+		}
+		c.deleteRange(t, start, end)
+	}
+}
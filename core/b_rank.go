@@ -0,0 +1,89 @@
+package core
+
+// Order statistics over the subtree counts of the internal nodes.
+// The dummy key is counted in the leaves, it's subtracted here.
+
+// the number of keys less than the key.
+func (tree *BTree) Rank(key []byte) (uint64, error) {
+	if tree.root == 0 {
+		return 0, nil
+	}
+	rank := uint64(0)
+	node, err := tree.get(tree.root)
+	for err == nil && node.btype() == BNODE_NODE {
+		idx := nodeLookupLE(tree.cmp, node, key)
+		for i := uint16(0); i < idx; i++ {
+			rank += node.getCount(i)
+		}
+		node, err = tree.get(node.getPtr(idx))
+	}
+	if err != nil {
+		return 0, err
+	}
+	if node.btype() != BNODE_LEAF {
+		return 0, ErrBadNode
+	}
+	idx := nodeLookupLE(tree.cmp, node, key)
+	rank += uint64(idx)
+	if tree.cmp.compare(node.getKey(idx), key) < 0 {
+		rank++
+	}
+	if rank > 0 {
+		rank-- // the dummy key
+	}
+	return rank, nil
+}
+
+// the number of keys in the half-open range [start, end).
+// a nil `end` means no upper bound.
+func (tree *BTree) Count(start []byte, end []byte) (uint64, error) {
+	if tree.root == 0 {
+		return 0, nil
+	}
+	root, err := tree.get(tree.root)
+	if err != nil {
+		return 0, err
+	}
+	hi := nodeTotal(root) - 1 // the dummy key
+	if end != nil {
+		if hi, err = tree.Rank(end); err != nil {
+			return 0, err
+		}
+	}
+	lo, err := tree.Rank(start)
+	if err != nil || hi < lo {
+		return 0, err
+	}
+	return hi - lo, nil
+}
+
+// position an iterator at the i-th key (0-based) in order.
+// the iterator is not valid if there are not that many keys.
+func (tree *BTree) Select(i uint64) *BIter {
+	iter := &BIter{tree: tree}
+	if tree.root == 0 {
+		return iter
+	}
+	node, err := tree.get(tree.root)
+	i++ // skip the dummy key
+	if err != nil || i >= nodeTotal(node) {
+		iter.err = err
+		return iter
+	}
+	for node.btype() == BNODE_NODE {
+		idx := uint16(0)
+		for i >= node.getCount(idx) {
+			i -= node.getCount(idx)
+			idx++
+		}
+		iter.path = append(iter.path, node)
+		iter.pos = append(iter.pos, idx)
+		if node, err = tree.get(node.getPtr(idx)); err != nil {
+			iter.err = err
+			return iter
+		}
+	}
+	iter.path = append(iter.path, node)
+	iter.pos = append(iter.pos, uint16(i))
+	return iter
+}
@@ -0,0 +1,106 @@
+package core
+
+import (
+	"fmt"
+	mrand "math/rand"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// the subtree counts must match the leaves.
+func (c *C) checkCounts(t *testing.T, ptr uint64) uint64 {
+	node := c.node(ptr)
+	if node.btype() == BNODE_LEAF {
+		return uint64(node.nkeys())
+	}
+	total := uint64(0)
+	for i := uint16(0); i < node.nkeys(); i++ {
+		count := c.checkCounts(t, node.getPtr(i))
+		assert.Equal(t, count, node.getCount(i))
+		total += count
+	}
+	return total
+}
+
+func (c *C) rank(key string) uint64 {
+	rank, err := c.tree.Rank([]byte(key))
+	assert.NoError(c.t, err)
+	return rank
+}
+
+func (c *C) count(start, end []byte) uint64 {
+	count, err := c.tree.Count(start, end)
+	assert.NoError(c.t, err)
+	return count
+}
+
+func (c *C) sortedKeys() []string {
+	keys := []string{}
+	for key := range c.ref {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (c *C) checkRank(t *testing.T) {
+	assert.Equal(t, uint64(len(c.ref)+1), c.checkCounts(t, c.tree.root))
+	keys := c.sortedKeys()
+	assert.Equal(t, uint64(len(keys)), c.count(nil, nil))
+	for i, key := range keys {
+		assert.Equal(t, uint64(i), c.rank(key))
+		// a key that is not in the tree
+		assert.Equal(t, uint64(i+1), c.rank(key+"\x00"))
+		iter := c.tree.Select(uint64(i))
+		assert.True(t, iter.Valid())
+		assert.Equal(t, key, string(iter.Key()))
+	}
+	assert.False(t, c.tree.Select(uint64(len(keys))).Valid())
+}
+
+func TestRank(t *testing.T) {
+	c := newC(t)
+	assert.Equal(t, uint64(0), c.rank("a"))
+	assert.Equal(t, uint64(0), c.count(nil, nil))
+	assert.False(t, c.tree.Select(0).Valid())
+
+	r := mrand.New(mrand.NewSource(3))
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprintf("k%0*d", 1+r.Intn(100), r.Intn(2000))
+		if r.Intn(3) == 0 {
+			c.del(key)
+		} else {
+			c.add(key, fmt.Sprintf("%0*d", r.Intn(200), i))
+		}
+	}
+	c.checkRank(t)
+
+	keys := c.sortedKeys()
+	lo, hi := keys[10], keys[len(keys)-10]
+	assert.Equal(t, uint64(len(keys)-20), c.count([]byte(lo), []byte(hi)))
+	assert.Equal(t, uint64(0), c.count([]byte(hi), []byte(lo)))
+	assert.Equal(t, uint64(10), c.count([]byte(hi), nil))
+
+	// iterate from a selected position
+	iter := c.tree.Select(5)
+	iter.Prev()
+	assert.Equal(t, keys[4], string(iter.Key()))
+
+	for _, key := range keys {
+		c.del(key)
+	}
+	c.checkRank(t)
+}
+
+func TestRankBuildTree(t *testing.T) {
+	var keys, vals []string
+	for i := 0; i < 10000; i++ {
+		keys = append(keys, fmt.Sprintf("key%08d", i))
+		vals = append(vals, "")
+	}
+	c := newC(t)
+	c.build(t, 1, keys, vals)
+	c.checkRank(t)
+}
@@ -1,150 +1,356 @@
 package core
 
-import "bytes"
+import (
+	"bytes"
+	"fmt"
+)
 
 type BTree struct {
 	// pointer (a nonzero page number)
 	root uint64
-	// callbacks for managing on-disk pages
-	get func(uint64) BNode // dereference a pointer
-	new func(BNode) uint64 // allocate a new page
-	del func(uint64)       // deallocate a page
+	// the order of the keys, nil is the byte order.
+	cmp *Comparator
+	// callbacks for managing on-disk pages.
+	// a failed callback fails the whole operation.
+	get func(uint64) (BNode, error) // dereference a pointer
+	new func(BNode) (uint64, error) // allocate a new page
+	del func(uint64) error          // deallocate a page
 }
 
-func (tree *BTree) Get(key []byte) ([]byte, bool) {
-	//assert(len(key) != 0)
-	//assert(len(key) <= BTREE_MAX_KEY_SIZE)
+func (tree *BTree) Get(key []byte) ([]byte, bool, error) {
+	if err := checkKey(key); err != nil {
+		return nil, false, err
+	}
 	if tree.root == 0 {
-		return nil, false
+		return nil, false, nil
 	}
 
-	root := tree.get(tree.root)
+	root, err := tree.get(tree.root)
+	if err != nil {
+		return nil, false, err
+	}
 	return treeGet(tree, root, key)
 }
 
-func (tree *BTree) Delete(key []byte) bool {
-	//assert(len(key) != 0)
-	//assert(len(key) <= BTREE_MAX_KEY_SIZE)
+// returns false if the key is not found.
+func (tree *BTree) Delete(key []byte) (bool, error) {
+	if err := checkKey(key); err != nil {
+		return false, err
+	}
 	if tree.root == 0 {
-		return false
+		return false, nil
+	}
+	root, err := tree.get(tree.root)
+	if err != nil {
+		return false, err
 	}
-	updated := treeDelete(tree, tree.get(tree.root), key)
-	if len(updated.data) == 0 {
-		return false // not found
+	updated, err := treeDelete(tree, root, key)
+	if err != nil || len(updated.data) == 0 {
+		return false, err // not found
+	}
+	if err := tree.del(tree.root); err != nil {
+		return false, err
 	}
-	tree.del(tree.root)
 	// 只有一个key，可以取代原来的root节点了
 	if updated.btype() == BNODE_NODE && updated.nkeys() == 1 {
 		// remove a level
 		tree.root = updated.getPtr(0)
-	} else {
-		tree.root = tree.new(updated)
+		return true, nil
 	}
-	return true
+	// 删除也可能让节点变大（前缀变短），所以 root 也可能要分裂
+	return true, treeSetRoot(tree, updated)
+}
+
+// modes of the updates
+const (
+	MODE_UPSERT      = 0 // insert or replace
+	MODE_UPDATE_ONLY = 1 // update existing keys
+	MODE_INSERT_ONLY = 2 // only add new keys
+	MODE_CAS         = 3 // update an existing key whose value is `Expected`
+)
+
+// a conditional update, the results are written back to it.
+type UpdateReq struct {
+	// in
+	Key      []byte
+	Val      []byte
+	Mode     int
+	Expected []byte // the old value for MODE_CAS
+	// out
+	Added   bool   // a new key was added
+	Updated bool   // the value was written, either added or replaced
+	Old     []byte // the value before the update, nil if the key was not found
 }
 
 // the interface
+func (tree *BTree) Insert(key []byte, val []byte) error {
+	return tree.Update(&UpdateReq{Key: key, Val: val})
+}
+
+// insert or update a key according to the mode of the request.
 // The empty key is the lowest possible key by sorting order,
 // it makes the lookup function nodeLookupLE always successful,
 // eliminating the case of failing to find a node that
 // contains the input key
-func (tree *BTree) Insert(key []byte, val []byte) {
-	// assert(len(key) != 0)
-	// assert(len(key) <= BTREE_MAX_KEY_SIZE)
-	// assert(len(val) <= BTREE_MAX_VAL_SIZE)
+func (tree *BTree) Update(req *UpdateReq) error {
+	if err := req.check(); err != nil {
+		return err
+	}
+	req.Added, req.Updated, req.Old = false, false, nil
 	if tree.root == 0 {
+		if !req.allowed(false) {
+			return nil
+		}
 		// create the first node
 		root := BNode{data: make([]byte, BTREE_PAGE_SIZE)}
 		root.setHeader(BNODE_LEAF, 2)
 		// a dummy key, this makes the tree cover the whole key space.
 		// thus a lookup can always find a containing node.
 		nodeAppendKV(root, 0, 0, nil, nil) // 如果树为空时查找一个不存在的键，这个哨兵键确保查找操作可以找到一个候选节点
-		nodeAppendKV(root, 1, 0, key, val)
-		tree.root = tree.new(root)
-		return
-	}
-	node := tree.get(tree.root)
-	tree.del(tree.root)
-	node = treeInsert(tree, node, key, val)
-	nsplit, splitted := nodeSplit3(node)
-	if nsplit > 1 {
-		// the root was split, add a new level.
-		root := BNode{data: make([]byte, BTREE_PAGE_SIZE)}
-		root.setHeader(BNODE_NODE, nsplit)
-		for i, knode := range splitted[:nsplit] {
-			ptr, key := tree.new(knode), knode.getKey(0)
-			// 这里只是说明root子节点指针队员的key时子节点的第一个key
-			nodeAppendKV(root, uint16(i), ptr, key, nil)
+		big, stored, err := leafValue(tree, req.Val)
+		if err != nil {
+			return err
+		}
+		nodeAppendKV(root, 1, 0, req.Key, stored)
+		if big {
+			leafSetOverflow(root, 1)
 		}
-		tree.root = tree.new(root)
-	} else {
-		tree.root = tree.new(splitted[0])
+		if tree.root, err = tree.new(root); err != nil {
+			return err
+		}
+		req.Added, req.Updated = true, true
+		return nil
+	}
+	node, err := tree.get(tree.root)
+	if err != nil {
+		return err
+	}
+	if node, err = treeInsert(tree, node, req); err != nil || len(node.data) == 0 {
+		return err // not updated
+	}
+	if err := tree.del(tree.root); err != nil {
+		return err
+	}
+	return treeSetRoot(tree, node)
+}
+
+// validate the input of a request.
+func (req *UpdateReq) check() error {
+	if err := checkKV(req.Key, req.Val); err != nil {
+		return err
 	}
+	if req.Mode < MODE_UPSERT || req.Mode > MODE_CAS {
+		return fmt.Errorf("bad update mode %d", req.Mode)
+	}
+	return nil
+}
+
+// can the key be written by the request? `req.Old` is the current value.
+func (req *UpdateReq) allowed(found bool) bool {
+	switch req.Mode {
+	case MODE_UPDATE_ONLY:
+		return found
+	case MODE_INSERT_ONLY:
+		return !found
+	case MODE_CAS:
+		return found && bytes.Equal(req.Old, req.Expected)
+	default:
+		return true
+	}
+}
+
+// replace the root with the node, split it and add a new level if it's too big.
+func treeSetRoot(tree *BTree, node BNode) (err error) {
+	nsplit, splitted := nodeSplit3(tree.cmp, node)
+	if nsplit == 1 {
+		tree.root, err = tree.new(splitted[0])
+		return err
+	}
+	// the root was split, add a new level.
+	root := BNode{data: make([]byte, BTREE_PAGE_SIZE)}
+	root.setHeader(BNODE_NODE, nsplit)
+	root.setPrefix(nodePrefix(tree.cmp, splitted[0].getKey(0), splitted[nsplit-1].getKey(0)))
+	for i, knode := range splitted[:nsplit] {
+		ptr, err := tree.new(knode)
+		if err != nil {
+			return err
+		}
+		// 这里只是说明root子节点指针队员的key时子节点的第一个key
+		nodeAppendKV(root, uint16(i), ptr, knode.getKey(0), nil)
+		root.setCount(uint16(i), nodeCountFlags(knode))
+	}
+	tree.root, err = tree.new(root)
+	return err
 }
 
 // delete a key from the tree
-func treeDelete(tree *BTree, node BNode, key []byte) BNode {
+// an empty node is returned if the key is not found.
+func treeDelete(tree *BTree, node BNode, key []byte) (BNode, error) {
 	// where to find the key?
-	idx := nodeLookupLE(node, key)
+	idx := nodeLookupLE(tree.cmp, node, key)
 	// act depending on the node type
 	switch node.btype() {
 	case BNODE_LEAF:
-		if !bytes.Equal(key, node.getKey(idx)) {
-			return BNode{} // not found
+		if tree.cmp.compare(key, node.getKey(idx)) != 0 {
+			return BNode{}, nil // not found
 		}
 		// delete the key in the leaf
+		if err := leafFreeVal(tree, node, idx); err != nil {
+			return BNode{}, err
+		}
 		new := BNode{data: make([]byte, BTREE_PAGE_SIZE)}
-		leafDelete(new, node, idx)
-		return new
+		leafDelete(tree.cmp, new, node, idx)
+		return new, nil
 	case BNODE_NODE:
 		return nodeDelete(tree, node, idx, key)
 	default:
-		panic("bad node!")
+		return BNode{}, ErrBadNode
 	}
 }
 
-func treeGet(tree *BTree, node BNode, key []byte) ([]byte, bool) {
-	idx := nodeLookupLE(node, key)
+func treeGet(tree *BTree, node BNode, key []byte) ([]byte, bool, error) {
+	idx := nodeLookupLE(tree.cmp, node, key)
 	switch node.btype() {
 	case BNODE_LEAF:
-		if !bytes.Equal(key, node.getKey(idx)) {
-			return nil, false
+		if tree.cmp.compare(key, node.getKey(idx)) != 0 {
+			return nil, false, nil
 		}
-		return node.getVal(idx), true
+		val, err := leafGetVal(tree, node, idx)
+		return val, err == nil, err
 	case BNODE_NODE:
-		kptr := node.getPtr(idx)
-		knode := tree.get(kptr)
+		knode, err := tree.get(node.getPtr(idx))
+		if err != nil {
+			return nil, false, err
+		}
 		return treeGet(tree, knode, key)
 	default:
-		panic("bad node!")
+		return nil, false, ErrBadNode
 	}
 }
 
 // insert a KV into a node, the result might be split into 2 nodes.
 // the caller is responsible for deallocating the input node
 // and splitting and allocating result nodes.
-func treeInsert(tree *BTree, node BNode, key []byte, val []byte) BNode {
+// an empty node is returned if the request doesn't update anything.
+func treeInsert(tree *BTree, node BNode, req *UpdateReq) (BNode, error) {
 	// the result node.
 	// it's allowed to be bigger than 1 page and will be split if so
-	new := BNode{data: make([]byte, 2*BTREE_PAGE_SIZE)}
+	new := BNode{data: make([]byte, nodeBufSize(node))}
 	// where to insert the key?
-	idx := nodeLookupLE(node, key)
+	idx := nodeLookupLE(tree.cmp, node, req.Key)
 	// act depending on the node type
 	switch node.btype() {
 	case BNODE_LEAF:
 		// leaf, node.getKey(idx) <= key
-		if bytes.Equal(key, node.getKey(idx)) {
+		found := tree.cmp.compare(req.Key, node.getKey(idx)) == 0
+		if found {
+			old, err := leafGetVal(tree, node, idx)
+			if err != nil {
+				return BNode{}, err
+			}
+			// the page can be reused after the update
+			req.Old = append([]byte{}, old...)
+		}
+		if !req.allowed(found) {
+			return BNode{}, nil
+		}
+		// 大的 value 先写到溢出页面，叶子节点里只存溢出页面的位置
+		big, stored, err := leafValue(tree, req.Val)
+		if err != nil {
+			return BNode{}, err
+		}
+		if found {
 			// found the key, update it.
-			leafUpdate(new, node, idx, key, val)
+			if err := leafFreeVal(tree, node, idx); err != nil {
+				return BNode{}, err
+			}
+			leafUpdate(tree.cmp, new, node, idx, req.Key, stored)
 		} else {
 			// insert it after the position.
-			leafInsert(new, node, idx+1, key, val)
+			idx++
+			leafInsert(tree.cmp, new, node, idx, req.Key, stored)
+			req.Added = true
+		}
+		if big {
+			leafSetOverflow(new, idx)
 		}
+		req.Updated = true
 	case BNODE_NODE:
 		// internal node, insert it to a kid node.
-		nodeInsert(tree, new, node, idx, key, val)
+		if err := nodeInsert(tree, new, node, idx, req); err != nil || !req.Updated {
+			return BNode{}, err
+		}
 	default:
-		panic("bad node!")
+		return BNode{}, ErrBadNode
+	}
+	return new, nil
+}
+
+// comparison modes for Seek()
+const (
+	CMP_GE = +3 // >=
+	CMP_GT = +2 // >
+	CMP_LT = -2 // <
+	CMP_LE = -3 // <=
+)
+
+// key cmp ref, `r` is the comparison of the key with the ref.
+// `cmp` is checked by Seek().
+func cmpOK(r int, cmp int) bool {
+	switch cmp {
+	case CMP_GE:
+		return r >= 0
+	case CMP_GT:
+		return r > 0
+	case CMP_LT:
+		return r < 0
+	case CMP_LE:
+		return r <= 0
+	default:
+		panic("unreachable")
+	}
+}
+
+// find the closest position to the key with respect to the `cmp` relation.
+// SeekLE() always lands on a key <= the input, so at most one step
+// in either direction is needed to satisfy the other modes.
+// the iterator is not valid if no such key exists.
+func (tree *BTree) Seek(key []byte, cmp int) *BIter {
+	if cmp != CMP_GE && cmp != CMP_GT && cmp != CMP_LT && cmp != CMP_LE {
+		return &BIter{tree: tree, err: fmt.Errorf("bad cmp %d", cmp)}
+	}
+	iter := tree.SeekLE(key)
+	switch cmp {
+	case CMP_LE:
+	case CMP_LT:
+		if iter.Valid() && !cmpOK(tree.cmp.compare(iter.Key(), key), cmp) {
+			iter.Prev()
+		}
+	case CMP_GE, CMP_GT:
+		if !iter.Valid() || !cmpOK(tree.cmp.compare(iter.Key(), key), cmp) {
+			iter.Next()
+		}
+	}
+	return iter
+}
+
+// position the iterator at the last key in the tree.
+func (tree *BTree) SeekLast() *BIter {
+	iter := &BIter{tree: tree}
+	for ptr := tree.root; ptr != 0; {
+		node, err := tree.get(ptr)
+		if err != nil {
+			iter.err = err
+			return iter
+		}
+		idx := node.nkeys() - 1
+		iter.path = append(iter.path, node)
+		iter.pos = append(iter.pos, idx)
+		if node.btype() == BNODE_NODE {
+			ptr = node.getPtr(idx)
+		} else {
+			ptr = 0
+		}
 	}
-	return new
+	return iter
 }
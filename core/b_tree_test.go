@@ -1,8 +1,12 @@
 package core
 
 import (
+	"bytes"
 	"crypto/rand"
+	"errors"
 	"fmt"
+	mrand "math/rand"
+	"strings"
 	"testing"
 	"unsafe"
 
@@ -10,6 +14,7 @@ import (
 )
 
 type C struct {
+	t     *testing.T
 	tree  BTree
 	ref   map[string]string
 	pages map[uint64]BNode
@@ -22,23 +27,28 @@ func TestBtree(t *testing.T) {
 func newC(t *testing.T) *C {
 	pages := map[uint64]BNode{}
 	return &C{
+		t: t,
 		tree: BTree{
-			get: func(ptr uint64) BNode {
+			get: func(ptr uint64) (BNode, error) {
 				node, ok := pages[ptr]
-				assert.True(t, ok)
-				return node
+				if !ok {
+					return BNode{}, ErrBadPointer
+				}
+				return node, nil
 			},
-			new: func(node BNode) uint64 {
+			new: func(node BNode) (uint64, error) {
 				assert.True(t, node.nbytes() <= BTREE_PAGE_SIZE)
 				key := uint64(uintptr(unsafe.Pointer(&node.data[0])))
 				assert.True(t, pages[key].data == nil)
 				pages[key] = node
-				return key
+				return key, nil
 			},
-			del: func(ptr uint64) {
-				_, ok := pages[ptr]
-				assert.True(t, ok)
+			del: func(ptr uint64) error {
+				if _, ok := pages[ptr]; !ok {
+					return ErrBadPointer
+				}
 				delete(pages, ptr)
+				return nil
 			},
 		},
 		ref:   map[string]string{},
@@ -47,23 +57,32 @@ func newC(t *testing.T) *C {
 }
 
 func (c *C) add(key string, val string) {
-	c.tree.Insert([]byte(key), []byte(val))
+	assert.NoError(c.t, c.tree.Insert([]byte(key), []byte(val)))
 	c.ref[key] = val
 }
 
 func (c *C) del(key string) bool {
 	delete(c.ref, key)
-	return c.tree.Delete([]byte(key))
+	deleted, err := c.tree.Delete([]byte(key))
+	assert.NoError(c.t, err)
+	return deleted
 }
 
 func (c *C) get(key string) (string, bool) {
-	val, found := c.tree.Get([]byte(key))
+	val, found, err := c.tree.Get([]byte(key))
+	assert.NoError(c.t, err)
 	if !found {
 		return "", false
 	}
 	return string(val), true
 }
 
+func (c *C) node(ptr uint64) BNode {
+	node, err := c.tree.get(ptr)
+	assert.NoError(c.t, err)
+	return node
+}
+
 func generateRandomString(byteCount int) (string, error) {
 	// Create a byte slice of the specified size.
 	randomBytes := make([]byte, byteCount)
@@ -148,3 +167,284 @@ func TestMulWriteAndDel(t *testing.T) {
 	}
 
 }
+
+func TestRandomInsertDelete(t *testing.T) {
+	c := newC(t)
+	r := mrand.New(mrand.NewSource(1))
+	for i := 0; i < 5000; i++ {
+		key := fmt.Sprintf("k%0*d", 1+r.Intn(200), r.Intn(3000))
+		if r.Intn(3) == 0 {
+			c.del(key)
+		} else {
+			c.add(key, fmt.Sprintf("%0*d", r.Intn(500), i))
+		}
+	}
+	for key, val := range c.ref {
+		treeVal, exist := c.get(key)
+		assert.True(t, exist)
+		assert.Equal(t, val, treeVal)
+	}
+}
+
+func TestOverflowValue(t *testing.T) {
+	c := newC(t)
+	big := strings.Repeat("0123456789", 100_000) // 1MB
+	c.add("big", big)
+	c.add("small", "s")
+	val, exist := c.get("big")
+	assert.True(t, exist)
+	assert.Equal(t, big, val)
+	npages := len(c.pages)
+	assert.True(t, npages > len(big)/BTREE_PAGE_SIZE)
+
+	// replace it with a smaller big value, the old chain is freed
+	c.add("big", big[:5000])
+	val, _ = c.get("big")
+	assert.Equal(t, big[:5000], val)
+	assert.True(t, len(c.pages) < 10)
+
+	assert.True(t, c.del("big"))
+	_, exist = c.get("big")
+	assert.False(t, exist)
+	assert.Equal(t, 1, len(c.pages))
+}
+
+func (c *C) height() int {
+	height := 0
+	for ptr := c.tree.root; ptr != 0; height++ {
+		node := c.node(ptr)
+		if node.btype() == BNODE_LEAF {
+			return height + 1
+		}
+		ptr = node.getPtr(0)
+	}
+	return height
+}
+
+func TestPrefixKeys(t *testing.T) {
+	c := newC(t)
+	for i := 0; i < 15000; i++ {
+		c.add(fmt.Sprintf("tenant/1234/orders/%06d", i), fmt.Sprint(i))
+	}
+	// without the prefix compression, the tree would have 3 levels
+	assert.Equal(t, 2, c.height())
+	for i := 0; i < 15000; i += 7 {
+		val, ok := c.get(fmt.Sprintf("tenant/1234/orders/%06d", i))
+		assert.True(t, ok)
+		assert.Equal(t, fmt.Sprint(i), val)
+	}
+}
+
+func TestRandomPrefixKeys(t *testing.T) {
+	c := newC(t)
+	r := mrand.New(mrand.NewSource(2))
+	prefixes := []string{
+		strings.Repeat("p", 200), strings.Repeat("p", 200) + "/q", strings.Repeat("q", 900), "",
+	}
+	for i := 0; i < 5000; i++ {
+		prefix := prefixes[r.Intn(len(prefixes))]
+		key := fmt.Sprintf("%s%d", prefix, r.Intn(1000))
+		if r.Intn(3) == 0 {
+			c.del(key)
+		} else {
+			c.add(key, fmt.Sprintf("%0*d", r.Intn(300), i))
+		}
+	}
+	for key, val := range c.ref {
+		treeVal, exist := c.get(key)
+		assert.True(t, exist)
+		assert.Equal(t, val, treeVal)
+	}
+	for key := range c.ref {
+		assert.True(t, c.del(key))
+	}
+	assert.Equal(t, 1, c.height())
+}
+
+func TestBadInput(t *testing.T) {
+	c := newC(t)
+	c.add("a", "1")
+	big := make([]byte, BTREE_MAX_KEY_SIZE+1)
+
+	assert.ErrorIs(t, c.tree.Insert(nil, []byte("x")), ErrEmptyKey)
+	assert.ErrorIs(t, c.tree.Insert(big, []byte("x")), ErrKeyTooLarge)
+	_, _, err := c.tree.Get(nil)
+	assert.ErrorIs(t, err, ErrEmptyKey)
+	_, _, err = c.tree.Get(big)
+	assert.ErrorIs(t, err, ErrKeyTooLarge)
+	_, err = c.tree.Delete(nil)
+	assert.ErrorIs(t, err, ErrEmptyKey)
+	_, err = c.tree.Delete(big)
+	assert.ErrorIs(t, err, ErrKeyTooLarge)
+
+	// the largest key is fine
+	c.add(string(big[:BTREE_MAX_KEY_SIZE]), "2")
+	val, ok := c.get(string(big[:BTREE_MAX_KEY_SIZE]))
+	assert.True(t, ok)
+	assert.Equal(t, "2", val)
+	val, ok = c.get("a")
+	assert.True(t, ok)
+	assert.Equal(t, "1", val)
+}
+
+func TestBadPointer(t *testing.T) {
+	c := newC(t)
+	for i := 0; i < 1000; i++ {
+		c.add(fmt.Sprintf("key%04d", i), strings.Repeat("v", 100))
+	}
+	assert.True(t, c.height() > 1)
+
+	// a dangling pointer in an internal node
+	root := c.node(c.tree.root)
+	kid := root.getPtr(1)
+	saved := c.pages[kid]
+	delete(c.pages, kid)
+	key := []byte(saved.getKey(0))
+	_, _, err := c.tree.Get(key)
+	assert.ErrorIs(t, err, ErrBadPointer)
+	assert.ErrorIs(t, c.tree.Insert(key, []byte("x")), ErrBadPointer)
+	iter := c.tree.SeekLE(key)
+	assert.False(t, iter.Valid())
+	assert.ErrorIs(t, iter.Err(), ErrBadPointer)
+
+	// a failed allocation fails the update
+	c = newC(t)
+	c.add("a", "1")
+	errFull := errors.New("disk full")
+	c.tree.new = func(BNode) (uint64, error) { return 0, errFull }
+	assert.ErrorIs(t, c.tree.Insert([]byte("b"), []byte("2")), errFull)
+}
+
+func TestUpdateModes(t *testing.T) {
+	c := newC(t)
+	update := func(key string, val string, mode int, expected string) *UpdateReq {
+		req := &UpdateReq{Key: []byte(key), Val: []byte(val), Mode: mode, Expected: []byte(expected)}
+		assert.Nil(t, c.tree.Update(req))
+		if req.Updated {
+			c.ref[key] = val
+		}
+		return req
+	}
+
+	// nothing to update in an empty tree
+	req := update("a", "1", MODE_UPDATE_ONLY, "")
+	assert.False(t, req.Updated)
+	assert.Equal(t, uint64(0), c.tree.root)
+	req = update("a", "1", MODE_INSERT_ONLY, "")
+	assert.True(t, req.Added)
+	assert.True(t, req.Updated)
+	assert.Nil(t, req.Old)
+
+	for i := 0; i < 1000; i++ {
+		c.add(fmt.Sprintf("k%04d", i), fmt.Sprintf("v%d", i))
+	}
+	pages := len(c.pages)
+	req = update("k0001", "x", MODE_INSERT_ONLY, "")
+	assert.False(t, req.Updated)
+	assert.Equal(t, []byte("v1"), req.Old)
+	req = update("k9999", "x", MODE_UPDATE_ONLY, "")
+	assert.False(t, req.Updated)
+	assert.Nil(t, req.Old)
+	req = update("k0002", "x", MODE_CAS, "v1")
+	assert.False(t, req.Updated)
+	assert.Equal(t, []byte("v2"), req.Old)
+	req = update("k9999", "x", MODE_CAS, "")
+	assert.False(t, req.Updated)
+	// nothing was copied
+	assert.Equal(t, pages, len(c.pages))
+
+	req = update("k0002", "x", MODE_CAS, "v2")
+	assert.True(t, req.Updated)
+	assert.False(t, req.Added)
+	assert.Equal(t, []byte("v2"), req.Old)
+	req = update("k0003", "y", MODE_UPDATE_ONLY, "")
+	assert.True(t, req.Updated)
+	assert.Equal(t, []byte("v3"), req.Old)
+	req = update("k0003", "z", MODE_UPSERT, "")
+	assert.True(t, req.Updated)
+	assert.Equal(t, []byte("y"), req.Old)
+	req = update("k9999", "z", MODE_UPSERT, "")
+	assert.True(t, req.Added)
+
+	// the old value in overflow pages
+	big := strings.Repeat("big", 5000)
+	update("k0004", big, MODE_UPSERT, "")
+	pages = len(c.pages)
+	req = update("k0004", "x", MODE_INSERT_ONLY, "")
+	assert.Equal(t, []byte(big), req.Old)
+	assert.Equal(t, pages, len(c.pages))
+	req = update("k0004", "small", MODE_CAS, big)
+	assert.True(t, req.Updated)
+	assert.Equal(t, []byte(big), req.Old)
+
+	for key, val := range c.ref {
+		treeVal, ok := c.get(key)
+		assert.True(t, ok)
+		assert.Equal(t, val, treeVal)
+	}
+	assert.NotNil(t, c.tree.Update(&UpdateReq{Key: []byte("a"), Mode: 9}))
+}
+
+// the non-root nodes smaller than BTREE_MIN_FILL.
+func (c *C) underfull(ptr uint64) []uint64 {
+	node := c.node(ptr)
+	small := []uint64{}
+	for i := uint16(0); node.btype() == BNODE_NODE && i < node.nkeys(); i++ {
+		kptr := node.getPtr(i)
+		if c.node(kptr).nbytes() < BTREE_MIN_FILL {
+			small = append(small, kptr)
+		}
+		small = append(small, c.underfull(kptr)...)
+	}
+	return small
+}
+
+func TestRedistribute(t *testing.T) {
+	c := newC(t)
+	val := strings.Repeat("v", 200)
+	for i := 0; i < 20; i++ {
+		c.add(fmt.Sprintf("k%03d", i), val)
+	}
+	root := c.node(c.tree.root)
+	assert.Equal(t, uint16(2), root.nkeys())
+	first := root.getKey(1)
+	// fill the 1st leaf
+	for i := 0; i < 9; i++ {
+		c.add(fmt.Sprintf("k%03da", i), val)
+	}
+	assert.True(t, c.node(c.node(c.tree.root).getPtr(0)).nbytes() > BTREE_PAGE_SIZE-BTREE_MIN_FILL)
+
+	// the 2nd leaf becomes small, it can't be merged with the 1st leaf
+	for i := 19; i >= 12; i-- {
+		c.del(fmt.Sprintf("k%03d", i))
+	}
+	root = c.node(c.tree.root)
+	assert.Equal(t, uint16(2), root.nkeys())
+	assert.True(t, bytes.Compare(root.getKey(1), first) < 0) // borrowed from the left
+	assert.Empty(t, c.underfull(c.tree.root))
+	leafDepth := -1
+	assert.Equal(t, len(c.pages), c.reachable(t, c.tree.root, 0, &leafDepth))
+	c.checkCounts(t, c.tree.root)
+
+	// random deletes
+	c = newC(t)
+	r := mrand.New(mrand.NewSource(5))
+	keys := []string{}
+	for _, i := range r.Perm(3000) {
+		key := fmt.Sprintf("k%05d", i)
+		c.add(key, val)
+		keys = append(keys, key)
+	}
+	for _, i := range r.Perm(len(keys))[:2500] {
+		assert.True(t, c.del(keys[i]))
+	}
+	assert.Empty(t, c.underfull(c.tree.root))
+	leafDepth = -1
+	assert.Equal(t, len(c.pages), c.reachable(t, c.tree.root, 0, &leafDepth))
+	c.checkCounts(t, c.tree.root)
+	for key, val := range c.ref {
+		got, ok := c.get(key)
+		assert.True(t, ok)
+		assert.Equal(t, val, got)
+	}
+}
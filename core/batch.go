@@ -0,0 +1,82 @@
+package core
+
+// WriteBatch is a list of updates applied by KV.Batch() as a single update.
+// the keys and values are copied, the caller can reuse the buffers.
+type WriteBatch struct {
+	ops []batchOp
+}
+
+type batchOp struct {
+	key []byte
+	val []byte
+	del bool
+}
+
+// insert or update a key.
+func (b *WriteBatch) Set(key []byte, val []byte) {
+	b.ops = append(b.ops, batchOp{
+		key: append([]byte{}, key...),
+		val: append([]byte{}, val...),
+	})
+}
+
+// delete a key, it's not an error if the key doesn't exist.
+func (b *WriteBatch) Del(key []byte) {
+	b.ops = append(b.ops, batchOp{key: append([]byte{}, key...), del: true})
+}
+
+// the number of updates in the batch.
+func (b *WriteBatch) Len() int {
+	return len(b.ops)
+}
+
+// remove all updates so the batch can be reused.
+func (b *WriteBatch) Reset() {
+	b.ops = b.ops[:0]
+}
+
+// apply the updates of a batch in order, the later ones win for the same key.
+// the updated tree is committed once with a single writePages() and syncPages(),
+// so either all of them or none of them survive a crash.
+// nothing is changed if an update fails.
+func (db *KV) Batch(b *WriteBatch) error {
+	return db.update(b.check, func(rec *walRecord) (bool, error) {
+		changed := false
+		for _, op := range b.ops {
+			if op.del {
+				deleted, err := db.tree.Delete(op.key)
+				if err != nil {
+					return false, err
+				}
+				if deleted {
+					rec.del(op.key)
+				}
+				changed = changed || deleted
+				continue
+			}
+			req := &UpdateReq{Key: op.key, Val: op.val}
+			if err := db.tree.Update(req); err != nil {
+				return false, err
+			}
+			if req.Updated {
+				rec.set(op.key, op.val)
+			}
+			changed = changed || req.Updated
+		}
+		return changed, nil
+	})
+}
+
+// validate the updates before applying any of them.
+func (b *WriteBatch) check() error {
+	for _, op := range b.ops {
+		if op.del {
+			if err := checkKey(op.key); err != nil {
+				return err
+			}
+		} else if err := checkKV(op.key, op.val); err != nil {
+			return err
+		}
+	}
+	return nil
+}
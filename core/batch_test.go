@@ -0,0 +1,93 @@
+package core
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKVBatch(t *testing.T) {
+	db := newTestKV(t)
+	ref := map[string]string{}
+	b := &WriteBatch{}
+	key := []byte{}
+	for i := 0; i < 2000; i++ {
+		key = fmt.Appendf(key[:0], "k%04d", i) // the buffer is reused
+		val := fmt.Sprintf("v%d", i)
+		if i%100 == 0 {
+			val = strings.Repeat("big", 2000) // overflow pages
+		}
+		b.Set(key, []byte(val))
+		ref[string(key)] = val
+	}
+	for i := 0; i < 2000; i += 3 {
+		key := fmt.Sprintf("k%04d", i)
+		b.Del([]byte(key))
+		delete(ref, key)
+	}
+	b.Set([]byte("k0003"), []byte("again"))
+	ref["k0003"] = "again"
+	assert.Equal(t, 2000+667+1, b.Len())
+	assert.Nil(t, db.Batch(b))
+	assert.Empty(t, db.page.updates)
+
+	db.Close()
+	assert.Nil(t, db.Open())
+	count, err := db.Count(nil, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(len(ref)), count)
+	for key, val := range ref {
+		got, ok, err := db.Get([]byte(key))
+		assert.Nil(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, val, string(got))
+	}
+	report, err := db.Check()
+	assert.Nil(t, err, report.String())
+
+	// nothing to change
+	b.Reset()
+	assert.Equal(t, 0, b.Len())
+	b.Del([]byte("nope"))
+	flushed := db.page.flushed
+	assert.Nil(t, db.Batch(b))
+	assert.Equal(t, flushed, db.page.flushed)
+}
+
+func TestKVBatchError(t *testing.T) {
+	db := newTestKV(t)
+	assert.Nil(t, db.Set([]byte("a"), []byte("1")))
+	meta := saveMeta(db)
+
+	// the last update fails, the others are not applied
+	b := &WriteBatch{}
+	b.Set([]byte("a"), []byte("2"))
+	for i := 0; i < 500; i++ {
+		b.Set([]byte(fmt.Sprintf("k%04d", i)), []byte("v"))
+	}
+	b.Del([]byte("a"))
+	b.Set(nil, []byte("x"))
+	assert.ErrorIs(t, db.Batch(b), ErrEmptyKey)
+	assert.Equal(t, meta, saveMeta(db))
+	val, ok, err := db.Get([]byte("a"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "1", string(val))
+	_, ok, err = db.Get([]byte("k0000"))
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	// still usable
+	b.Reset()
+	b.Set([]byte("b"), []byte("2"))
+	assert.Nil(t, db.Batch(b))
+	db.Close()
+	assert.Nil(t, db.Open())
+	count, err := db.Count(nil, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(2), count)
+	report, err := db.Check()
+	assert.Nil(t, err, report.String())
+}
@@ -0,0 +1,337 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// the result of KV.Check().
+type CheckReport struct {
+	Pages         uint64 // the database size in pages, the master page included
+	Keys          uint64 // the dummy key excluded
+	Height        int
+	TreePages     uint64 // the B-tree nodes
+	OverflowPages uint64
+	FreeListPages uint64 // the free list nodes
+	FreePages     uint64 // the pages in the free list
+	Problems      []CheckProblem
+}
+
+type CheckProblem struct {
+	Ptr uint64 // the page with the problem, 0 is the master page
+	Msg string
+}
+
+func (p CheckProblem) String() string {
+	return fmt.Sprintf("page %d: %s", p.Ptr, p.Msg)
+}
+
+func (r *CheckReport) OK() bool {
+	return len(r.Problems) == 0
+}
+
+func (r *CheckReport) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "pages: %d, keys: %d, height: %d\n", r.Pages, r.Keys, r.Height)
+	fmt.Fprintf(&b, "tree: %d, overflow: %d, free list: %d, free: %d\n",
+		r.TreePages, r.OverflowPages, r.FreeListPages, r.FreePages)
+	fmt.Fprintf(&b, "%d problems\n", len(r.Problems))
+	for _, p := range r.Problems {
+		fmt.Fprintf(&b, "%s\n", p)
+	}
+	return b.String()
+}
+
+// Check the structure of the file: the nodes of the B-tree, the free list, and that
+// every page is referenced exactly once by the master page, the tree or the free list.
+// the returned error is ErrInconsistent if there are problems, see the report for them.
+func (db *KV) Check() (*CheckReport, error) {
+	db.writer.Lock()
+	defer db.writer.Unlock()
+	if !db.opened {
+		return &CheckReport{}, ErrClosed
+	}
+	c := &checker{
+		db:        db,
+		report:    &CheckReport{Pages: db.page.flushed},
+		owner:     map[uint64]string{},
+		leafDepth: -1,
+	}
+	c.owner[0] = "the master page"
+	if db.tree.root != 0 {
+		c.checkNode(0, db.tree.root, nil, nil, 0)
+	}
+	c.checkFreeList()
+	if db.wal != nil {
+		for _, ptr := range db.wal.freed {
+			c.visit(0, ptr, "a page freed since the last checkpoint")
+		}
+	}
+	for ptr := uint64(1); ptr < db.page.flushed; ptr++ {
+		if _, ok := c.owner[ptr]; !ok {
+			c.problem(ptr, "not referenced, the page is leaked")
+		}
+	}
+	if n := len(c.report.Problems); n > 0 {
+		return c.report, fmt.Errorf("%w: %d problems, first: %s", ErrInconsistent, n, c.report.Problems[0])
+	}
+	return c.report, nil
+}
+
+type checker struct {
+	db        *KV
+	report    *CheckReport
+	owner     map[uint64]string // what references each page
+	leafDepth int
+}
+
+func (c *checker) problem(ptr uint64, format string, args ...interface{}) {
+	c.report.Problems = append(c.report.Problems, CheckProblem{Ptr: ptr, Msg: fmt.Sprintf(format, args...)})
+}
+
+// mark a page as referenced by `owner`, it fails if it's out of the file
+// or it's already referenced.
+func (c *checker) visit(from uint64, ptr uint64, owner string) bool {
+	if ptr == 0 || ptr >= c.db.page.flushed {
+		c.problem(from, "bad pointer %d to %s", ptr, owner)
+		return false
+	}
+	if prev, ok := c.owner[ptr]; ok {
+		c.problem(ptr, "referenced as %s and %s", prev, owner)
+		return false
+	}
+	c.owner[ptr] = owner
+	return true
+}
+
+// read a page, a bad checksum is a problem.
+func (c *checker) get(ptr uint64, btype uint16) (BNode, bool) {
+	node, err := c.db.pageGet(ptr)
+	if err != nil {
+		c.problem(ptr, "%v", err)
+		return BNode{}, false
+	}
+	if node.btype() != btype {
+		c.problem(ptr, "bad node type %d, expected %d", node.btype(), btype)
+		return BNode{}, false
+	}
+	return node, true
+}
+
+// check a subtree referenced by the page `from` whose keys are in [first, upper) and
+// starts with `first`, which is the separator key in the parent, or the dummy key for the root.
+// returns the number of keys in the leaves with the flags, see nodeCountFlags(),
+// and whether the subtree is intact.
+func (c *checker) checkNode(from uint64, ptr uint64, first []byte, upper []byte, depth int) (uint64, bool) {
+	if !c.visit(from, ptr, "a tree node") {
+		return 0, false
+	}
+	c.report.TreePages++
+	node, err := c.db.pageGet(ptr)
+	if err != nil {
+		c.problem(ptr, "%v", err)
+		return 0, false
+	}
+	btype := node.btype()
+	if btype != BNODE_LEAF && btype != BNODE_NODE {
+		c.problem(ptr, "bad node type %d", btype)
+		return 0, false
+	}
+	flags := binary.LittleEndian.Uint16(node.data) &^ btype
+	if want := uint16(BNODE_PREFIX); flags != want && !(btype == BNODE_NODE && flags == want|BNODE_COUNTS) {
+		c.problem(ptr, "bad node flags %#x", flags)
+		return 0, false
+	}
+	if btype == BNODE_NODE && flags&BNODE_COUNTS == 0 {
+		c.problem(ptr, "internal node without the subtree counts")
+		return 0, false
+	}
+	if msg := nodeCheckLayout(node); msg != "" {
+		c.problem(ptr, "%s", msg)
+		return 0, false
+	}
+
+	// the keys
+	ok := true
+	nkeys := node.nkeys()
+	for i := uint16(0); i < nkeys; i++ {
+		key := node.getKey(i)
+		switch {
+		case i == 0 && !bytes.Equal(key, first):
+			c.problem(ptr, "the first key %q doesn't match the separator %q", key, first)
+			ok = false
+		case i > 0 && c.db.tree.cmp.compare(node.getKey(i-1), key) >= 0:
+			c.problem(ptr, "key %d %q is not after %q", i, key, node.getKey(i-1))
+			ok = false
+		case len(key) > BTREE_MAX_KEY_SIZE:
+			c.problem(ptr, "key %d is too large: %d bytes", i, len(key))
+			ok = false
+		}
+	}
+	if last := node.getKey(nkeys - 1); upper != nil && c.db.tree.cmp.compare(last, upper) >= 0 {
+		c.problem(ptr, "the last key %q is not before the next separator %q", last, upper)
+		ok = false
+	}
+
+	if btype == BNODE_LEAF {
+		if c.leafDepth < 0 {
+			c.leafDepth = depth
+			c.report.Height = depth + 1
+		} else if c.leafDepth != depth {
+			c.problem(ptr, "leaf at depth %d, expected %d", depth, c.leafDepth)
+			ok = false
+		}
+		for i := uint16(0); i < nkeys; i++ {
+			ok = c.checkValue(ptr, node, i) && ok
+		}
+		if depth == 0 {
+			c.report.Keys = uint64(nkeys) - 1
+		}
+		return nodeCountFlags(node), ok
+	}
+
+	// the kids
+	total, noOverflow := uint64(0), uint64(COUNT_NO_OVERFLOW)
+	for i := uint16(0); i < nkeys; i++ {
+		next := upper
+		if i+1 < nkeys {
+			next = node.getKey(i + 1)
+		}
+		found, kidOK := c.checkNode(ptr, node.getPtr(i), node.getKey(i), next, depth+1)
+		count := found &^ COUNT_NO_OVERFLOW
+		if kidOK && count != node.getCount(i) {
+			c.problem(ptr, "the count of kid %d is %d, %d keys found", i, node.getCount(i), count)
+			kidOK = false
+		}
+		// a missing flag is fine, the leaves are read when they are freed
+		if kidOK && node.getCountFlags(i)&^found&COUNT_NO_OVERFLOW != 0 {
+			c.problem(ptr, "kid %d is flagged without overflow values, but it has some", i)
+			kidOK = false
+		}
+		ok = ok && kidOK
+		total += count
+		noOverflow &= found
+	}
+	if depth == 0 && total > 0 {
+		c.report.Keys = total - 1
+	}
+	return total | noOverflow, ok
+}
+
+// the offsets must be in the page, before reading any key.
+func nodeCheckLayout(node BNode) string {
+	nkeys := node.nkeys()
+	if nkeys == 0 {
+		return "empty node"
+	}
+	// the prefix length is read before getPrefix() slices the page with it
+	if plen := binary.LittleEndian.Uint16(node.data[HEADER:]); plen > BTREE_MAX_PREFIX_SIZE {
+		return fmt.Sprintf("prefix too long: %d bytes", plen)
+	}
+	base := int(node.bodyPos()) + int(node.overhead())*int(nkeys)
+	if base > BTREE_PAGE_SIZE {
+		return fmt.Sprintf("too many keys: %d", nkeys)
+	}
+	for i := uint16(0); i < nkeys; i++ {
+		if node.getOffset(i) > node.getOffset(i+1) {
+			return fmt.Sprintf("bad offset of key %d", i+1)
+		}
+	}
+	if size := base + int(node.getOffset(nkeys)); size > BTREE_PAGE_SIZE {
+		return fmt.Sprintf("nbytes %d is larger than a page", size)
+	}
+	for i := uint16(0); node.btype() == BNODE_LEAF && i < nkeys; i++ {
+		pos, end := node.kvPos(i), node.kvPos(i+1)
+		if pos+2 > end || pos+2+node.leafKlen(pos) > end {
+			return fmt.Sprintf("bad klen of key %d", i)
+		}
+	}
+	return ""
+}
+
+// an inline value or the chain of overflow pages.
+func (c *checker) checkValue(ptr uint64, node BNode, idx uint16) bool {
+	val := node.getVal(idx)
+	if !leafIsOverflow(node, idx) {
+		if len(val) > BTREE_MAX_VAL_SIZE {
+			c.problem(ptr, "value %d is too large: %d bytes", idx, len(val))
+			return false
+		}
+		return true
+	}
+	if len(val) != 16 {
+		c.problem(ptr, "bad overflow reference of value %d", idx)
+		return false
+	}
+	size := binary.LittleEndian.Uint64(val[0:8])
+	npages := (size + OVERFLOW_CAP - 1) / OVERFLOW_CAP
+	if size <= BTREE_MAX_VAL_SIZE || size > BTREE_MAX_OVERFLOW_SIZE {
+		c.problem(ptr, "bad overflow size %d of value %d", size, idx)
+		return false
+	}
+	from, next := ptr, binary.LittleEndian.Uint64(val[8:16])
+	for i := uint64(0); i < npages; i++ {
+		if !c.visit(from, next, "an overflow page") {
+			return false
+		}
+		c.report.OverflowPages++
+		ov, ok := c.get(next, BNODE_OVERFLOW)
+		if !ok {
+			return false
+		}
+		from, next = next, ovNext(ov)
+	}
+	if next != 0 {
+		c.problem(from, "the overflow chain is longer than the value size %d", size)
+		return false
+	}
+	return true
+}
+
+func (c *checker) checkFreeList() {
+	total, err := c.db.free.Total()
+	if err != nil {
+		c.problem(c.db.free.head, "%v", err)
+		return
+	}
+	// the oldest items are taken by the logged updates of the WAL mode,
+	// they are in use, but not removed from the list until the checkpoint.
+	taken := total - uint64(c.db.page.nfree)
+	// the nodes after the last item are not followed, see FreeList.
+	found := uint64(0)
+	for from, ptr := uint64(0), c.db.free.head; found < total; {
+		if ptr == 0 {
+			c.problem(c.db.free.head, "the free list total is %d, %d pages found", total, found)
+			return
+		}
+		if !c.visit(from, ptr, "a free list node") {
+			return
+		}
+		c.report.FreeListPages++
+		node, ok := c.get(ptr, BNODE_FREE_LIST)
+		if !ok {
+			return
+		}
+		size := flnSize(node)
+		if size > FREE_LIST_CAP {
+			c.problem(ptr, "too many free pages in a node: %d", size)
+			return
+		}
+		for i := 0; i < size && found < total; i++ {
+			if ver := flnVer(node, i); ver > c.db.ver {
+				c.problem(ptr, "page %d is freed by version %d after the last version %d", flnPtr(node, i), ver, c.db.ver)
+			}
+			if found >= taken {
+				found++
+				continue
+			}
+			if c.visit(ptr, flnPtr(node, i), "a free page") {
+				c.report.FreePages++
+			}
+			found++
+		}
+		from, ptr = ptr, flnNext(node)
+	}
+}
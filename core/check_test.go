@@ -0,0 +1,126 @@
+package core
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newCheckKV(t *testing.T) *KV {
+	db := newTestKV(t)
+	for i := 0; i < 1200; i++ {
+		val := strings.Repeat("v", i%200)
+		if i%200 == 0 {
+			val = strings.Repeat("big", 3000) // overflow pages
+		}
+		assert.Nil(t, db.Set([]byte(fmt.Sprintf("k%04d", i)), []byte(val)))
+	}
+	for i := 0; i < 1200; i += 3 {
+		_, err := db.Del([]byte(fmt.Sprintf("k%04d", i)))
+		assert.Nil(t, err)
+	}
+	return db
+}
+
+// modify a page in place with a valid checksum.
+func patchPage(t *testing.T, db *KV, ptr uint64, fn func(node BNode)) {
+	page, err := db.pager.Read(ptr)
+	assert.Nil(t, err)
+	page = append([]byte(nil), page...)
+	fn(BNode{page})
+	pageSetChecksum(page)
+	assert.Nil(t, db.pager.Write(ptr, page))
+}
+
+// flip a bit of a page without updating the checksum.
+func corruptPage(t *testing.T, db *KV, ptr uint64) {
+	page, err := db.pager.Read(ptr)
+	assert.Nil(t, err)
+	page = append([]byte(nil), page...)
+	page[100] ^= 1
+	assert.Nil(t, db.pager.Write(ptr, page))
+}
+
+func checkProblems(t *testing.T, db *KV, msgs ...string) {
+	report, err := db.Check()
+	assert.ErrorIs(t, err, ErrInconsistent)
+	for _, msg := range msgs {
+		assert.Contains(t, report.String(), msg)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	db := newTestKV(t)
+	report, err := db.Check()
+	assert.Nil(t, err)
+	assert.True(t, report.OK())
+
+	db = newCheckKV(t)
+	_, err = db.DeleteRange([]byte("k0400"), []byte("k0800"))
+	assert.Nil(t, err)
+	db.Close()
+	assert.Nil(t, db.Open())
+
+	report, err = db.Check()
+	assert.Nil(t, err, report.String())
+	count, err := db.Count(nil, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, count, report.Keys)
+	assert.Equal(t, db.page.flushed, report.Pages)
+	assert.Equal(t, report.Pages, 1+report.TreePages+report.OverflowPages+report.FreeListPages+report.FreePages)
+	assert.True(t, report.Height > 1)
+	assert.True(t, report.OverflowPages > 0)
+	assert.True(t, report.FreePages > 0)
+}
+
+func TestCheckProblems(t *testing.T) {
+	// keys out of order
+	db := newCheckKV(t)
+	root, _ := db.pageGet(db.tree.root)
+	leaf := root.getPtr(1)
+	patchPage(t, db, leaf, func(node BNode) {
+		key := node.getSuffix(2)
+		key[len(key)-1] = 0
+	})
+	checkProblems(t, db, fmt.Sprintf("page %d: key 2", leaf), "is not after")
+
+	// a kid referenced twice, the other one is leaked
+	db = newCheckKV(t)
+	root, _ = db.pageGet(db.tree.root)
+	leaked := root.getPtr(2)
+	patchPage(t, db, db.tree.root, func(node BNode) {
+		node.setPtr(2, node.getPtr(1))
+	})
+	checkProblems(t, db, "referenced as a tree node and a tree node",
+		fmt.Sprintf("page %d: not referenced", leaked))
+
+	// a wrong subtree count
+	db = newCheckKV(t)
+	patchPage(t, db, db.tree.root, func(node BNode) {
+		node.setCount(0, node.getCount(0)+1)
+	})
+	checkProblems(t, db, fmt.Sprintf("page %d: the count of kid 0", db.tree.root))
+
+	// a bad checksum
+	db = newCheckKV(t)
+	root, _ = db.pageGet(db.tree.root)
+	leaf = root.getPtr(1)
+	corruptPage(t, db, leaf)
+	checkProblems(t, db, fmt.Sprintf("page %d: corrupted page", leaf))
+
+	// the free list is lost
+	db = newCheckKV(t)
+	db.free.head = 0
+	checkProblems(t, db, "not referenced, the page is leaked")
+
+	// a bad offset doesn't crash the checker
+	db = newCheckKV(t)
+	root, _ = db.pageGet(db.tree.root)
+	leaf = root.getPtr(1)
+	patchPage(t, db, leaf, func(node BNode) {
+		node.setOffset(node.nkeys(), BTREE_PAGE_SIZE)
+	})
+	checkProblems(t, db, fmt.Sprintf("page %d: nbytes", leaf))
+}
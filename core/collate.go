@@ -0,0 +1,162 @@
+package core
+
+import "bytes"
+
+// Comparator defines the order of the keys in a BTree.
+// The empty key must be the lowest key, it's the dummy key of the tree.
+// Keys comparing equal are the same key.
+type Comparator struct {
+	// persisted in the master page, a file can only be opened with the same order.
+	Name string
+	// returns -1, 0 or +1 like bytes.Compare().
+	Compare func(a, b []byte) int
+	// A node stores the prefix shared by its first and last key only once, see b_node.go.
+	// Every key between them must share the prefix too, which is true for the byte order,
+	// and comparing 2 keys with the prefix removed must give the same result.
+	// Other orders must end the prefix before the first byte that is not compared
+	// byte by byte, for which PrefixStop returns true. nil disables the prefix.
+	PrefixStop func(c byte) bool
+}
+
+// the longest Comparator.Name that can be stored in the master page.
+const COMPARATOR_MAX_NAME_SIZE = 64
+
+func (cmp *Comparator) valid() bool {
+	return cmp.Compare != nil && 0 < len(cmp.Name) && len(cmp.Name) <= COMPARATOR_MAX_NAME_SIZE
+}
+
+// the byte order, the default.
+var CmpBinary = &Comparator{
+	Name:       "binary",
+	Compare:    bytes.Compare,
+	PrefixStop: func(c byte) bool { return false },
+}
+
+// the byte order with ASCII letters folded to lower case.
+// "ABC" and "abc" are the same key.
+var CmpNoCase = &Comparator{
+	Name:       "nocase",
+	Compare:    compareNoCase,
+	PrefixStop: isASCIILetter,
+}
+
+// runs of decimal digits are compared by their numeric value, so "a9" < "a10".
+// keys with the same value but different leading zeros are ordered by bytes.
+var CmpNatural = &Comparator{
+	Name:       "natural",
+	Compare:    compareNatural,
+	PrefixStop: isDigit,
+}
+
+// the built-in comparators by name.
+var comparators = map[string]*Comparator{
+	CmpBinary.Name:  CmpBinary,
+	CmpNoCase.Name:  CmpNoCase,
+	CmpNatural.Name: CmpNatural,
+}
+
+// a nil comparator is the byte order.
+func (cmp *Comparator) compare(a, b []byte) int {
+	if cmp == nil {
+		return bytes.Compare(a, b)
+	}
+	return cmp.Compare(a, b)
+}
+
+// the shared prefix of a node holding keys from `first` to `last`.
+func nodePrefix(cmp *Comparator, first []byte, last []byte) []byte {
+	if cmp != nil && cmp.PrefixStop == nil {
+		return nil
+	}
+	n := 0
+	for n < len(first) && n < len(last) && n < BTREE_MAX_PREFIX_SIZE && first[n] == last[n] {
+		if cmp != nil && cmp.PrefixStop(first[n]) {
+			break
+		}
+		n++
+	}
+	return first[:n]
+}
+
+func isASCIILetter(c byte) bool {
+	return ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+func foldASCII(c byte) byte {
+	if 'A' <= c && c <= 'Z' {
+		return c + ('a' - 'A')
+	}
+	return c
+}
+
+func compareNoCase(a, b []byte) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		ca, cb := foldASCII(a[i]), foldASCII(b[i])
+		if ca != cb {
+			if ca < cb {
+				return -1
+			}
+			return +1
+		}
+	}
+	return compareInt(len(a), len(b))
+}
+
+func compareNatural(a, b []byte) int {
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		if !isDigit(a[i]) || !isDigit(b[j]) {
+			if a[i] != b[j] {
+				return compareInt(int(a[i]), int(b[j]))
+			}
+			i, j = i+1, j+1
+			continue
+		}
+		// compare the digit runs by value: without the leading zeros,
+		// the longer one is larger, or else it's the byte order.
+		ni, nj := digitRun(a[i:]), digitRun(b[j:])
+		va, vb := trimZeros(a[i:i+ni]), trimZeros(b[j:j+nj])
+		if r := compareInt(len(va), len(vb)); r != 0 {
+			return r
+		}
+		if r := bytes.Compare(va, vb); r != 0 {
+			return r
+		}
+		i, j = i+ni, j+nj
+	}
+	if r := compareInt(len(a)-i, len(b)-j); r != 0 {
+		return r
+	}
+	// the same value, break the tie by bytes
+	return bytes.Compare(a, b)
+}
+
+func digitRun(s []byte) int {
+	n := 0
+	for n < len(s) && isDigit(s[n]) {
+		n++
+	}
+	return n
+}
+
+func trimZeros(s []byte) []byte {
+	for len(s) > 0 && s[0] == '0' {
+		s = s[1:]
+	}
+	return s
+}
+
+func compareInt(a, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return +1
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,104 @@
+package core
+
+import (
+	"fmt"
+	mrand "math/rand"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompare(t *testing.T) {
+	sorted := func(cmp *Comparator, keys ...string) {
+		for i := 1; i < len(keys); i++ {
+			assert.Equal(t, -1, cmp.Compare([]byte(keys[i-1]), []byte(keys[i])), keys[i])
+			assert.Equal(t, +1, cmp.Compare([]byte(keys[i]), []byte(keys[i-1])), keys[i])
+		}
+	}
+	sorted(CmpBinary, "", "A", "B", "a", "b")
+	sorted(CmpNoCase, "", "1", "a", "B", "c", "c1", "D")
+	assert.Equal(t, 0, CmpNoCase.Compare([]byte("Hello"), []byte("hELLO")))
+	sorted(CmpNatural, "", "0", "01", "1", "2", "10", "a", "a2", "a9", "a10", "a010b", "a10b", "b")
+	assert.Equal(t, 0, CmpNatural.Compare([]byte("a10"), []byte("a10")))
+}
+
+func TestNodePrefixStop(t *testing.T) {
+	assert.Equal(t, []byte("user/ab"), nodePrefix(CmpBinary, []byte("user/abc"), []byte("user/abd")))
+	assert.Equal(t, []byte("12/"), nodePrefix(CmpNoCase, []byte("12/abc"), []byte("12/abd")))
+	assert.Equal(t, []byte("user"), nodePrefix(CmpNatural, []byte("user12"), []byte("user13")))
+	assert.Empty(t, nodePrefix(&Comparator{Name: "x", Compare: CmpBinary.Compare}, []byte("ab"), []byte("ab")))
+}
+
+// random updates with a comparator, the reference is keyed by `canon`.
+func testTreeOrder(t *testing.T, cmp *Comparator, canon func(string) string, genKey func(r *mrand.Rand) string) {
+	c := newC(t)
+	c.tree.cmp = cmp
+	ref := map[string]string{} // canonical key -> stored key
+	r := mrand.New(mrand.NewSource(4))
+	for i := 0; i < 4000; i++ {
+		key := genKey(r)
+		if r.Intn(3) == 0 {
+			_, ok := ref[canon(key)]
+			assert.Equal(t, ok, c.del(key))
+			delete(ref, canon(key))
+		} else {
+			c.add(key, key)
+			ref[canon(key)] = key
+		}
+	}
+	keys := []string{}
+	for _, key := range ref {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return cmp.Compare([]byte(keys[i]), []byte(keys[j])) < 0
+	})
+	got := []string{}
+	for iter := c.tree.Seek([]byte("\x00"), CMP_GE); iter.Valid(); iter.Next() {
+		got = append(got, string(iter.Key()))
+		assert.Equal(t, iter.Key(), iter.Value())
+	}
+	assert.Equal(t, keys, got)
+	for i, key := range keys {
+		assert.Equal(t, uint64(i), c.rank(key))
+	}
+	assert.True(t, c.height() > 1)
+}
+
+func TestTreeNoCase(t *testing.T) {
+	dirs := []string{"Dir/", "dir/", "DIR/Sub/", "12/", "12/x"}
+	genKey := func(r *mrand.Rand) string {
+		name := []byte(fmt.Sprintf("%sItem%04d", dirs[r.Intn(len(dirs))], r.Intn(500)))
+		for i := range name {
+			if r.Intn(2) == 0 {
+				name[i] = foldASCII(name[i])
+			}
+		}
+		return string(name) + strings.Repeat("-", r.Intn(100))
+	}
+	testTreeOrder(t, CmpNoCase, strings.ToLower, genKey)
+
+	// case-insensitive lookups
+	c := newC(t)
+	c.tree.cmp = CmpNoCase
+	c.add("Hello", "1")
+	val, ok := c.get("hELLO")
+	assert.True(t, ok)
+	assert.Equal(t, "1", val)
+	c.add("HELLO", "2")
+	iter := c.tree.Seek([]byte("hello"), CMP_GE)
+	assert.Equal(t, []byte("HELLO"), iter.Key())
+	assert.Equal(t, []byte("2"), iter.Value())
+	assert.True(t, c.del("hello"))
+	_, ok = c.get("Hello")
+	assert.False(t, ok)
+}
+
+func TestTreeNatural(t *testing.T) {
+	genKey := func(r *mrand.Rand) string {
+		return fmt.Sprintf("file%d.v%0*d%s", r.Intn(300), r.Intn(3), r.Intn(20), strings.Repeat("x", r.Intn(100)))
+	}
+	testTreeOrder(t, CmpNatural, func(key string) string { return key }, genKey)
+}
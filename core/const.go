@@ -1,7 +1,21 @@
 package core
 
 // unit : byte
-const HEADER = 4
+// | type | nkeys | checksum |
+// | 2B   | 2B    | 4B       |
+const HEADER = 8
 const BTREE_PAGE_SIZE = 4096
 const BTREE_MAX_KEY_SIZE = 1000
 const BTREE_MAX_VAL_SIZE = 3000
+
+// the maximum length of the key prefix shared by a node,
+// it bounds how much a node can grow when its prefix becomes shorter.
+const BTREE_MAX_PREFIX_SIZE = 64
+
+// a non-root node smaller than this after a deletion is merged with a sibling,
+// or borrows keys from it if they don't fit in a page together.
+const BTREE_MIN_FILL = BTREE_PAGE_SIZE / 4
+
+// the largest value. values bigger than BTREE_MAX_VAL_SIZE are stored in
+// overflow pages, a value is still read into memory as a whole.
+const BTREE_MAX_OVERFLOW_SIZE = 1 << 30
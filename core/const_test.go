@@ -7,10 +7,15 @@ import (
 )
 
 func TestNodeSizeFit(t *testing.T) {
-	// | type | nkeys | pointers | offsets | key-values
-	// | 2B | 2B | nkeys * 8B | nkeys * 2B | ...
+	// | type | nkeys | checksum | plen | offsets | key-values
+	// | 2B | 2B | 4B | 2B | nkeys * 2B | ...
 	// 确保 a node with single KV pair always fits on a single page.
-	node1max := HEADER + 8 + 2 + 4 + BTREE_MAX_KEY_SIZE + BTREE_MAX_VAL_SIZE
+	// the prefix is taken from the key, so it doesn't add to the size.
+	leaf1max := HEADER + 2 + 2 + 2 + BTREE_MAX_KEY_SIZE + BTREE_MAX_VAL_SIZE
+	assert.True(t, leaf1max <= BTREE_PAGE_SIZE)
+	// | type | nkeys | checksum | plen | pointers | counts | offsets | keys
+	// | 2B | 2B | 4B | 2B | nkeys * 8B | nkeys * 8B | nkeys * 2B | ...
+	node1max := HEADER + 2 + 8 + 8 + 2 + BTREE_MAX_KEY_SIZE
 	assert.True(t, node1max <= BTREE_PAGE_SIZE)
 }
 
@@ -0,0 +1,71 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// the key is empty, the empty key is reserved for the dummy key.
+	ErrEmptyKey = errors.New("empty key")
+	// the key is longer than BTREE_MAX_KEY_SIZE.
+	ErrKeyTooLarge = errors.New("key too large")
+	// the value is longer than BTREE_MAX_OVERFLOW_SIZE.
+	ErrValueTooLarge = errors.New("value too large")
+	// a pointer to a page that doesn't exist or was deallocated.
+	ErrBadPointer = errors.New("bad pointer")
+	// a node of an unexpected type.
+	ErrBadNode = errors.New("bad node")
+	// the file was created with a different KV.Comparator.
+	ErrComparatorMismatch = errors.New("comparator mismatch")
+	// KV.Check() found problems in the file.
+	ErrInconsistent = errors.New("inconsistent database")
+	// the transaction is already committed or aborted.
+	ErrTxDone = errors.New("transaction already committed or aborted")
+	// writing or syncing the master page failed, it's unknown whether the update
+	// is durable, so the database must be reopened before the next update.
+	ErrNeedReopen = errors.New("the master page may be partially written, reopen the database")
+	// the KV isn't open, or it's closed by KV.Close().
+	ErrClosed = errors.New("the database is closed")
+	// an update of a KV opened with Options.ReadOnly.
+	ErrReadOnly = errors.New("the database is read-only")
+	// a file in an old format opened with Options.ReadOnly, it's upgraded by
+	// opening it once without Options.ReadOnly.
+	ErrNeedUpgrade = errors.New("the file needs an upgrade, open it read-write once")
+	// the file can't grow beyond Options.MmapMaxSize.
+	ErrMapFull = errors.New("the file is larger than the max mmap size")
+	// the file is locked by another KV, see Options.LockTimeout.
+	ErrLocked = errors.New("the database is locked by another process")
+	// a fault injected by FaultFS.
+	ErrInjected = errors.New("injected fault")
+)
+
+// ErrCorruptPage is returned when a page read from the file fails its checksum.
+type ErrCorruptPage struct {
+	Ptr uint64 // the page number
+}
+
+func (e ErrCorruptPage) Error() string {
+	return fmt.Sprintf("corrupted page %d: checksum mismatch", e.Ptr)
+}
+
+// validate the input of the BTree and KV methods.
+func checkKey(key []byte) error {
+	if len(key) == 0 {
+		return ErrEmptyKey
+	}
+	if len(key) > BTREE_MAX_KEY_SIZE {
+		return fmt.Errorf("%w: %d bytes", ErrKeyTooLarge, len(key))
+	}
+	return nil
+}
+
+func checkKV(key []byte, val []byte) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	if len(val) > BTREE_MAX_OVERFLOW_SIZE {
+		return fmt.Errorf("%w: %d bytes", ErrValueTooLarge, len(val))
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+	"time"
+)
+
+// how often a locked file is retried, see Options.LockTimeout.
+const LOCK_RETRY_INTERVAL = 10 * time.Millisecond
+
+// the file operations used by KV, so that the tests can replace them, see FaultFS.
+// the pages are written via the mmap, the master page via WriteAt(),
+// both are durable after Sync().
+type File interface {
+	io.ReaderAt
+	io.WriterAt
+	Size() (int64, error)
+	Truncate(size int64) error
+	Sync() error
+	// a shared mapping of the file, it can be larger than the file.
+	Mmap(offset int64, length int) ([]byte, error)
+	Munmap(chunk []byte) error
+	// flock() without blocking, it fails with ErrLocked if another file holds a
+	// conflicting lock. the lock is released by Close().
+	Lock(exclusive bool) error
+	Close() error
+}
+
+// opens or creates the database file, see KV.FS.
+// the flag and the permissions are the ones of os.OpenFile().
+type FS interface {
+	OpenFile(path string, flag int, perm os.FileMode) (File, error)
+}
+
+// the OS files, the default of KV.FS.
+type osFS struct{}
+
+type osFile struct {
+	*os.File
+	readonly bool // the mmap is read-only too
+}
+
+func (osFS) OpenFile(path string, flag int, perm os.FileMode) (File, error) {
+	fp, err := os.OpenFile(path, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return osFile{fp, flag&(os.O_WRONLY|os.O_RDWR) == 0}, nil
+}
+
+func (f osFile) Size() (int64, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("stat: %w", err)
+	}
+	return fi.Size(), nil
+}
+
+func (f osFile) Mmap(offset int64, length int) ([]byte, error) {
+	prot := syscall.PROT_READ | syscall.PROT_WRITE // 读写权限
+	if f.readonly {
+		prot = syscall.PROT_READ
+	}
+	return syscall.Mmap(
+		int(f.Fd()),        // 文件描述符
+		offset,             // 偏移量
+		length,             // 映射大小
+		prot,               // 权限
+		syscall.MAP_SHARED, // 共享映射
+	)
+}
+
+func (f osFile) Munmap(chunk []byte) error {
+	return syscall.Munmap(chunk)
+}
+
+func (f osFile) Lock(exclusive bool) error {
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	err := syscall.Flock(int(f.Fd()), how|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return ErrLocked
+	}
+	return err
+}
+
+// open the database file for a pager and lock it, an exclusive lock for
+// writing, a shared lock for Options.ReadOnly. returns the file size.
+func openFile(fs FS, path string, opts Options) (File, int, error) {
+	fp, err := fs.OpenFile(path, opts.openFlag(), opts.FileMode)
+	if err != nil {
+		return nil, 0, fmt.Errorf("OpenFile: %w", err)
+	}
+	deadline := time.Now().Add(opts.LockTimeout)
+	for {
+		err = fp.Lock(!opts.ReadOnly)
+		if !errors.Is(err, ErrLocked) || !time.Now().Before(deadline) {
+			break
+		}
+		time.Sleep(min(LOCK_RETRY_INTERVAL, time.Until(deadline)))
+	}
+	size := int64(0)
+	if err == nil {
+		size, err = fp.Size()
+	}
+	if err != nil {
+		_ = fp.Close()
+		return nil, 0, err
+	}
+	return fp, int(size), nil
+}
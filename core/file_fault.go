@@ -0,0 +1,165 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"os"
+	"sync"
+)
+
+// FaultFS is a FS for testing the crash recovery. the files are OS files, and the
+// content of each file at its last Sync() is kept as the durable one.
+// Crash() simulates a power loss, the writes after the last Sync() are dropped,
+// kept or torn randomly. the faults are injected randomly at the given rates.
+type FaultFS struct {
+	Rand         *rand.Rand
+	SyncErrRate  float64 // Sync() fails, the writes stay unsynced
+	WriteErrRate float64 // WriteAt() fails after writing a random prefix of the data
+	// the process dies before a WriteAt() or Sync(), the later calls fail until Crash().
+	CrashRate float64
+	mu        sync.Mutex
+	crashed   bool
+	durable   map[string][]byte // the synced content of each file
+}
+
+type faultFile struct {
+	File
+	fs   *FaultFS
+	path string
+}
+
+func (fs *FaultFS) OpenFile(path string, flag int, perm os.FileMode) (File, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.crashed {
+		return nil, fmt.Errorf("%w: crashed", ErrInjected)
+	}
+	fp, err := osFS{}.OpenFile(path, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	if fs.durable == nil {
+		fs.durable = map[string][]byte{}
+	}
+	if _, ok := fs.durable[path]; !ok {
+		// the existing content is durable
+		data, err := os.ReadFile(path)
+		if err != nil {
+			_ = fp.Close()
+			return nil, err
+		}
+		fs.durable[path] = data
+	}
+	return &faultFile{File: fp, fs: fs, path: path}, nil
+}
+
+// whether the process has died, see CrashRate.
+func (fs *FaultFS) Crashed() bool {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.crashed
+}
+
+// inject a fault at the rate.
+func (fs *FaultFS) fault(rate float64) bool {
+	return rate > 0 && fs.Rand.Float64() < rate
+}
+
+// the process may die before each write.
+func (fs *FaultFS) beforeWrite() error {
+	if !fs.crashed && fs.fault(fs.CrashRate) {
+		fs.crashed = true
+	}
+	if fs.crashed {
+		return fmt.Errorf("%w: crashed", ErrInjected)
+	}
+	return nil
+}
+
+// simulate a power loss and a restart, the files must be closed before it.
+// each page that differs from the durable content is the old one, the new one,
+// or torn: a prefix of the new one followed by the old one.
+// the file size is either the durable one or the new one.
+func (fs *FaultFS) Crash() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	for path, old := range fs.durable {
+		cur, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		size := len(cur)
+		if fs.Rand.Intn(2) == 0 {
+			size = len(old)
+		}
+		data := make([]byte, size)
+		copy(data, old)
+		for pos := 0; pos < size && pos < len(cur); pos += BTREE_PAGE_SIZE {
+			new := cur[pos:min(pos+BTREE_PAGE_SIZE, size, len(cur))]
+			if bytes.Equal(new, data[pos:pos+len(new)]) {
+				continue
+			}
+			switch fs.Rand.Intn(3) {
+			case 0: // lost
+			case 1:
+				copy(data[pos:], new)
+			case 2:
+				copy(data[pos:], new[:fs.Rand.Intn(len(new))])
+			}
+		}
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			return err
+		}
+		fs.durable[path] = data
+	}
+	fs.crashed = false
+	return nil
+}
+
+func (f *faultFile) WriteAt(data []byte, off int64) (int, error) {
+	fs := f.fs
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := fs.beforeWrite(); err != nil {
+		return 0, err
+	}
+	if fs.fault(fs.WriteErrRate) {
+		n, err := f.File.WriteAt(data[:fs.Rand.Intn(len(data)+1)], off)
+		if err == nil {
+			err = fmt.Errorf("%w: write", ErrInjected)
+		}
+		return n, err
+	}
+	return f.File.WriteAt(data, off)
+}
+
+func (f *faultFile) Truncate(size int64) error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.fs.crashed {
+		return fmt.Errorf("%w: crashed", ErrInjected)
+	}
+	return f.File.Truncate(size)
+}
+
+func (f *faultFile) Sync() error {
+	fs := f.fs
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := fs.beforeWrite(); err != nil {
+		return err
+	}
+	if fs.fault(fs.SyncErrRate) {
+		return fmt.Errorf("%w: fsync", ErrInjected)
+	}
+	if err := f.File.Sync(); err != nil {
+		return err
+	}
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return err
+	}
+	fs.durable[f.path] = data
+	return nil
+}
@@ -0,0 +1,196 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFaultFS(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	old := bytes.Repeat([]byte("o"), 3*BTREE_PAGE_SIZE)
+	new := bytes.Repeat([]byte("n"), 3*BTREE_PAGE_SIZE)
+	for seed := int64(0); seed < 30; seed++ {
+		assert.Nil(t, os.WriteFile(path, old[:BTREE_PAGE_SIZE], 0644))
+		fs := &FaultFS{Rand: rand.New(rand.NewSource(seed))}
+		fp, err := fs.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+		assert.Nil(t, err)
+		// the 1st page is synced, the others are not
+		_, err = fp.WriteAt(old[BTREE_PAGE_SIZE:], BTREE_PAGE_SIZE)
+		assert.Nil(t, err)
+		assert.Nil(t, fp.Sync())
+		_, err = fp.WriteAt(new, 0)
+		assert.Nil(t, err)
+		_, err = fp.WriteAt(new[:BTREE_PAGE_SIZE], 3*BTREE_PAGE_SIZE)
+		assert.Nil(t, err)
+		assert.Nil(t, fp.Close())
+
+		assert.Nil(t, fs.Crash())
+		data, err := os.ReadFile(path)
+		assert.Nil(t, err)
+		assert.Contains(t, []int{3 * BTREE_PAGE_SIZE, 4 * BTREE_PAGE_SIZE}, len(data))
+		for pos := 0; pos < len(data); pos += BTREE_PAGE_SIZE {
+			// the old page, the new page or a prefix of the new page
+			page := data[pos : pos+BTREE_PAGE_SIZE]
+			n := len(page) - len(bytes.TrimLeft(page, "n"))
+			rest := page[n:]
+			if pos == 3*BTREE_PAGE_SIZE {
+				assert.Equal(t, make([]byte, len(rest)), rest)
+			} else {
+				assert.Equal(t, old[:len(rest)], rest)
+			}
+		}
+	}
+
+	// injected errors
+	fs := &FaultFS{Rand: rand.New(rand.NewSource(1)), SyncErrRate: 1, WriteErrRate: 1}
+	fp, err := fs.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	assert.Nil(t, err)
+	_, err = fp.WriteAt(new, 0)
+	assert.ErrorIs(t, err, ErrInjected)
+	assert.ErrorIs(t, fp.Sync(), ErrInjected)
+	fs.SyncErrRate, fs.WriteErrRate, fs.CrashRate = 0, 0, 1
+	assert.ErrorIs(t, fp.Sync(), ErrInjected)
+	assert.True(t, fs.Crashed())
+	fs.CrashRate = 0
+	_, err = fp.WriteAt(new, 0)
+	assert.ErrorIs(t, err, ErrInjected)
+	assert.Nil(t, fp.Close())
+	assert.Nil(t, fs.Crash())
+	assert.False(t, fs.Crashed())
+}
+
+// the keys and values of a KV.
+func kvDump(t *testing.T, db *KV) map[string]string {
+	m := map[string]string{}
+	assert.Nil(t, db.Scan(nil, nil, func(key, val []byte) bool {
+		m[string(key)] = string(val)
+		return true
+	}))
+	return m
+}
+
+// the master page is not durable if writing it fails.
+func TestKVNeedReopen(t *testing.T) {
+	fs := &FaultFS{Rand: rand.New(rand.NewSource(1))}
+	db := &KV{Path: filepath.Join(t.TempDir(), "test.db"), FS: fs}
+	assert.Nil(t, db.Open())
+	defer db.Close()
+	assert.Nil(t, db.Set([]byte("k"), []byte("1")))
+
+	fs.WriteErrRate = 1
+	assert.ErrorIs(t, db.Set([]byte("k"), []byte("2")), ErrNeedReopen)
+	fs.WriteErrRate = 0
+	assert.ErrorIs(t, db.Set([]byte("k"), []byte("3")), ErrNeedReopen)
+	val, _, err := db.Get([]byte("k"))
+	assert.Nil(t, err)
+	assert.Equal(t, "1", string(val))
+
+	db.Close()
+	assert.Nil(t, fs.Crash())
+	assert.Nil(t, db.Open())
+	val, _, err = db.Get([]byte("k"))
+	assert.Nil(t, err)
+	assert.Contains(t, []string{"1", "2"}, string(val))
+	assert.Nil(t, db.Set([]byte("k"), []byte("3")))
+}
+
+// random updates with random faults and crashes. after each crash, the
+// database has every successful update, and maybe the last failed one.
+func TestKVCrash(t *testing.T) {
+	for seed := int64(1); seed <= 10; seed++ {
+		t.Run(fmt.Sprint(seed), func(t *testing.T) {
+			testKVCrash(t, seed, NewMmapPager(), Options{})
+		})
+		t.Run(fmt.Sprintf("file pager %d", seed), func(t *testing.T) {
+			testKVCrash(t, seed, NewFilePager(16), Options{})
+		})
+	}
+}
+
+func testKVCrash(t *testing.T, seed int64, pager Pager, opts Options) {
+	r := rand.New(rand.NewSource(seed))
+	fs := &FaultFS{
+		Rand:         rand.New(rand.NewSource(seed)),
+		SyncErrRate:  0.03,
+		WriteErrRate: 0.02,
+		CrashRate:    0.03,
+	}
+	db := &KV{Path: filepath.Join(t.TempDir(), "test.db"), FS: fs, Pager: pager}
+	// the recovery of the WAL mode writes the files, it's retried if it fails
+	open := func() error {
+		err := db.OpenWith(opts)
+		for n := 0; n < 100 && (errors.Is(err, ErrInjected) || errors.Is(err, ErrNeedReopen)); n++ {
+			if err := fs.Crash(); err != nil {
+				return err
+			}
+			err = db.OpenWith(opts)
+		}
+		return err
+	}
+	assert.Nil(t, open())
+	defer db.Close()
+
+	committed := map[string]string{}
+	crashes := 0
+	for i := 0; i < 300; i++ {
+		next := map[string]string{}
+		for k, v := range committed {
+			next[k] = v
+		}
+		b := &WriteBatch{}
+		for n := 1 + r.Intn(20); n > 0; n-- {
+			key := fmt.Sprintf("k%03d", r.Intn(300))
+			if r.Intn(4) == 0 {
+				b.Del([]byte(key))
+				delete(next, key)
+				continue
+			}
+			val := strings.Repeat(fmt.Sprint(i), r.Intn(50))
+			if r.Intn(30) == 0 {
+				val = strings.Repeat("big", 3000) // overflow pages
+			}
+			b.Set([]byte(key), []byte(val))
+			next[key] = val
+		}
+		err := db.Batch(b)
+		unknown := err != nil && (errors.Is(err, ErrNeedReopen) || fs.Crashed())
+		if err == nil {
+			committed = next
+		} else if !unknown {
+			// the failed update is reverted
+			assert.ErrorIs(t, err, ErrInjected)
+			assert.Equal(t, committed, kvDump(t, db))
+		}
+		if !unknown && r.Intn(20) > 0 {
+			continue
+		}
+
+		// crash and reopen
+		crashes++
+		db.Close()
+		assert.Nil(t, fs.Crash())
+		if !assert.Nil(t, open()) {
+			return
+		}
+		got := kvDump(t, db)
+		if unknown && assert.ObjectsAreEqual(next, got) {
+			committed = next
+		}
+		if !assert.Equal(t, committed, got, "update %d", i) {
+			return
+		}
+		report, err := db.Check()
+		if !assert.Nil(t, err, report.String()) {
+			return
+		}
+	}
+	assert.True(t, crashes > 0)
+}
@@ -2,118 +2,249 @@ package core
 
 import (
 	"encoding/binary"
+	"fmt"
+	"sort"
 )
 
 const BNODE_FREE_LIST = 3
-const FREE_LIST_HEADER = 4 + 8 + 8 // 定义了自由列表节点的头部大小，包括节点类型、大小和指向下一个节点的指针
-// FREE_LIST_CAP表示在一个页面中可以存储的指针数量 (一个指针8B)
-const FREE_LIST_CAP = (BTREE_PAGE_SIZE - FREE_LIST_HEADER) / 8
+const FREE_LIST_HEADER = 4 + 4 + 8 + 8 // 定义了自由列表节点的头部大小，包括节点类型、大小、校验和、总数和指向下一个节点的指针
+// FREE_LIST_CAP表示在一个页面中可以存储的条目数量 (一个指针8B + 一个版本8B)
+const FREE_LIST_CAP = (BTREE_PAGE_SIZE - FREE_LIST_HEADER) / 16
 
 // 函数声明，全部要自己实现
 //func flnSize(node BNode) int
 //func flnNext(node BNode) uint64
 //func flnPtr(node BNode, idx int)
-//func flnSetPtr(node BNode, idx int, ptr uint64)
+//func flnSetItem(node BNode, idx int, ptr uint64, ver uint64)
 //func flnSetHeader(node BNode, size uint16, next uint64)
 //func flnSetTotal(node BNode, total uint64)
 
-// 自由列表节点的格式，next pointer代表下一个自由列表节点，而pointers指向一个个空闲的页面
-// size表示当前节点中存储的指针数量，一个指针指向一个空闲的页面
+// 自由列表节点的格式，next pointer代表下一个自由列表节点，而items指向一个个空闲的页面
+// size表示当前节点中存储的条目数量，一个条目是一个空闲页面的指针和释放它的版本
 // The total number of items in the list. This only applies to the head node
-// | type | size | total | next pointer | pointers... |
-// | 2B   | 2B   | 	8B	 |	8B          | nkeys * 8B  |
+// The checksum is at the same place as in a BNode, it's stamped when the page is written.
+// | type | size | checksum | total | next pointer | items...    |
+// | 2B   | 2B   | 4B       | 8B    | 8B           | size * 16B  |
+// | pointer | version |
+// | 8B      | 8B      |
+//
+// The items are ordered from the newest to the oldest. The freed pages are added
+// at the head by rewriting the head node, the pages are reused from the tail.
+// Only the first `total` items from the head are in the list, so removing items
+// from the tail doesn't rewrite the other nodes, it only decreases the total.
+// The nodes after the last item are garbage, their pages are added to the list.
+//
+// A page freed by version V is still read by the readers of the versions before V,
+// so it's only reused when maxVer >= V, see KV.oldest().
 type FreeList struct {
 	head uint64
 	// callbacks for managing on-disk pages
-	get func(uint64) BNode // dereference a pointer
+	get func(uint64) (BNode, error) // dereference a pointer
 	// The new callback is only for appending new pages
 	// since the free list must reuse pages from itself.
-	new func(BNode) uint64  // append a new page
-	use func(uint64, BNode) // reuse a page
+	new func(BNode) (uint64, error) // append a new page
+	use func(uint64, BNode) error   // reuse a page
+	// the items freed by versions <= maxVer can be reused
+	maxVer uint64
+	// in-memory: the nodes holding the items of the list from `head`
+	nodes     []flNode
+	nodesHead uint64
 }
 
-func (fl *FreeList) Get(topn int) uint64 {
+type flNode struct {
+	ptr   uint64
+	start uint64 // the position of the first item in the list
+	size  int
+}
+
+// read a free list node
+func flGet(fl *FreeList, ptr uint64) (BNode, error) {
+	node, err := fl.get(ptr)
+	if err == nil && node.btype() != BNODE_FREE_LIST {
+		err = ErrBadNode
+	}
+	return node, err
+}
+
+// read the nodes holding the `total` items, once for each head.
+func (fl *FreeList) loadNodes(total uint64) error {
+	if fl.nodesHead == fl.head && fl.nodes != nil {
+		return nil
+	}
+	nodes := []flNode{}
+	count := uint64(0)
+	for ptr := fl.head; count < total; {
+		if ptr == 0 {
+			return fmt.Errorf("%w: the free list is shorter than its total %d", ErrBadPointer, total)
+		}
+		node, err := flGet(fl, ptr)
+		if err != nil {
+			return err
+		}
+		nodes = append(nodes, flNode{ptr: ptr, start: count, size: flnSize(node)})
+		count += uint64(flnSize(node))
+		ptr = flnNext(node)
+	}
+	fl.nodes, fl.nodesHead = nodes, fl.head
+	return nil
+}
+
+// the item at the position `pos` from the head.
+func (fl *FreeList) item(pos uint64) (uint64, uint64, error) {
+	i := sort.Search(len(fl.nodes), func(i int) bool { return fl.nodes[i].start > pos }) - 1
+	if i < 0 {
+		return 0, 0, ErrBadPointer
+	}
+	node, err := flGet(fl, fl.nodes[i].ptr)
+	if err != nil {
+		return 0, 0, err
+	}
+	idx := int(pos - fl.nodes[i].start)
+	return flnPtr(node, idx), flnVer(node, idx), nil
+}
+
+// the topn-th oldest page in the list, and whether it can be reused.
+// the later items can't be reused if this one can't.
+func (fl *FreeList) Get(topn int) (uint64, bool, error) {
 	// assert(0 <= topn && topn < fl.Total())
-	node := fl.get(fl.head)
-	for flnSize(node) <= topn {
-		topn -= flnSize(node)
-		next := flnNext(node)
-		// assert(next != 0)
-		node = fl.get(next)
+	total, err := fl.Total()
+	if err != nil {
+		return 0, false, err
+	}
+	if err := fl.loadNodes(total); err != nil {
+		return 0, false, err
 	}
-	return flnPtr(node, flnSize(node)-topn-1)
+	ptr, ver, err := fl.item(total - 1 - uint64(topn))
+	return ptr, ver <= fl.maxVer, err
 }
 
-// remove `popn` pointers and add some new pointers
-// popn: 表示请求的页面数量
+// remove the `popn` oldest items and add the freed pages of the version `ver`.
+// popn: 表示已经被 pageNew 拿走的页面数量
 // freed: 是一个无符号整型切片，用于存储被释放的页面指针
-func (fl *FreeList) Update(popn int, freed []uint64) {
+func (fl *FreeList) Update(popn int, freed []uint64, ver uint64) error {
 	// assert(popn <= fl.Total())
 	if popn == 0 && len(freed) == 0 {
-		return // nothing to do
+		return nil // nothing to do
+	}
+	total, err := fl.Total()
+	if err != nil {
+		return err
 	}
-	// prepare to construct the new list
-	total := fl.Total() // 获取当前自由列表中的总页面数量
+	if err := fl.loadNodes(total); err != nil {
+		return err
+	}
+	remain := total - uint64(popn)
+	// the new head nodes take the oldest items if they can be reused
 	reuse := []uint64{}
-	for fl.head != 0 && len(reuse)*FREE_LIST_CAP < len(freed) {
-		node := fl.get(fl.head)
-		freed = append(freed, fl.head) // recyle the node itself
-		if popn >= flnSize(node) {
-			// 如果popn大于或等于当前节点的大小，表示可以移除整个节点的所有指针
-			// phase 1
-			// remove all pointers in this node
-			popn -= flnSize(node)
+	for {
+		added, keep, _ := fl.split(remain, freed)
+		nnodes := (len(added) + int(keep) + FREE_LIST_CAP - 1) / FREE_LIST_CAP
+		if len(reuse) > nnodes {
+			// the last item taken makes a node unnecessary, it stays in the list
+			reuse = reuse[:len(reuse)-1]
+			remain++
+			break
+		}
+		if len(reuse) == nnodes || remain == 0 {
+			break
+		}
+		ptr, pver, err := fl.item(remain - 1)
+		if err != nil {
+			return err
+		}
+		if pver > fl.maxVer {
+			break
+		}
+		reuse = append(reuse, ptr)
+		remain--
+	}
+	added, keep, rest := fl.split(remain, freed)
+	return flPush(fl, added, ver, keep, rest, reuse, remain-keep)
+}
+
+// the new head nodes after removing the items from the position `remain`:
+// the freed pages and the pages of the nodes out of the list are added,
+// the first `keep` items of the old head are kept after them,
+// and the nodes in `rest` are unchanged.
+func (fl *FreeList) split(remain uint64, freed []uint64) ([]uint64, uint64, []flNode) {
+	added := append([]uint64{}, freed...)
+	if len(fl.nodes) == 0 {
+		return added, 0, nil
+	}
+	added = append(added, fl.head) // the head is rewritten
+	keep := min(uint64(fl.nodes[0].size), remain)
+	rest := []flNode{}
+	for _, node := range fl.nodes[1:] {
+		if node.start < remain {
+			rest = append(rest, node)
 		} else {
-			// 如果popn小于当前节点的大小，表示只需移除部分指针。计算剩余的指针数量remain
-			// phase 2:
-			// remove some pointers
-			remain := flnSize(node) - popn
-			popn = 0
-			// reuse pointers from the free list itself
-			for remain > 0 && len(reuse)*FREE_LIST_CAP < len(freed)+remain {
-				remain--
-				reuse = append(reuse, flnPtr(node, remain))
-			}
-			// move the node into the `freed` list
-			for i := 0; i < remain; i++ {
-				freed = append(freed, flnPtr(node, i))
-			}
+			added = append(added, node.ptr)
 		}
-		// discard the node and move to the next node
-		total -= uint64(flnSize(node))
-		fl.head = flnNext(node)
 	}
-	// assert(len(reuse)*FREE_LIST_CAP >= len(freed) || fl.head == 0)
-	// phase 3: prepend new nodes
-	flPush(fl, freed, reuse)
-	// done
-	flnSetTotal(fl.get(fl.head), uint64(total+uint64(len(freed))))
+	return added, keep, rest
 }
 
-func flPush(fl *FreeList, freed []uint64, reuse []uint64) {
-	for len(freed) > 0 {
-		new := BNode{make([]byte, BTREE_PAGE_SIZE)}
-		// construct a new node
-		size := len(freed)
-		// 指针数量太多，一个node存不完
-		if size > FREE_LIST_CAP {
-			size = FREE_LIST_CAP
+// write the new head nodes holding the added pages of the version `ver`
+// and the kept items of the old head, in front of the `rest` nodes.
+func flPush(fl *FreeList, added []uint64, ver uint64, keep uint64, rest []flNode, reuse []uint64, nrest uint64) error {
+	type flItem struct{ ptr, ver uint64 }
+	items := make([]flItem, 0, len(added)+int(keep))
+	for _, ptr := range added {
+		items = append(items, flItem{ptr, ver})
+	}
+	if keep > 0 {
+		head, err := flGet(fl, fl.head)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < int(keep); i++ {
+			items = append(items, flItem{flnPtr(head, i), flnVer(head, i)})
 		}
-		flnSetHeader(new, uint16(size), fl.head)
-		for i, ptr := range freed[:size] {
-			flnSetPtr(new, i, ptr)
+	}
+	next := uint64(0)
+	if len(rest) > 0 {
+		next = rest[0].ptr
+	}
+	// construct the nodes from the last one
+	nodes := []flNode{}
+	for end := len(items); end > 0; {
+		begin := (end - 1) / FREE_LIST_CAP * FREE_LIST_CAP
+		new := BNode{make([]byte, BTREE_PAGE_SIZE)}
+		flnSetHeader(new, uint16(end-begin), next)
+		for i, item := range items[begin:end] {
+			flnSetItem(new, i, item.ptr, item.ver)
 		}
-		freed = freed[size:]
 		if len(reuse) > 0 {
 			// reuse a pointer from the list
-			fl.head, reuse = reuse[0], reuse[1:]
-			fl.use(fl.head, new)
+			next, reuse = reuse[0], reuse[1:]
+			if err := fl.use(next, new); err != nil {
+				return err
+			}
 		} else {
 			// or append a page to house the new node
-			fl.head = fl.new(new)
+			ptr, err := fl.new(new)
+			if err != nil {
+				return err
+			}
+			next = ptr
 		}
+		nodes = append([]flNode{{ptr: next, start: uint64(begin), size: end - begin}}, nodes...)
+		end = begin
 	}
 	// assert(len(reuse) == 0)
+	fl.head = next
+	head, err := flGet(fl, fl.head)
+	if err != nil {
+		return err
+	}
+	flnSetTotal(head, uint64(len(items))+nrest)
+	// the rest nodes are after the new nodes
+	for _, node := range rest {
+		node.start = node.start - keep + uint64(len(items))
+		nodes = append(nodes, node)
+	}
+	fl.nodes, fl.nodesHead = nodes, fl.head
+	return nil
 }
 
 func flnSize(node BNode) int {
@@ -122,42 +253,44 @@ func flnSize(node BNode) int {
 
 // 只有head节点才需要记录
 func flnSetTotal(node BNode, total uint64) {
-	binary.LittleEndian.PutUint64(node.data[4:12], total) // 将总数存储在节点数据的第4到第12字节
+	binary.LittleEndian.PutUint64(node.data[8:16], total) // 将总数存储在节点数据的第8到第16字节
 }
 
 func flnNext(node BNode) uint64 {
-	return binary.LittleEndian.Uint64(node.data[12:16]) // 从节点数据中获取下一个节点的指针
+	return binary.LittleEndian.Uint64(node.data[16:24]) // 从节点数据中获取下一个节点的指针
 }
 
 func flnPtr(node BNode, idx int) uint64 {
-	pos := FREE_LIST_HEADER + 8*idx                    // 计算指针在节点数据中的位置
+	pos := FREE_LIST_HEADER + 16*idx                   // 计算指针在节点数据中的位置
 	return binary.LittleEndian.Uint64(node.data[pos:]) // 返回该位置的指针
 }
 
+// the version that freed the page
+func flnVer(node BNode, idx int) uint64 {
+	pos := FREE_LIST_HEADER + 16*idx + 8
+	return binary.LittleEndian.Uint64(node.data[pos:])
+}
+
 func flnSetHeader(node BNode, size uint16, next uint64) {
-	binary.LittleEndian.PutUint16(node.data[2:4], size)   // 设置节点的大小
-	binary.LittleEndian.PutUint64(node.data[12:16], next) // 设置下一个节点的指针
+	binary.LittleEndian.PutUint16(node.data[0:2], BNODE_FREE_LIST) // 设置节点类型
+	binary.LittleEndian.PutUint16(node.data[2:4], size)            // 设置节点的大小
+	binary.LittleEndian.PutUint64(node.data[16:24], next)          // 设置下一个节点的指针
 }
 
-func flnSetPtr(node BNode, idx int, ptr uint64) {
-	pos := FREE_LIST_HEADER + 8*idx                     // 计算指针在节点数据中的位置
+func flnSetItem(node BNode, idx int, ptr uint64, ver uint64) {
+	pos := FREE_LIST_HEADER + 16*idx                    // 计算条目在节点数据中的位置
 	binary.LittleEndian.PutUint64(node.data[pos:], ptr) // 设置该位置的指针
+	binary.LittleEndian.PutUint64(node.data[pos+8:], ver)
 }
 
-func (fl *FreeList) Total() uint64 {
-	total := uint64(0)      // 初始化总页面数量
-	head := fl.get(fl.head) // 获取当前头节点
-
-	listNodesTotal := binary.LittleEndian.Uint64(head.data[4:12])
-
-	node := head
-	// 遍历所有节点，累加每个节点的指针数量
-	for i := 0; i < int(listNodesTotal); i++ {
-		total += uint64(flnSize(node))
-		next := flnNext(node)
-		// assert(next != 0)
-		node = fl.get(next)
+// the total is only kept in the head node, see flnSetTotal.
+func (fl *FreeList) Total() (uint64, error) {
+	if fl.head == 0 {
+		return 0, nil // 空列表，还没有任何页面被释放
 	}
-
-	return total // 返回总页面数量
+	head, err := flGet(fl, fl.head) // 获取当前头节点
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint64(head.data[8:16]), nil
 }
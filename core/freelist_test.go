@@ -0,0 +1,207 @@
+package core
+
+import (
+	mrand "math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type L struct {
+	t     *testing.T
+	free  FreeList
+	pages map[uint64]BNode
+	next  uint64 // the next page to append
+}
+
+func newL(t *testing.T) *L {
+	l := &L{t: t, pages: map[uint64]BNode{}, next: 1}
+	l.free = FreeList{
+		get: func(ptr uint64) (BNode, error) {
+			node, ok := l.pages[ptr]
+			if !ok {
+				return BNode{}, ErrBadPointer
+			}
+			return node, nil
+		},
+		new: func(node BNode) (uint64, error) {
+			ptr := l.next
+			l.next++
+			l.pages[ptr] = node
+			return ptr, nil
+		},
+		use: func(ptr uint64, node BNode) error {
+			l.pages[ptr] = node
+			return nil
+		},
+	}
+	return l
+}
+
+// the items from the head and the pages of the list nodes.
+func (l *L) items() (ptrs []uint64, vers []uint64, nodes []uint64) {
+	total, err := l.free.Total()
+	assert.Nil(l.t, err)
+	for ptr := l.free.head; uint64(len(ptrs)) < total; {
+		nodes = append(nodes, ptr)
+		node := l.pages[ptr]
+		for i := 0; i < flnSize(node) && uint64(len(ptrs)) < total; i++ {
+			ptrs = append(ptrs, flnPtr(node, i))
+			vers = append(vers, flnVer(node, i))
+		}
+		ptr = flnNext(node)
+	}
+	return ptrs, vers, nodes
+}
+
+// allocate pages like KV.pageNew(), the oldest free pages first.
+func (l *L) alloc(n int) (popn int, ptrs []uint64) {
+	total, err := l.free.Total()
+	assert.Nil(l.t, err)
+	for i := 0; i < n; i++ {
+		if uint64(popn) < total {
+			ptr, ok, err := l.free.Get(popn)
+			assert.Nil(l.t, err)
+			if ok {
+				popn++
+				ptrs = append(ptrs, ptr)
+				continue
+			}
+		}
+		ptrs = append(ptrs, l.next)
+		l.next++
+	}
+	return popn, ptrs
+}
+
+func TestFreeListVersions(t *testing.T) {
+	l := newL(t)
+	// version 1 frees 1000 pages
+	freed := []uint64{}
+	for i := 0; i < 1000; i++ {
+		freed = append(freed, l.next)
+		l.next++
+	}
+	assert.Nil(t, l.free.Update(0, freed, 1))
+	ptrs, vers, nodes := l.items()
+	assert.Equal(t, 1000, len(ptrs))
+	assert.Equal(t, (1000+FREE_LIST_CAP-1)/FREE_LIST_CAP, len(nodes))
+	for _, ver := range vers {
+		assert.Equal(t, uint64(1), ver)
+	}
+
+	// not reusable by a reader of version 0
+	l.free.maxVer = 0
+	_, ok, err := l.free.Get(0)
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	// version 2 reuses 600 pages of version 1 and frees 10 of them
+	l.free.maxVer = 1
+	popn, used := l.alloc(600)
+	assert.Equal(t, 600, popn)
+	assert.Equal(t, freed[1000-600:], reverse(used)) // the oldest first
+	assert.Nil(t, l.free.Update(popn, used[:10], 2))
+	ptrs, vers, _ = l.items()
+	// the new items, then the rest of the old ones
+	for i := 1; i < len(vers); i++ {
+		assert.True(t, vers[i-1] >= vers[i])
+	}
+	assert.Equal(t, uint64(2), vers[0])
+	assert.Equal(t, uint64(1), vers[len(vers)-1])
+	assert.Contains(t, ptrs, used[0])
+	assert.NotContains(t, ptrs, used[10])
+
+	// the items of version 2 are not reused before a reader of version 1 is done
+	_, all := l.alloc(len(ptrs))
+	for _, ptr := range all {
+		i := indexOf(ptrs, ptr)
+		assert.True(t, i < 0 || vers[i] <= 1)
+	}
+}
+
+func reverse(s []uint64) []uint64 {
+	r := []uint64{}
+	for i := len(s) - 1; i >= 0; i-- {
+		r = append(r, s[i])
+	}
+	return r
+}
+
+func indexOf(s []uint64, v uint64) int {
+	for i := range s {
+		if s[i] == v {
+			return i
+		}
+	}
+	return -1
+}
+
+// every page is either used, a free page in the list or a list node.
+func TestFreeListRandom(t *testing.T) {
+	l := newL(t)
+	r := mrand.New(mrand.NewSource(6))
+	used := map[uint64]bool{}
+	for ver := uint64(1); ver <= 300; ver++ {
+		l.free.maxVer = ver - 1 - uint64(r.Intn(3)) // the oldest reader
+		if ver < 4 {
+			l.free.maxVer = 0
+		}
+		popn, ptrs := l.alloc(r.Intn(400))
+		freed := []uint64{}
+		for ptr := range used {
+			if r.Intn(2) == 0 {
+				freed = append(freed, ptr)
+				delete(used, ptr)
+			}
+		}
+		for _, ptr := range ptrs {
+			assert.False(t, used[ptr])
+			used[ptr] = true
+		}
+		assert.Nil(t, l.free.Update(popn, freed, ver))
+
+		items, vers, nodes := l.items()
+		all := map[uint64]bool{}
+		for _, list := range [][]uint64{items, nodes} {
+			for _, ptr := range list {
+				assert.False(t, all[ptr] || used[ptr], ptr)
+				all[ptr] = true
+			}
+		}
+		assert.Equal(t, int(l.next-1), len(all)+len(used))
+		for i := 1; i < len(vers); i++ {
+			assert.True(t, vers[i-1] >= vers[i])
+		}
+		if t.Failed() {
+			break
+		}
+	}
+	// the file doesn't grow forever
+	assert.True(t, l.next < 3000, l.next)
+}
+
+// taking the items for the new nodes can make a node unnecessary,
+// the extra item stays in the list.
+func TestFreeListNodeBoundary(t *testing.T) {
+	for nfreed := FREE_LIST_CAP - 120; nfreed < FREE_LIST_CAP-100; nfreed++ {
+		l := newL(t)
+		freed := []uint64{}
+		for i := 0; i < 246; i++ {
+			freed = append(freed, l.next)
+			l.next++
+		}
+		assert.Nil(t, l.free.Update(0, freed, 1))
+		l.free.maxVer = 1
+		popn, used := l.alloc(140)
+		freed = []uint64{}
+		for i := 0; i < nfreed; i++ {
+			freed = append(freed, l.next)
+			l.next++
+		}
+		assert.Nil(t, l.free.Update(popn, freed, 2))
+
+		items, _, nodes := l.items()
+		assert.Equal(t, int(l.next-1), len(items)+len(nodes)+len(used), nfreed)
+	}
+}
@@ -0,0 +1,91 @@
+package core
+
+import "sync"
+
+// With Options.GroupCommit, the concurrent updates are queued. the first one
+// in the queue is the leader, it applies the queued updates to the tree in order
+// and commits them with a single writePages() and syncPages(), then the callers
+// return together. the updates arriving meanwhile form the next group.
+// the invalid updates are rejected before they join a group, so they don't fail
+// the others, but a failed commit fails the whole group.
+type commitGroup struct {
+	mu      sync.Mutex
+	pending []*commitReq
+}
+
+type commitReq struct {
+	apply func(rec *walRecord) (bool, error) // update the tree, returns whether it's changed
+	done  chan error
+}
+
+// run an update holding the writer lock, alone or in a group.
+// `check` validates the update before anything is changed.
+// `apply` updates the tree and logs the updates to `rec` for the WAL mode.
+func (db *KV) update(check func() error, apply func(rec *walRecord) (bool, error)) (err error) {
+	if err := check(); err != nil {
+		return err
+	}
+	if db.opts.GroupCommit {
+		return groupUpdate(db, &commitReq{apply: apply, done: make(chan error, 1)})
+	}
+	db.writer.Lock()
+	defer db.writer.Unlock()
+	if !db.opened {
+		return ErrClosed
+	}
+	meta := saveMeta(db)
+	defer revertOnError(db, meta, &err)
+	rec := newWalRecord(db)
+	changed, err := apply(rec)
+	if err != nil || !changed {
+		return err
+	}
+	return commitPages(db, rec)
+}
+
+func groupUpdate(db *KV, req *commitReq) error {
+	g := &db.group
+	g.mu.Lock()
+	g.pending = append(g.pending, req)
+	leader := len(g.pending) == 1
+	g.mu.Unlock()
+	if leader {
+		// the previous group is being committed, the followers join meanwhile
+		db.writer.Lock()
+		g.mu.Lock()
+		reqs := g.pending
+		g.pending = nil
+		g.mu.Unlock()
+		groupCommit(db, reqs)
+		db.writer.Unlock()
+	}
+	return <-req.done
+}
+
+// apply the updates in order and commit them together, they are a single record in the log.
+func groupCommit(db *KV, reqs []*commitReq) {
+	if !db.opened {
+		for _, req := range reqs {
+			req.done <- ErrClosed
+		}
+		return
+	}
+	meta, rec := saveMeta(db), newWalRecord(db)
+	changed, err := false, error(nil)
+	for _, req := range reqs {
+		var ok bool
+		if ok, err = req.apply(rec); err != nil {
+			break
+		}
+		changed = changed || ok
+	}
+	if err == nil && changed {
+		err = commitPages(db, rec)
+	}
+	if err != nil {
+		rollback(db, meta)
+	}
+	for _, req := range reqs {
+		req.done <- err
+	}
+}
@@ -0,0 +1,193 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// run `fn(i)` for i in [0, n) concurrently.
+func runConcurrently(n int, fn func(i int)) {
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			fn(i)
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestGroupCommit(t *testing.T) {
+	fs := &syncCountFS{delay: 5 * time.Millisecond}
+	db := &KV{Path: filepath.Join(t.TempDir(), "test.db"), FS: fs}
+	assert.Nil(t, db.OpenWith(Options{GroupCommit: true}))
+	fs.syncs.Store(0)
+
+	const N = 100
+	runConcurrently(N, func(i int) {
+		key := []byte(fmt.Sprintf("k%03d", i))
+		switch i % 3 {
+		case 0:
+			assert.Nil(t, db.Set(key, []byte("v")))
+		case 1:
+			b := &WriteBatch{}
+			b.Set(key, []byte("v"))
+			b.Set(append(key, 'x'), []byte("v"))
+			assert.Nil(t, db.Batch(b))
+		case 2:
+			assert.Nil(t, db.Set(key, []byte("v")))
+			deleted, err := db.Del(key)
+			assert.Nil(t, err)
+			assert.True(t, deleted)
+		}
+	})
+	// 2 fsyncs per commit without grouping
+	assert.Less(t, fs.syncs.Load(), int64(2*N))
+
+	for i := 0; i < N; i++ {
+		key := []byte(fmt.Sprintf("k%03d", i))
+		_, ok, err := db.Get(key)
+		assert.Nil(t, err)
+		assert.Equal(t, i%3 != 2, ok, string(key))
+	}
+	count, err := db.Count(nil, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(N/3+1+2*(N/3)), count)
+	report, err := db.Check()
+	assert.Nil(t, err, report.String())
+
+	// no update
+	deleted, err := db.Del([]byte("none"))
+	assert.Nil(t, err)
+	assert.False(t, deleted)
+	n, err := db.DeleteRange([]byte("x"), nil)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), n)
+	db.Close()
+
+	assert.Nil(t, db.Open())
+	defer db.Close()
+	count, err = db.Count(nil, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(N/3+1+2*(N/3)), count)
+}
+
+// an invalid update is rejected alone.
+func TestGroupCommitInvalid(t *testing.T) {
+	db := &KV{Path: filepath.Join(t.TempDir(), "test.db")}
+	assert.Nil(t, db.OpenWith(Options{GroupCommit: true}))
+	defer db.Close()
+	runConcurrently(50, func(i int) {
+		key := []byte(fmt.Sprintf("k%03d", i))
+		if i%5 == 0 {
+			err := db.Set(make([]byte, BTREE_MAX_KEY_SIZE+1), []byte("v"))
+			assert.NotNil(t, err)
+			b := &WriteBatch{}
+			b.Set(key, []byte("v"))
+			b.Del(nil)
+			assert.NotNil(t, db.Batch(b))
+			return
+		}
+		assert.Nil(t, db.Set(key, []byte("v")))
+	})
+	count, err := db.Count(nil, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(40), count)
+}
+
+// an update returns after it's durable, a failed commit fails the whole group.
+func TestGroupCommitCrash(t *testing.T) {
+	for seed := int64(0); seed < 10; seed++ {
+		fs := &FaultFS{Rand: rand.New(rand.NewSource(seed)), CrashRate: 0.02}
+		db := &KV{Path: filepath.Join(t.TempDir(), "test.db"), FS: fs}
+		assert.Nil(t, db.OpenWith(Options{GroupCommit: true}))
+
+		var mu sync.Mutex
+		acked := map[string]bool{}
+		runConcurrently(200, func(i int) {
+			key := fmt.Sprintf("k%03d", i)
+			err := db.Set([]byte(key), []byte("v"))
+			if err != nil {
+				assert.True(t, errors.Is(err, ErrInjected) || errors.Is(err, ErrNeedReopen), err)
+				return
+			}
+			mu.Lock()
+			acked[key] = true
+			mu.Unlock()
+		})
+		db.Close()
+		assert.Nil(t, fs.Crash())
+
+		assert.Nil(t, db.Open())
+		for key := range acked {
+			_, ok, err := db.Get([]byte(key))
+			assert.Nil(t, err)
+			assert.True(t, ok, "seed %d: %s", seed, key)
+		}
+		report, err := db.Check()
+		assert.Nil(t, err, report.String())
+		db.Close()
+	}
+}
+
+// the updates of a group that failed report no result.
+func TestGroupCommitFailedResults(t *testing.T) {
+	db := &KV{Path: filepath.Join(t.TempDir(), "test.db")}
+	assert.Nil(t, db.OpenWith(Options{GroupCommit: true}))
+	defer db.Close()
+	b := &WriteBatch{}
+	for i := 0; i < 300; i++ {
+		b.Set([]byte(fmt.Sprintf("k%03d", i)), []byte(strings.Repeat("v", 100)))
+	}
+	assert.Nil(t, db.Batch(b))
+	// the last leaf fails the 2nd update
+	ptr := db.tree.root
+	for {
+		node, err := db.tree.get(ptr)
+		assert.Nil(t, err)
+		if node.btype() == BNODE_LEAF {
+			break
+		}
+		ptr = node.getPtr(node.nkeys() - 1)
+	}
+	corruptPage(t, db, ptr)
+
+	// queue both updates behind the writer lock, so they form a group in order
+	pending := func() int {
+		db.group.mu.Lock()
+		defer db.group.mu.Unlock()
+		return len(db.group.pending)
+	}
+	db.writer.Lock()
+	first := &UpdateReq{Key: []byte("k000"), Val: []byte("new")}
+	second := &UpdateReq{Key: []byte("k299"), Val: []byte("new")}
+	errs := make(chan error, 2)
+	go func() { errs <- db.Update(first) }()
+	for pending() < 1 {
+		time.Sleep(time.Millisecond)
+	}
+	go func() { errs <- db.Update(second) }()
+	for pending() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	db.writer.Unlock()
+	for i := 0; i < 2; i++ {
+		assert.True(t, errors.As(<-errs, &ErrCorruptPage{}))
+	}
+
+	assert.False(t, first.Added || first.Updated)
+	assert.Nil(t, first.Old)
+	assert.False(t, second.Added || second.Updated)
+	val, _, err := db.Get([]byte("k000"))
+	assert.Nil(t, err)
+	assert.Equal(t, strings.Repeat("v", 100), string(val))
+}
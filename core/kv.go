@@ -5,24 +5,47 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
-	"os"
-	"syscall"
+	"hash/crc32"
+	"sort"
+	"sync"
+	"time"
 )
 
-const DB_SIG = "BuildYourOwnDB05"
+// 06: every page except the master page carries a CRC32C checksum.
+// 07: leaf nodes and internal nodes use different formats.
+// 08: nodes can store a shared key prefix.
+// 09: internal nodes store the subtree counts.
+// 10: the free list items carry the version that freed the page.
+// 11: the master page has 2 slots with a checksum.
+// 12: the subtree counts have the COUNT_NO_OVERFLOW flag.
+// the older versions are upgraded on open, see legacy.go.
+const DB_SIG = "BuildYourOwnDB12"
 
 type KV struct {
 	Path string
+	// the order of the keys, it's persisted in the file and can't be changed later.
+	// nil is the order of an existing file if it's a built-in one, or CmpBinary.
+	Comparator *Comparator
+	// the file operations, nil is the OS files. see FaultFS for testing.
+	FS FS
+	// how the pages are stored, nil is NewMmapPager().
+	Pager Pager
 	// internals
-	fp   *os.File
-	tree BTree
-	free FreeList
-	mmap struct {
-		file   int      // file size, can be larger than the database size
-		total  int      // mmap size, can be larger than the file size
-		chunks [][]byte // multiple mmaps, can be non-continuous
-	}
-	page struct {
+	pager  Pager
+	tree   BTree
+	free   FreeList
+	ver    uint64 // the version of the last update, increased by each update
+	master int    // the master page slot of the last update, see masterStore()
+	failed error  // ErrNeedReopen, the updates fail until the next Open()
+	size   int    // file size, can be larger than the database size
+	opts   Options
+	// the version in the master page, it's behind `ver` with SYNC_INTERVAL.
+	durable uint64
+	synced  time.Time   // the last masterWrite()
+	timer   *time.Timer // the pending masterWrite() of SYNC_INTERVAL
+	group   commitGroup // Options.GroupCommit
+	wal     *kvWAL      // Options.WAL, see wal.go
+	page    struct {
 		// temp    [][]byte // todo:这个需要被删除吗？page.temp 可以被视为一种过渡性的机制，用于在没有 FreeList 的情况下追踪临时页面或新分配的页面
 		flushed uint64 // database size in number of pages
 		nfree   int    // number of pages taken from the free list
@@ -32,38 +55,73 @@ type KV struct {
 		// updates 变量用于跟踪新分配或已释放的页面。它在写入页面时记录需要更新的页面，并在 writePages 函数中进行处理
 		updates map[uint64][]byte
 	}
+	// a single writer and many readers, see KVReader.
+	// the updates and KVTX hold `writer`, the fields below are protected by `mu`.
+	writer  sync.Mutex
+	mu      sync.Mutex
+	opened  bool           // from Open() to Close(), see ErrClosed
+	version kvVersion      // the last committed version
+	readers map[uint64]int // the number of open KVReader for each version
+}
+
+// what a reader needs to read a committed version without the writer's states.
+type kvVersion struct {
+	ver     uint64
+	root    uint64
+	flushed uint64
+	pages   *walPages // the unwritten pages of the WAL mode
 }
 
 func (db *KV) Open() error {
+	return db.OpenWith(Options{})
+}
+
+// like Open(), with the options.
+func (db *KV) OpenWith(opts Options) error {
+	if db.Comparator != nil && !db.Comparator.valid() {
+		return errors.New("KV.Open: bad comparator")
+	}
+	if err := opts.check(); err != nil {
+		return fmt.Errorf("KV.Open: %w", err)
+	}
+	db.opts = opts.normalize()
 	// open or create the DB file
-	fp, err := os.OpenFile(db.Path, os.O_RDWR|os.O_CREATE, 0644)
-	if err != nil {
-		return fmt.Errorf("OpenFile: %w", err)
+	fs := db.FS
+	if fs == nil {
+		fs = osFS{}
+	}
+	db.pager = db.Pager
+	if db.pager == nil {
+		db.pager = NewMmapPager()
 	}
-	db.fp = fp
-	// create the initial mmap
-	sz, chunk, err := mmapInit(db.fp)
+	size, err := db.pager.Open(fs, db.Path, db.opts)
 	if err != nil {
-		db.Close()
+		db.pager = nil
 		return fmt.Errorf("KV.Open: %w", err)
 	}
-	db.mmap.file = sz
-	db.mmap.total = len(chunk)
-	db.mmap.chunks = [][]byte{chunk}
+	db.size = size
+	db.failed = nil
+	if size%BTREE_PAGE_SIZE != 0 {
+		db.Close()
+		return errors.New("KV.Open: File size is not a multiple of page size.")
+	}
 	// btree callbacks
+	db.tree.cmp = db.Comparator
 	db.tree.get = db.pageGet
 	db.tree.new = db.pageNew
 	db.tree.del = db.pageDel
 
 	// Initialize the free list
-	db.free.get = db.pageGet // 设置获取页面的回调
-	db.free.new = db.pageNew // 设置新页面的回调
-	db.free.use = db.pageUse // 设置重用页面的回调
+	db.free = FreeList{
+		get: db.pageGet,    // 设置获取页面的回调
+		new: db.pageAppend, // 设置新页面的回调，free list 只能追加新页面，不能从自己身上分配
+		use: db.pageUse,    // 设置重用页面的回调
+	}
+	// 自由列表的头节点在第一次释放页面时由 FreeList.Update 创建，head 为 0 表示空列表
 
-	// 这里可以初始化自由列表的头节点
-	headNode := BNode{data: make([]byte, BTREE_PAGE_SIZE)} // 创建一个新的空节点
-	flnSetHeader(headNode, 0, 0)                           // 设置头节点的大小为0，指向下一个节点为0
-	db.free.head = db.free.new(headNode)                   // 将头节点添加到自由列表中
+	db.page.updates = map[uint64][]byte{}
+	db.page.nfree, db.page.nappend = 0, 0
+	db.readers = map[uint64]int{}
 
 	// read the master page
 	err = masterLoad(db)
@@ -71,196 +129,555 @@ func (db *KV) Open() error {
 		goto fail
 	}
 	// done
+	db.durable, db.synced = db.ver, time.Now()
+	publish(db)
+	// replay the log of the WAL mode
+	if err = walOpen(db, fs); err != nil {
+		goto fail
+	}
+	db.mu.Lock()
+	db.opened = true
+	db.mu.Unlock()
 	return nil
 
 fail:
+	db.failed = err // nothing is written by Close()
 	db.Close()
 	return fmt.Errorf("KV.Open: %w", err)
 }
 
-// cleanups
+// cleanups. the readers and the transactions must be finished before it.
 func (db *KV) Close() {
-	for _, chunk := range db.mmap.chunks {
-		err := syscall.Munmap(chunk)
-		if err != nil {
-			panic(fmt.Sprintf("db close failed,err %+v", err))
+	db.writer.Lock()
+	defer db.writer.Unlock()
+	if db.timer != nil {
+		db.timer.Stop()
+		db.timer = nil
+	}
+	if db.pager != nil && db.failed == nil && !db.opts.ReadOnly && db.durable != db.ver {
+		if db.wal != nil {
+			_ = checkpoint(db) // the logged updates
+		} else {
+			_ = masterWrite(db, true) // the pending updates of SYNC_INTERVAL
 		}
 	}
-	_ = db.fp.Close()
+	if db.wal != nil {
+		_ = db.wal.fp.Close()
+		db.wal = nil
+	}
+	db.mu.Lock()
+	db.opened = false // later reads fail with ErrClosed
+	db.version = kvVersion{}
+	db.mu.Unlock()
+	if db.pager != nil {
+		_ = db.pager.Close()
+		db.pager = nil
+	}
 }
 
-// read the db
-func (db *KV) Get(key []byte) ([]byte, bool) {
-	return db.tree.Get(key)
+// read the db. the read methods of KV use a short-lived KVReader.
+func (db *KV) Get(key []byte) (val []byte, ok bool, err error) {
+	r := db.BeginRead()
+	defer r.Close()
+	return r.Get(key)
 }
 
-func (db *KV) Set(key []byte, val []byte) error {
-	db.tree.Insert(key, val)
-	return flushPages(db)
+// iterate over the keys in the half-open range [start, end) in the key order.
+// a nil `end` means no upper bound. the scan stops when `fn` returns false.
+// the slices passed to `fn` are only valid during the call.
+func (db *KV) Scan(start, end []byte, fn func(key, val []byte) bool) error {
+	return db.ScanRange(start, end, ScanOptions{}, fn)
 }
 
-func (db *KV) Del(key []byte) (bool, error) {
-	deleted := db.tree.Delete(key)
-	return deleted, flushPages(db)
+// options for KV.ScanRange()
+type ScanOptions struct {
+	Desc  bool // iterate from the end of the range down to the start
+	Limit int  // the maximum number of pairs to visit, 0 means no limit
 }
 
-// persist the newly allocated pages after updates
-func flushPages(db *KV) error {
-	if err := writePages(db); err != nil {
-		return err
+// like Scan(), but can iterate in descending order and stop after `Limit` pairs.
+// the range is always [start, end) regardless of the direction.
+func (db *KV) ScanRange(start, end []byte, opts ScanOptions, fn func(key, val []byte) bool) error {
+	r := db.BeginRead()
+	defer r.Close()
+	return r.ScanRange(start, end, opts, fn)
+}
+
+func treeScan(tree *BTree, start, end []byte, opts ScanOptions, fn func(key, val []byte) bool) error {
+	var iter *BIter
+	switch {
+	case !opts.Desc:
+		iter = tree.Seek(start, CMP_GE)
+	case end != nil:
+		iter = tree.Seek(end, CMP_LT)
+	default:
+		iter = tree.SeekLast()
 	}
-	return syncPages(db)
+	for n := 0; iter.Valid(); n++ {
+		if opts.Limit > 0 && n >= opts.Limit {
+			break
+		}
+		key := iter.Key()
+		if !opts.Desc && end != nil && tree.cmp.compare(key, end) >= 0 {
+			break
+		}
+		if opts.Desc && tree.cmp.compare(key, start) < 0 {
+			break
+		}
+		val := iter.Value()
+		if iter.Err() != nil || !fn(key, val) {
+			break
+		}
+		if opts.Desc {
+			iter.Prev()
+		} else {
+			iter.Next()
+		}
+	}
+	return iter.Err()
+}
+
+// position an iterator on the closest key to `key` with respect to `cmp`,
+// which is one of CMP_GE, CMP_GT, CMP_LT and CMP_LE.
+// the iterator reads the last committed version with its own KVReader, so it
+// MUST be closed by BIter.Close(), usually `defer iter.Close()`. until then, the pages
+// freed by the later updates are not reused and the file keeps growing, like with
+// an open KVReader. KVReader.Seek() doesn't need it, the iterator is the reader's.
+func (db *KV) Seek(key []byte, cmp int) *BIter {
+	r := db.BeginRead()
+	iter := r.Seek(key, cmp)
+	iter.reader = r
+	return iter
+}
+
+// the number of keys less than the key.
+func (db *KV) Rank(key []byte) (uint64, error) {
+	r := db.BeginRead()
+	defer r.Close()
+	return r.Rank(key)
+}
+
+// the number of keys in the half-open range [start, end), a nil `end` means no upper bound.
+// it only reads the nodes on the paths to `start` and `end`.
+func (db *KV) Count(start, end []byte) (uint64, error) {
+	r := db.BeginRead()
+	defer r.Close()
+	return r.Count(start, end)
+}
+
+// position an iterator at the i-th key (0-based) in order.
+// like Seek(), the iterator MUST be closed by BIter.Close().
+func (db *KV) Select(i uint64) *BIter {
+	r := db.BeginRead()
+	iter := r.Select(i)
+	iter.reader = r
+	return iter
+}
+
+func (db *KV) Set(key []byte, val []byte) error {
+	return db.Update(&UpdateReq{Key: key, Val: val})
+}
+
+// insert or update a key according to the mode of the request, see UpdateReq.
+// nothing is written if the key is not updated.
+// the results in `req` are cleared if it fails, even if the tree was updated.
+func (db *KV) Update(req *UpdateReq) error {
+	err := db.update(req.check, func(rec *walRecord) (bool, error) {
+		if err := db.tree.Update(req); err != nil || !req.Updated {
+			return false, err
+		}
+		rec.set(req.Key, req.Val)
+		return true, nil
+	})
+	if err != nil {
+		// the update is rolled back, also when another update of its group failed
+		req.Added, req.Updated, req.Old = false, false, nil
+	}
+	return err
+}
+
+func (db *KV) Del(key []byte) (deleted bool, err error) {
+	err = db.update(func() error { return checkKey(key) }, func(rec *walRecord) (bool, error) {
+		if deleted, err = db.tree.Delete(key); err != nil || !deleted {
+			return false, err
+		}
+		rec.del(key)
+		return true, nil
+	})
+	return deleted && err == nil, err
 }
 
-// create the initial mmap that covers the whole file.
-func mmapInit(fp *os.File) (int, []byte, error) {
-	fi, err := fp.Stat()
+// delete the keys in the half-open range [start, end), a nil `end` means no upper bound.
+// all of them are deleted by a single update, see BTree.DeleteRange().
+func (db *KV) DeleteRange(start, end []byte) (deleted uint64, err error) {
+	err = db.update(func() error { return nil }, func(rec *walRecord) (bool, error) {
+		if deleted, err = db.tree.DeleteRange(start, end); err != nil || deleted == 0 {
+			return false, err
+		}
+		rec.delRange(start, end)
+		return true, nil
+	})
 	if err != nil {
-		return 0, nil, fmt.Errorf("stat: %w", err)
+		return 0, err
 	}
-	if fi.Size()%BTREE_PAGE_SIZE != 0 {
-		return 0, nil, errors.New("File size is not a multiple of page size.")
+	return deleted, nil
+}
+
+// the source of KV.BulkLoad(), the keys must be in ascending order.
+// a BIter positioned by Seek() is one.
+type SortedIter interface {
+	Valid() bool
+	Key() []byte
+	Value() []byte
+	Next()
+	Err() error
+}
+
+// options for KV.BulkLoadWith()
+type BulkOptions struct {
+	Fill float64 // the fill factor of the nodes, 0 means BULK_FILL_DEFAULT
+}
+
+// the number of pending pages written to the file at a time during a bulk load.
+const BULK_BATCH_PAGES = 1024
+
+// load KV pairs sorted in the key order into an empty KV.
+func (db *KV) BulkLoad(iter SortedIter) error {
+	return db.BulkLoadWith(iter, BulkOptions{})
+}
+
+// like BulkLoad(), with a custom fill factor.
+// the tree is built bottom-up in appended pages, which are written to the file
+// in batches, then the new root is published by a single master page update.
+func (db *KV) BulkLoadWith(iter SortedIter, opts BulkOptions) (err error) {
+	db.writer.Lock()
+	defer db.writer.Unlock()
+	if !db.opened {
+		return ErrClosed
 	}
-	mmapSize := 64 << 20
-	for mmapSize < int(fi.Size()) {
-		mmapSize *= 2
+	if db.wal != nil {
+		// the pages are written directly, the log starts over after them
+		if err := checkpoint(db); err != nil {
+			return err
+		}
+		defer func() {
+			if err == nil {
+				err = walReset(db)
+			}
+		}()
 	}
+	meta := saveMeta(db)
+	defer revertOnError(db, meta, &err)
 
-	chunk, err := syscall.Mmap(
-		int(fp.Fd()),                         // 文件描述符
-		0,                                    // 偏移量
-		mmapSize,                             // 映射大小
-		syscall.PROT_READ|syscall.PROT_WRITE, // 读写权限
-		syscall.MAP_SHARED,                   // 共享映射
-	)
+	if first := db.tree.Seek(nil, CMP_GT); first.Valid() {
+		return errors.New("bulk load into a non-empty KV")
+	} else if first.Err() != nil {
+		return first.Err()
+	}
+	if opts.Fill == 0 {
+		opts.Fill = BULK_FILL_DEFAULT
+	}
+	// pages are only appended, so they are written sequentially
+	tree := BTree{cmp: db.tree.cmp, get: db.pageGet, new: db.pageAppend, del: db.pageDel}
+	builder, err := newTreeBuilder(&tree, opts.Fill)
 	if err != nil {
-		return 0, nil, fmt.Errorf("mmap: %w", err)
+		return err
+	}
+	for ; iter.Valid(); iter.Next() {
+		if err := bulkAdd(db, builder, iter.Key(), iter.Value()); err != nil {
+			return err
+		}
 	}
-	return int(fi.Size()), chunk, nil
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	if err := builder.finish(); err != nil {
+		return err
+	}
+	if db.tree.root != 0 {
+		// the old root only has the dummy key
+		if err := db.tree.del(db.tree.root); err != nil {
+			return err
+		}
+	}
+	db.tree.root = tree.root
+	return flushPages(db)
 }
 
-// extend the mmap by adding new mappings.
-func extendMmap(db *KV, npages int) error {
-	// 如果当前总映射空间已经足够，直接返回
-	if db.mmap.total >= npages*BTREE_PAGE_SIZE {
-		return nil
+// add a KV to the tree builder, the pending pages are written in batches.
+func bulkAdd(db *KV, builder *treeBuilder, key []byte, val []byte) error {
+	if err := builder.add(key, val); err != nil {
+		return err
 	}
+	if len(db.page.updates) >= BULK_BATCH_PAGES {
+		return writePagesEarly(db)
+	}
+	return nil
+}
 
-	chunk, err := syscall.Mmap(
-		int(db.fp.Fd()),                      // 文件描述符
-		int64(db.mmap.total),                 // offset：从文件的哪个位置开始映射
-		db.mmap.total,                        // length: 要映射的长度
-		syscall.PROT_READ|syscall.PROT_WRITE, // 读写权限
-		syscall.MAP_SHARED,                   // 共享映射
-	)
-	if err != nil {
-		return fmt.Errorf("mmap: %w", err)
+// commit the updates, the pages are written, or the updates are logged in the WAL mode.
+func commitPages(db *KV, rec *walRecord) error {
+	if db.wal != nil {
+		return walCommit(db, rec)
 	}
+	return flushPages(db)
+}
 
-	// 更新数据库的内存映射信息
+// persist the newly allocated pages after updates
+func flushPages(db *KV) error {
+	if err := writePages(db); err != nil {
+		return err
+	}
+	return syncPages(db)
+}
 
-	db.mmap.total += db.mmap.total                 // 总大小翻倍
-	db.mmap.chunks = append(db.mmap.chunks, chunk) // 保存新的映射块
-	return nil
+// the in-memory copy of the master page.
+type kvMeta struct {
+	ver     uint64
+	root    uint64
+	flushed uint64
+	free    uint64
+	nfree   int // taken from the free list by the logged updates, see walPublish()
+}
+
+func saveMeta(db *KV) kvMeta {
+	return kvMeta{ver: db.ver, root: db.tree.root, flushed: db.page.flushed, free: db.free.head, nfree: db.page.nfree}
+}
+
+func loadMeta(db *KV, meta kvMeta) {
+	db.ver = meta.ver
+	db.tree.root = meta.root
+	db.page.flushed = meta.flushed
+	db.free.head = meta.free
+}
+
+// a failed update leaves the in-memory states half modified,
+// restore them to the last successful update and discard the pending pages.
+// the pages that were already copied to the file are not reachable
+// from the master page, so they are harmless.
+func revertOnError(db *KV, meta kvMeta, err *error) {
+	if *err == nil {
+		return
+	}
+	rollback(db, meta)
+}
+
+// discard the pending pages and restore the states saved by saveMeta().
+func rollback(db *KV, meta kvMeta) {
+	loadMeta(db, meta)
+	db.page.nfree = meta.nfree
+	db.page.nappend = 0
+	db.page.updates = map[uint64][]byte{}
 }
 
 // callback for BTree, dereference a pointer.
-func (db *KV) pageGet(ptr uint64) BNode {
+func (db *KV) pageGet(ptr uint64) (BNode, error) {
 	if page, ok := db.page.updates[ptr]; ok {
-		// assert(page != nil)
-		return BNode{page} // for new pages
-	}
-	return pageGetMapped(db, ptr) // for written pages
-}
-
-/*
-让我用一个具体的例子来解释：
-
-假设：
-- BTREE_PAGE_SIZE = 4096（每页4KB）
-- 有两个内存映射块(chunks)：
-  - chunk[0]: 16KB (可以存4页)
-  - chunk[1]: 16KB (可以存4页)
-
-那么：
-
-chunk[0]对应的页���编号：0,1,2,3
-chunk[1]对应的页面编号：4,5,6,7
-
-当要获取第6页（ptr=6）时：
-1. 第一次循环：
-  - start = 0
-  - end = 4（16KB/4KB = 4页）
-  - ptr(6) >= end(4)，继续下一个chunk
-
-2. 第二次循环：
-  - start = 4（上一个chunk的end）
-  - end = 8
-  - ptr(6) < end(8)，找到了目标chunk
-  - offset = 4096 * (6 - 4)
-  - = 4096 * 2
-  - = 8192
-
-所以`offset = BTREE_PAGE_SIZE * (ptr - start)`就是在计算：
-- 目标页面在当前chunk中是第几页(ptr - start)
-- 乘以页面大小，得到字节偏移量
-
-这样就能精确定位到目标页面在chunk中的具体位置。
-*/
-func pageGetMapped(db *KV, ptr uint64) BNode {
-	start := uint64(0)
-	for _, chunk := range db.mmap.chunks {
-		end := start + uint64(len(chunk))/BTREE_PAGE_SIZE
-		if ptr < end {
-			offset := BTREE_PAGE_SIZE * (ptr - start)
-			return BNode{chunk[offset : offset+BTREE_PAGE_SIZE]}
+		if page == nil {
+			return BNode{}, fmt.Errorf("%w: page %d is deallocated", ErrBadPointer, ptr)
+		}
+		return BNode{page}, nil // for new pages
+	}
+	if db.wal != nil {
+		if page, ok := db.wal.pages.get(ptr); ok {
+			return BNode{page}, nil // for the logged updates
 		}
-		start = end
 	}
-	panic("bad ptr")
+	if ptr == 0 || ptr >= db.page.flushed+uint64(db.page.nappend) {
+		return BNode{}, fmt.Errorf("%w: page %d", ErrBadPointer, ptr)
+	}
+	return pageGetWritten(db, ptr) // for written pages
+}
+
+// read a written page.
+func pageGetWritten(db *KV, ptr uint64) (BNode, error) {
+	return pagerGet(db.pager, ptr)
+}
+
+// read a page from the pager and verify the checksum.
+func pagerGet(pager Pager, ptr uint64) (BNode, error) {
+	page, err := pager.Read(ptr)
+	if err != nil {
+		return BNode{}, err
+	}
+	if !pageVerify(page) {
+		return BNode{}, ErrCorruptPage{Ptr: ptr}
+	}
+	return BNode{page}, nil
+}
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// the checksum is at [4:8] for both BNode and free list nodes,
+// it covers the whole page except the checksum itself.
+func pageChecksum(page []byte) uint32 {
+	sum := crc32.Update(0, crc32c, page[:4])
+	return crc32.Update(sum, crc32c, page[8:BTREE_PAGE_SIZE])
+}
+
+func pageSetChecksum(page []byte) {
+	binary.LittleEndian.PutUint32(page[4:8], pageChecksum(page))
+}
+
+func pageVerify(page []byte) bool {
+	return binary.LittleEndian.Uint32(page[4:8]) == pageChecksum(page)
 }
 
 // the master page format.
 // it contains the pointer to the root and other important bits.
-// | sig | btree_root | page_used |
-// | 16B | 8B         | 8B        |
+// the master page has 2 slots, the updates write them alternately, so a torn write
+// only breaks the new slot and the previous one is used. the valid slot with
+// the larger version is the current one.
+// | sig | btree_root | page_used | free_list | cmp_len | cmp_name | version | checksum |
+// | 16B | 8B         | 8B        | 8B        | 1B      | 64B      | 8B      | 4B       |
+// the checksum is the CRC32C of the bytes before it.
+// the files without the comparator name (cmp_len is 0) are in the byte order.
+// the files before "BuildYourOwnDB11" only use the 1st slot and have no checksum.
+// the slots of "BuildYourOwnDB11" are replaced by the current signature by the updates.
+const MASTER_SLOT_SIZE = 41 + COMPARATOR_MAX_NAME_SIZE + 8 + 4
+
+// the offset of a master slot in the file, they are in different halves of the page.
+func masterSlotPos(slot int) int64 {
+	return int64(slot) * BTREE_PAGE_SIZE / 2
+}
+
+type masterSlot struct {
+	sig     string
+	root    uint64
+	used    uint64
+	free    uint64
+	cmpName string
+	ver     uint64
+}
+
+// decode a master slot, returns false if it's not valid.
+func masterDecode(data []byte, slot int) (masterSlot, bool) {
+	m := masterSlot{
+		sig:     string(data[:16]),
+		root:    binary.LittleEndian.Uint64(data[16:]),
+		used:    binary.LittleEndian.Uint64(data[24:]),
+		free:    binary.LittleEndian.Uint64(data[32:]), // 读取 free_list 指针
+		cmpName: string(data[41:][:min(data[40], COMPARATOR_MAX_NAME_SIZE)]),
+		ver:     binary.LittleEndian.Uint64(data[41+COMPARATOR_MAX_NAME_SIZE:]),
+	}
+	if m.cmpName == "" {
+		m.cmpName = CmpBinary.Name
+	}
+	if m.sig == DB_SIG || m.sig == noFlagsSig {
+		sum := binary.LittleEndian.Uint32(data[MASTER_SLOT_SIZE-4:])
+		return m, sum == crc32.Checksum(data[:MASTER_SLOT_SIZE-4], crc32c)
+	}
+	if m.sig != singleMasterSig {
+		m.ver = 0 // not in the older formats
+	}
+	_, legacy := legacySigs[m.sig]
+	old := legacy || rebuildSigs[m.sig] || m.sig == singleMasterSig
+	return m, slot == 0 && old
+}
+
+// the 1st update of a new file crashed before the master page is durable:
+// the file is extended, but the 1st slot is empty or torn, the 2nd one is never written.
+func masterUnwritten(data []byte) bool {
+	if _, ok := masterDecode(data, 0); ok {
+		return false
+	}
+	if !bytes.Equal(data[masterSlotPos(1):][:MASTER_SLOT_SIZE], make([]byte, MASTER_SLOT_SIZE)) {
+		return false
+	}
+	// a torn write is a prefix of the new format followed by zeros
+	sig := data[:16]
+	n := bytes.IndexByte(sig, 0)
+	if n < 0 {
+		n = len(sig)
+	}
+	return string(sig[:n]) == DB_SIG[:n] && bytes.Equal(sig[n:], make([]byte, 16-n))
+}
+
 func masterLoad(db *KV) error {
-	if db.mmap.file == 0 {
+	data := []byte(nil)
+	if db.size > 0 {
+		var err error
+		if data, err = db.pager.Read(0); err != nil {
+			return err
+		}
+	}
+	if data == nil || masterUnwritten(data) {
 		// empty file, the master page will be created on the first write.
 		db.page.flushed = 1 // reserved for the master page
+		db.master = 1       // the 1st update writes the 1st slot
+		db.tree.root = 0
+		db.ver = 0
+		if db.tree.cmp == nil {
+			db.tree.cmp = CmpBinary
+		}
 		return nil
 	}
-	data := db.mmap.chunks[0]
-	root := binary.LittleEndian.Uint64(data[16:])
-	used := binary.LittleEndian.Uint64(data[24:])
-	freeListPtr := binary.LittleEndian.Uint64(data[32:]) // 读取 free_list 指针
-
-	// verify the page
-	if !bytes.Equal([]byte(DB_SIG), data[:16]) {
+	// pick the newest valid slot
+	m, found, sigs := masterSlot{}, false, 0
+	for slot := 0; slot < 2; slot++ {
+		s, ok := masterDecode(data[masterSlotPos(slot):], slot)
+		if s.sig == DB_SIG || s.sig == noFlagsSig || ok {
+			sigs++
+		}
+		if ok && (!found || s.ver > m.ver) {
+			m, found, db.master = s, true, slot
+		}
+	}
+	if sigs == 0 {
 		return errors.New("Bad signature.")
 	}
-	bad := !(1 <= used && used <= uint64(db.mmap.file/BTREE_PAGE_SIZE))
-	bad = bad || !(0 <= root && root < used)
+	if !found {
+		return errors.New("Bad master page: no valid slot.")
+	}
+
+	// verify the page
+	legacyHeader, legacy := legacySigs[m.sig]
+	rebuild := rebuildSigs[m.sig]
+	bad := !(1 <= m.used && m.used <= uint64(db.size/BTREE_PAGE_SIZE))
+	bad = bad || !(0 <= m.root && m.root < m.used)
+	bad = bad || !(0 <= m.free && m.free < m.used)
 	if bad {
 		return errors.New("Bad master page.")
 	}
-	db.tree.root = root
-	db.page.flushed = used
-	db.free.head = freeListPtr
+	if db.tree.cmp == nil {
+		db.tree.cmp = comparators[m.cmpName]
+	}
+	if db.tree.cmp == nil || db.tree.cmp.Name != m.cmpName {
+		return fmt.Errorf("%w: the file is in the %q order", ErrComparatorMismatch, m.cmpName)
+	}
+	db.tree.root = m.root
+	db.page.flushed = m.used
+	db.free.head = m.free
+	db.ver = m.ver
+	if (legacy || rebuild) && db.opts.ReadOnly {
+		return fmt.Errorf("%w: the file is in the %q format", ErrNeedUpgrade, m.sig)
+	}
+	if legacy {
+		// the file was created by an older version
+		return legacyUpgrade(db, legacyHeader)
+	}
+	if rebuild {
+		return rebuildUpgrade(db)
+	}
 	return nil
 }
 
 // update the master page. it must be atomic.
+// it writes the slot that isn't the current one.
 func masterStore(db *KV) error {
-	var data [40]byte
+	var data [MASTER_SLOT_SIZE]byte
 	copy(data[:16], []byte(DB_SIG))
 	binary.LittleEndian.PutUint64(data[16:], db.tree.root)
 	binary.LittleEndian.PutUint64(data[24:], db.page.flushed)
 	binary.LittleEndian.PutUint64(data[32:], db.free.head) // 写入 free_list 指针
-
-	// NOTE: Updating the page via mmap is not atomic.
-	// Use the `pwrite()` syscall instead.
-	_, err := db.fp.WriteAt(data[:], 0)
+	data[40] = byte(len(db.tree.cmp.Name))
+	copy(data[41:], db.tree.cmp.Name)
+	binary.LittleEndian.PutUint64(data[41+COMPARATOR_MAX_NAME_SIZE:], db.ver)
+	sum := crc32.Checksum(data[:MASTER_SLOT_SIZE-4], crc32c)
+	binary.LittleEndian.PutUint32(data[MASTER_SLOT_SIZE-4:], sum)
+
+	// NOTE: Updating the page via mmap is not atomic, see Pager.WriteMaster().
+	err := db.pager.WriteMaster(masterSlotPos(1-db.master), data[:])
 	if err != nil {
 		return fmt.Errorf("write master page: %w", err)
 	}
@@ -268,12 +685,22 @@ func masterStore(db *KV) error {
 }
 
 // callback for BTree, allocate a new page.
-func (db *KV) pageNew(node BNode) uint64 {
+func (db *KV) pageNew(node BNode) (uint64, error) {
 	// assert(len(node.data) <= BTREE_PAGE_SIZE)
 	ptr := uint64(0)
-	if uint64(db.page.nfree) < db.free.Total() {
-		// reuse a deallocated page
-		ptr = db.free.Get(db.page.nfree)
+	total, err := db.free.Total()
+	if err != nil {
+		return 0, err
+	}
+	reuse := false
+	if uint64(db.page.nfree) < total {
+		// the oldest deallocated page, if no reader needs it
+		db.free.maxVer = db.oldest()
+		if ptr, reuse, err = db.free.Get(db.page.nfree); err != nil {
+			return 0, err
+		}
+	}
+	if reuse {
 		db.page.nfree++
 	} else {
 		// append a new page
@@ -281,57 +708,64 @@ func (db *KV) pageNew(node BNode) uint64 {
 		db.page.nappend++
 	}
 	db.page.updates[ptr] = node.data
-	return ptr
+	return ptr, nil
 }
 
 // callback for BTree, deallocate a page.
-func (db *KV) pageDel(ptr uint64) {
+func (db *KV) pageDel(ptr uint64) error {
+	if ptr == 0 || ptr >= db.page.flushed+uint64(db.page.nappend) {
+		return fmt.Errorf("%w: page %d", ErrBadPointer, ptr)
+	}
 	db.page.updates[ptr] = nil
+	return nil
 }
 
 // callback for FreeList, allocate a new page.
-func (db *KV) pageAppend(node BNode) uint64 {
+func (db *KV) pageAppend(node BNode) (uint64, error) {
 	// assert(len(node.data) <= BTREE_PAGE_SIZE)
 	ptr := db.page.flushed + uint64(db.page.nappend)
 	db.page.nappend++
 	db.page.updates[ptr] = node.data
-	return ptr
+	return ptr, nil
 }
 
 // callback for FreeList, reuse a page.
-func (db *KV) pageUse(ptr uint64, node BNode) {
+func (db *KV) pageUse(ptr uint64, node BNode) error {
+	if ptr == 0 || ptr >= db.page.flushed+uint64(db.page.nappend) {
+		return fmt.Errorf("%w: page %d", ErrBadPointer, ptr)
+	}
 	db.page.updates[ptr] = node.data
+	return nil
 }
 
 // extend the file to at least `npages`.
 func extendFile(db *KV, npages int) error {
-	filePages := db.mmap.file / BTREE_PAGE_SIZE
+	filePages := db.size / BTREE_PAGE_SIZE
 	if filePages >= npages {
 		return nil
 	}
-	for filePages < npages {
-		// the file size is increased exponentially,
-		// so that we don't have to extend the file for every update.
-		inc := filePages / 8
-		if inc < 1 {
-			inc = 1
-		}
-		filePages += inc
-	}
+	filePages = max(db.opts.Grow(filePages, npages), npages)
 	fileSize := filePages * BTREE_PAGE_SIZE
 	// Fallocate 是 Linux 特有的系统调用
 	//err := syscall.Fallocate(int(db.fp.Fd()), 0, 0, int64(fileSize))
-	// ���展文件大小
-	err := db.fp.Truncate(int64(fileSize))
+	// 扩展文件大小，mmap 也随之扩展
+	err := db.pager.Truncate(fileSize)
 
 	if err != nil {
 		return fmt.Errorf("fallocate: %w", err)
 	}
-	db.mmap.file = fileSize
+	db.size = fileSize
 	return nil
 }
 
 func writePages(db *KV) error {
+	if db.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	// the pages of the unknown update may be overwritten
+	if db.failed != nil {
+		return db.failed
+	}
 	// update the free list
 	freed := []uint64{}
 	for ptr, page := range db.page.updates {
@@ -339,44 +773,150 @@ func writePages(db *KV) error {
 			freed = append(freed, ptr)
 		}
 	}
-	db.free.Update(db.page.nfree, freed)
-
-	// extend the file & mmap if needed
-	npages := int(db.page.flushed)
-	if err := extendFile(db, npages); err != nil {
+	db.free.maxVer = db.oldest()
+	if err := db.free.Update(db.page.nfree, freed, db.ver+1); err != nil {
 		return err
 	}
-	if err := extendMmap(db, npages); err != nil {
+
+	// extend the file if needed
+	npages := int(db.page.flushed) + db.page.nappend
+	if err := extendFile(db, npages); err != nil {
 		return err
 	}
 
-	// copy pages to the file
+	// copy pages to the file in ascending order,
+	// so that the appended pages are written sequentially
+	ptrs := make([]uint64, 0, len(db.page.updates))
 	for ptr, page := range db.page.updates {
 		if page != nil {
-			copy(pageGetMapped(db, ptr).data, page)
+			ptrs = append(ptrs, ptr)
+		}
+	}
+	sort.Slice(ptrs, func(i, j int) bool { return ptrs[i] < ptrs[j] })
+	for _, ptr := range ptrs {
+		page := db.page.updates[ptr]
+		pageSetChecksum(page)
+		if err := db.pager.Write(ptr, page); err != nil {
+			return fmt.Errorf("write page %d: %w", ptr, err)
 		}
 	}
 	return nil
 }
 
-func syncPages(db *KV) error {
-	// flush data to the disk. must be done before updating the master page.
-	if err := db.fp.Sync(); err != nil {
-		return fmt.Errorf("fsync: %w", err)
+// write the pending pages without publishing them, so that a long update
+// doesn't keep all of them in memory. the pages are not reachable from the
+// master page until syncPages(), the counters are kept for it.
+func writePagesEarly(db *KV) error {
+	if err := writePages(db); err != nil {
+		return err
 	}
+	db.page.updates = map[uint64][]byte{}
+	return nil
+}
 
-	// 更新已刷新的页面数量
-	db.page.flushed += uint64(len(db.page.updates)) // 更新已刷新的页面数量
-	db.page.updates = make(map[uint64][]byte)       // 清空更新的页面映射
+func syncPages(db *KV) error {
+	// 更新已刷新的页面数量，只有追加的页面才会增加文件中的页面数，复用的页面本来就在文件里
+	db.page.flushed += uint64(db.page.nappend) // 更新已刷新的页面数量
+	db.page.nfree = 0
+	db.page.nappend = 0
+	db.page.updates = make(map[uint64][]byte) // 清空更新的页面映射
 
 	// 更新 & 刷新主页面
-	if err := masterStore(db); err != nil {
+	db.ver++
+	mode := db.opts.Sync
+	if db.wal != nil {
+		mode = SYNC_ALWAYS // a checkpoint, the log is reset after it
+	}
+	var err error
+	switch mode {
+	case SYNC_NEVER:
+		err = masterWrite(db, false)
+	case SYNC_INTERVAL:
+		if time.Since(db.synced) < db.opts.SyncInterval {
+			syncLater(db) // the master page is written later
+			break
+		}
+		fallthrough
+	default:
+		err = masterWrite(db, true)
+	}
+	if err != nil {
 		return err
 	}
+	publish(db)
+	return nil
+}
+
+// write the master page of the last update, the pages must be synced before it.
+func masterWrite(db *KV, sync bool) error {
+	// flush data to the disk. must be done before updating the master page.
+	if sync {
+		if err := db.pager.Sync(); err != nil {
+			return fmt.Errorf("fsync: %w", err)
+		}
+	}
+	if err := masterStore(db); err != nil {
+		db.failed = fmt.Errorf("%w: %v", ErrNeedReopen, err)
+		return db.failed
+	}
 
 	// 再次同步以确保所有数据都已写入磁盘
-	if err := db.fp.Sync(); err != nil {
-		return fmt.Errorf("fsync: %w", err)
+	if sync {
+		if err := db.pager.Sync(); err != nil {
+			db.failed = fmt.Errorf("%w: fsync: %v", ErrNeedReopen, err)
+			return db.failed
+		}
 	}
+	// the new slot is durable, the next update can overwrite the old one
+	db.master = 1 - db.master
+	db.durable, db.synced = db.ver, time.Now()
 	return nil
 }
+
+// SYNC_INTERVAL: sync the updates at the end of the interval.
+func syncLater(db *KV) {
+	if db.timer == nil {
+		db.timer = time.AfterFunc(db.opts.SyncInterval-time.Since(db.synced), db.syncPending)
+	}
+}
+
+func (db *KV) syncPending() {
+	db.writer.Lock()
+	defer db.writer.Unlock()
+	db.timer = nil
+	if db.pager == nil || db.failed != nil || db.durable == db.ver {
+		return // closed or nothing to do
+	}
+	if err := masterWrite(db, true); err != nil && db.failed == nil {
+		syncLater(db) // retry
+	}
+}
+
+// make the committed version visible to new readers.
+func publish(db *KV) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.version = kvVersion{ver: db.ver, root: db.tree.root, flushed: db.page.flushed}
+	if db.wal != nil {
+		db.version.pages = db.wal.pages
+	}
+}
+
+// the oldest version that can still be read, by the oldest reader or a new one.
+// the pages freed by this version or before it are not reachable from
+// any of the readers, so they can be reused.
+func (db *KV) oldest() uint64 {
+	// the pages of the version in the master page are not reused before it's synced
+	return min(db.oldestRead(), db.durable)
+}
+
+// the oldest version of the readers, or the last version if there are none.
+func (db *KV) oldestRead() uint64 {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	oldest := db.version.ver
+	for ver := range db.readers {
+		oldest = min(oldest, ver)
+	}
+	return oldest
+}
@@ -1,7 +1,16 @@
 package core
 
 import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -10,3 +19,714 @@ func TestMmapSize(t *testing.T) {
 	mmapSize := 64 << 20
 	assert.True(t, mmapSize%BTREE_PAGE_SIZE == 0)
 }
+
+func newTestKV(t *testing.T) *KV {
+	db := &KV{Path: filepath.Join(t.TempDir(), "test.db")}
+	assert.Nil(t, db.Open())
+	t.Cleanup(db.Close)
+	return db
+}
+
+func TestKVSetGetReopen(t *testing.T) {
+	db := newTestKV(t)
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, db.Set([]byte(fmt.Sprintf("k%04d", i)), []byte(fmt.Sprintf("v%d", i))))
+	}
+	for i := 0; i < 500; i += 3 {
+		deleted, err := db.Del([]byte(fmt.Sprintf("k%04d", i)))
+		assert.Nil(t, err)
+		assert.True(t, deleted)
+	}
+
+	db.Close()
+	assert.Nil(t, db.Open())
+	for i := 0; i < 500; i++ {
+		val, ok, err := db.Get([]byte(fmt.Sprintf("k%04d", i)))
+		assert.Nil(t, err)
+		if i%3 == 0 {
+			assert.False(t, ok)
+			continue
+		}
+		assert.True(t, ok)
+		assert.Equal(t, fmt.Sprintf("v%d", i), string(val))
+	}
+}
+
+func TestKVScan(t *testing.T) {
+	db := newTestKV(t)
+	for i := 0; i < 300; i++ {
+		assert.Nil(t, db.Set([]byte(fmt.Sprintf("k%04d", i)), []byte(fmt.Sprintf("v%d", i))))
+	}
+
+	keys := []string{}
+	err := db.Scan([]byte("k0100"), []byte("k0110"), func(key, val []byte) bool {
+		keys = append(keys, string(key))
+		return true
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 10, len(keys))
+	assert.Equal(t, "k0100", keys[0])
+	assert.Equal(t, "k0109", keys[9])
+
+	// unbounded end, early stop
+	keys = keys[:0]
+	db.Scan([]byte("k0295"), nil, func(key, val []byte) bool {
+		keys = append(keys, string(key))
+		return len(keys) < 3
+	})
+	assert.Equal(t, []string{"k0295", "k0296", "k0297"}, keys)
+
+	// a start key that doesn't exist
+	keys = keys[:0]
+	db.Scan([]byte("a"), []byte("k0002"), func(key, val []byte) bool {
+		keys = append(keys, string(key))
+		return true
+	})
+	assert.Equal(t, []string{"k0000", "k0001"}, keys)
+}
+
+func TestKVScanRange(t *testing.T) {
+	db := newTestKV(t)
+	for i := 0; i < 300; i++ {
+		assert.Nil(t, db.Set([]byte(fmt.Sprintf("k%04d", i)), []byte(fmt.Sprintf("v%d", i))))
+	}
+	collect := func(start, end []byte, opts ScanOptions) []string {
+		keys := []string{}
+		err := db.ScanRange(start, end, opts, func(key, val []byte) bool {
+			keys = append(keys, string(key))
+			return true
+		})
+		assert.Nil(t, err)
+		return keys
+	}
+
+	assert.Equal(t, []string{"k0100", "k0101", "k0102"},
+		collect([]byte("k0100"), []byte("k0110"), ScanOptions{Limit: 3}))
+	assert.Equal(t, []string{"k0109", "k0108", "k0107"},
+		collect([]byte("k0100"), []byte("k0110"), ScanOptions{Desc: true, Limit: 3}))
+	assert.Equal(t, []string{"k0102", "k0101", "k0100"},
+		collect([]byte("k0100"), []byte("k0103"), ScanOptions{Desc: true}))
+	assert.Equal(t, []string{"k0299", "k0298"},
+		collect(nil, nil, ScanOptions{Desc: true, Limit: 2}))
+	assert.Equal(t, []string{"k0001", "k0000"},
+		collect(nil, []byte("k0002"), ScanOptions{Desc: true}))
+	assert.Equal(t, 300, len(collect(nil, nil, ScanOptions{})))
+
+	// keyset pagination
+	iter := db.Seek([]byte("k0100"), CMP_GT)
+	defer iter.Close()
+	assert.True(t, iter.Valid())
+	assert.Equal(t, "k0101", string(iter.Key()))
+}
+
+func TestKVCorruptPage(t *testing.T) {
+	db := newTestKV(t)
+	for i := 0; i < 300; i++ {
+		assert.Nil(t, db.Set([]byte(fmt.Sprintf("k%04d", i)), []byte(fmt.Sprintf("v%d", i))))
+	}
+	root := db.tree.root
+	db.Close()
+
+	// flip a bit in the root node
+	fp, err := os.OpenFile(db.Path, os.O_RDWR, 0644)
+	assert.Nil(t, err)
+	buf := make([]byte, 1)
+	offset := int64(root*BTREE_PAGE_SIZE + 100)
+	_, err = fp.ReadAt(buf, offset)
+	assert.Nil(t, err)
+	buf[0] ^= 0x10
+	_, err = fp.WriteAt(buf, offset)
+	assert.Nil(t, err)
+	assert.Nil(t, fp.Close())
+
+	assert.Nil(t, db.Open())
+	var corrupt ErrCorruptPage
+	_, _, err = db.Get([]byte("k0001"))
+	assert.True(t, errors.As(err, &corrupt))
+	assert.Equal(t, root, corrupt.Ptr)
+
+	err = db.Set([]byte("k0001"), []byte("x"))
+	assert.True(t, errors.As(err, &corrupt))
+	_, err = db.Del([]byte("k0001"))
+	assert.True(t, errors.As(err, &corrupt))
+	err = db.Scan(nil, nil, func(key, val []byte) bool { return true })
+	assert.True(t, errors.As(err, &corrupt))
+
+	// the failed updates didn't change anything
+	assert.Equal(t, root, db.tree.root)
+	assert.Equal(t, 0, len(db.page.updates))
+}
+
+func TestKVOverflowValue(t *testing.T) {
+	db := newTestKV(t)
+	big := make([]byte, 3<<20)
+	for i := range big {
+		big[i] = byte(i % 251)
+	}
+	assert.Nil(t, db.Set([]byte("big"), big))
+	assert.Nil(t, db.Set([]byte("small"), []byte("s")))
+
+	db.Close()
+	assert.Nil(t, db.Open())
+	val, ok, err := db.Get([]byte("big"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, big, val)
+
+	// the pages of the deleted value are reused by the next one
+	deleted, err := db.Del([]byte("big"))
+	assert.Nil(t, err)
+	assert.True(t, deleted)
+	total, err := db.free.Total()
+	assert.Nil(t, err)
+	assert.True(t, total >= uint64(len(big)/OVERFLOW_CAP))
+	flushed := db.page.flushed
+	assert.Nil(t, db.Set([]byte("big2"), big[:1<<20]))
+	assert.Equal(t, flushed, db.page.flushed)
+
+	keys := []string{}
+	err = db.Scan(nil, nil, func(key, val []byte) bool {
+		keys = append(keys, string(key))
+		if string(key) == "big2" {
+			assert.Equal(t, big[:1<<20], val)
+		}
+		return true
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"big2", "small"}, keys)
+}
+
+// a chain of overflow pages that ends early isn't a shorter value.
+func TestKVOverflowTruncated(t *testing.T) {
+	db := newTestKV(t)
+	assert.Nil(t, db.Set([]byte("big"), make([]byte, 3*OVERFLOW_CAP)))
+	leaf, err := db.tree.get(db.tree.root)
+	assert.Nil(t, err)
+	idx := nodeLookupLE(db.tree.cmp, leaf, []byte("big"))
+	assert.True(t, leafIsOverflow(leaf, idx))
+	first := binary.LittleEndian.Uint64(leaf.getVal(idx)[8:16])
+	patchPage(t, db, first, func(node BNode) { ovSetHeader(node, 0) })
+
+	_, _, err = db.Get([]byte("big"))
+	assert.ErrorIs(t, err, ErrBadNode)
+}
+
+func TestKVBulkLoad(t *testing.T) {
+	db := newTestKV(t)
+	iter := &sliceIter{}
+	for i := 0; i < 20000; i++ {
+		iter.keys = append(iter.keys, fmt.Sprintf("k%06d", i))
+		val := fmt.Sprint(i)
+		if i%10 == 0 {
+			// in overflow pages, enough of them to be written in several batches
+			val = strings.Repeat("v", BTREE_MAX_VAL_SIZE+i%5000)
+		}
+		iter.vals = append(iter.vals, val)
+	}
+	assert.Nil(t, db.BulkLoad(iter))
+	// the KV is not empty anymore
+	assert.NotNil(t, db.BulkLoad(&sliceIter{keys: []string{"a"}, vals: []string{""}}))
+
+	db.Close()
+	assert.Nil(t, db.Open())
+	n := 0
+	err := db.Scan(nil, nil, func(key, val []byte) bool {
+		assert.Equal(t, iter.keys[n], string(key))
+		assert.Equal(t, iter.vals[n], string(val))
+		n++
+		return true
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, len(iter.keys), n)
+
+	assert.Nil(t, db.Set([]byte("k000001"), []byte("new")))
+	val, ok, err := db.Get([]byte("k000001"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, []byte("new"), val)
+}
+
+// records the pages written to the file.
+type writeOrderPager struct {
+	Pager
+	writes []uint64
+}
+
+func (p *writeOrderPager) Write(ptr uint64, page []byte) error {
+	p.writes = append(p.writes, ptr)
+	return p.Pager.Write(ptr, page)
+}
+
+// the pages of a bulk load are appended in order.
+func TestKVBulkLoadSequential(t *testing.T) {
+	pager := &writeOrderPager{Pager: NewMmapPager()}
+	db := &KV{Path: filepath.Join(t.TempDir(), "test.db"), Pager: pager}
+	assert.Nil(t, db.Open())
+	defer db.Close()
+	iter := &sliceIter{}
+	for i := 0; i < 20000; i++ {
+		iter.keys = append(iter.keys, fmt.Sprintf("k%06d", i))
+		iter.vals = append(iter.vals, strings.Repeat("v", i%200))
+	}
+	assert.Nil(t, db.BulkLoad(iter))
+	assert.True(t, len(pager.writes) > 100)
+	assert.True(t, sort.SliceIsSorted(pager.writes, func(i, j int) bool {
+		return pager.writes[i] < pager.writes[j]
+	}))
+}
+
+func TestKVBulkLoadUnsorted(t *testing.T) {
+	db := newTestKV(t)
+	assert.Nil(t, db.Set([]byte("a"), []byte("1")))
+	_, err := db.Del([]byte("a"))
+	assert.Nil(t, err)
+
+	// a failed load leaves the KV unchanged
+	iter := &sliceIter{keys: []string{"x", "z", "y"}, vals: []string{"1", "2", "3"}}
+	assert.NotNil(t, db.BulkLoad(iter))
+	_, ok, err := db.Get([]byte("x"))
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	// an empty tree that has a root
+	iter = &sliceIter{keys: []string{"x", "y"}, vals: []string{"1", "2"}}
+	assert.Nil(t, db.BulkLoadWith(iter, BulkOptions{Fill: 1}))
+	val, ok, err := db.Get([]byte("y"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, []byte("2"), val)
+}
+
+func TestKVRank(t *testing.T) {
+	db := newTestKV(t)
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Set([]byte(fmt.Sprintf("k%04d", i*2)), []byte("v")))
+	}
+	rank, err := db.Rank([]byte("k0100"))
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(50), rank)
+	count, err := db.Count([]byte("k0100"), []byte("k0200"))
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(50), count)
+	count, err = db.Count(nil, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1000), count)
+
+	iter := db.Select(999)
+	defer iter.Close()
+	assert.True(t, iter.Valid())
+	assert.Equal(t, []byte("k1998"), iter.Key())
+	past := db.Select(1000)
+	defer past.Close()
+	assert.False(t, past.Valid())
+}
+
+func TestKVBadInput(t *testing.T) {
+	db := newTestKV(t)
+	assert.Nil(t, db.Set([]byte("a"), []byte("1")))
+
+	assert.ErrorIs(t, db.Set(nil, []byte("x")), ErrEmptyKey)
+	assert.ErrorIs(t, db.Set(make([]byte, BTREE_MAX_KEY_SIZE+1), nil), ErrKeyTooLarge)
+	_, _, err := db.Get(nil)
+	assert.ErrorIs(t, err, ErrEmptyKey)
+	_, err = db.Del(make([]byte, BTREE_MAX_KEY_SIZE+1))
+	assert.ErrorIs(t, err, ErrKeyTooLarge)
+
+	// pointers out of the file
+	_, err = db.pageGet(0)
+	assert.ErrorIs(t, err, ErrBadPointer)
+	_, err = db.pageGet(db.page.flushed)
+	assert.ErrorIs(t, err, ErrBadPointer)
+	assert.ErrorIs(t, db.pageDel(db.page.flushed+10), ErrBadPointer)
+	// a deallocated page
+	root := db.tree.root
+	assert.Nil(t, db.pageDel(root))
+	_, err = db.pageGet(root)
+	assert.ErrorIs(t, err, ErrBadPointer)
+	db.page.updates = map[uint64][]byte{}
+
+	val, ok, err := db.Get([]byte("a"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, []byte("1"), val)
+}
+
+func TestKVComparator(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := &KV{Path: path, Comparator: CmpNatural}
+	assert.Nil(t, db.Open())
+	for _, key := range []string{"v10", "v9", "v100", "v1"} {
+		assert.Nil(t, db.Set([]byte(key), []byte(key)))
+	}
+	db.Close()
+
+	// the order is read from the file
+	db = &KV{Path: path}
+	assert.Nil(t, db.Open())
+	keys := []string{}
+	assert.Nil(t, db.Scan([]byte("v2"), []byte("v100"), func(key, val []byte) bool {
+		keys = append(keys, string(key))
+		return true
+	}))
+	assert.Equal(t, []string{"v9", "v10"}, keys)
+	db.Close()
+
+	// a different order
+	db = &KV{Path: path, Comparator: CmpBinary}
+	assert.ErrorIs(t, db.Open(), ErrComparatorMismatch)
+	db = &KV{Path: path, Comparator: &Comparator{Name: "custom", Compare: CmpNatural.Compare}}
+	assert.ErrorIs(t, db.Open(), ErrComparatorMismatch)
+	db = &KV{Path: path, Comparator: &Comparator{Name: "natural"}}
+	assert.NotNil(t, db.Open())
+
+	// a file without the name is in the byte order
+	db = newTestKV(t)
+	assert.Nil(t, db.Set([]byte("a"), []byte("1")))
+	db.Close()
+	patchMaster(t, db.Path, func(slot []byte) {
+		slot[40] = 0
+	})
+	db.Comparator = CmpNoCase
+	assert.ErrorIs(t, db.Open(), ErrComparatorMismatch)
+	db.Comparator = nil
+	assert.Nil(t, db.Open())
+	assert.Equal(t, CmpBinary, db.tree.cmp)
+}
+
+func TestKVDeleteRange(t *testing.T) {
+	db := newTestKV(t)
+	for i := 0; i < 3000; i++ {
+		assert.Nil(t, db.Set([]byte(fmt.Sprintf("k%04d", i)), []byte(strings.Repeat("v", 100))))
+	}
+	flushed := db.page.flushed
+	deleted, err := db.DeleteRange([]byte("k0100"), []byte("k2900"))
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(2800), deleted)
+	deleted, err = db.DeleteRange([]byte("k0100"), []byte("k2900"))
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), deleted)
+
+	db.Close()
+	assert.Nil(t, db.Open())
+	_, err = db.Check()
+	assert.Nil(t, err)
+	count, err := db.Count(nil, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(200), count)
+	_, ok, err := db.Get([]byte("k0099"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	_, ok, err = db.Get([]byte("k0100"))
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	// the freed pages are reused
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Set([]byte(fmt.Sprintf("x%04d", i)), []byte(strings.Repeat("v", 100))))
+	}
+	assert.Equal(t, flushed, db.page.flushed)
+}
+
+func TestKVUpdate(t *testing.T) {
+	db := newTestKV(t)
+	req := &UpdateReq{Key: []byte("k"), Val: []byte("1"), Mode: MODE_INSERT_ONLY}
+	assert.Nil(t, db.Update(req))
+	assert.True(t, req.Added)
+
+	// an idempotent insert
+	req = &UpdateReq{Key: []byte("k"), Val: []byte("2"), Mode: MODE_INSERT_ONLY}
+	assert.Nil(t, db.Update(req))
+	assert.False(t, req.Updated)
+	assert.Equal(t, []byte("1"), req.Old)
+	assert.Equal(t, 0, len(db.page.updates))
+
+	// compare-and-swap
+	req = &UpdateReq{Key: []byte("k"), Val: []byte("3"), Mode: MODE_CAS, Expected: []byte("2")}
+	assert.Nil(t, db.Update(req))
+	assert.False(t, req.Updated)
+	req.Expected = []byte("1")
+	assert.Nil(t, db.Update(req))
+	assert.True(t, req.Updated)
+
+	db.Close()
+	assert.Nil(t, db.Open())
+	val, ok, err := db.Get([]byte("k"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, []byte("3"), val)
+}
+
+// the master slots of a closed KV file.
+func readMaster(t *testing.T, path string) (slots [2]masterSlot, valid [2]bool) {
+	data, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	for i := range slots {
+		slots[i], valid[i] = masterDecode(data[masterSlotPos(i):], i)
+	}
+	return slots, valid
+}
+
+// modify the current master slot of a closed KV file with a valid checksum.
+func patchMaster(t *testing.T, path string, fn func(slot []byte)) {
+	slots, valid := readMaster(t, path)
+	cur := 0
+	if valid[1] && (!valid[0] || slots[1].ver > slots[0].ver) {
+		cur = 1
+	}
+	fp, err := os.OpenFile(path, os.O_RDWR, 0644)
+	assert.Nil(t, err)
+	defer fp.Close()
+	data := make([]byte, MASTER_SLOT_SIZE)
+	_, err = fp.ReadAt(data, masterSlotPos(cur))
+	assert.Nil(t, err)
+	fn(data)
+	sum := crc32.Checksum(data[:MASTER_SLOT_SIZE-4], crc32c)
+	binary.LittleEndian.PutUint32(data[MASTER_SLOT_SIZE-4:], sum)
+	_, err = fp.WriteAt(data, masterSlotPos(cur))
+	assert.Nil(t, err)
+}
+
+func TestKVMasterSlots(t *testing.T) {
+	db := newTestKV(t)
+	for i := 1; i <= 5; i++ {
+		assert.Nil(t, db.Set([]byte(fmt.Sprintf("k%d", i)), []byte("v")))
+		slots, valid := readMaster(t, db.Path)
+		// the slots are written alternately
+		cur := (i - 1) % 2
+		assert.True(t, valid[cur])
+		assert.Equal(t, uint64(i), slots[cur].ver)
+		assert.Equal(t, db.tree.root, slots[cur].root)
+		if i > 1 {
+			assert.True(t, valid[1-cur])
+			assert.Equal(t, uint64(i-1), slots[1-cur].ver)
+		}
+	}
+	db.Close()
+	assert.Nil(t, db.Open())
+	assert.Equal(t, uint64(5), db.ver)
+	assert.Equal(t, 0, db.master)
+}
+
+// a torn write of the master page leaves the previous slot intact.
+func TestKVTornMaster(t *testing.T) {
+	db := newTestKV(t)
+	for i := 0; i < 300; i++ {
+		assert.Nil(t, db.Set([]byte(fmt.Sprintf("k%04d", i)), []byte("old")))
+	}
+	meta := saveMeta(db)
+	// the slot to be written by the next update
+	next := masterSlotPos(1 - db.master)
+	data, err := db.pager.Read(0)
+	assert.Nil(t, err)
+	old := append([]byte(nil), data[next:][:MASTER_SLOT_SIZE]...)
+	b := &WriteBatch{}
+	for i := 0; i < 300; i++ {
+		b.Set([]byte(fmt.Sprintf("k%04d", i)), []byte("new"))
+	}
+	assert.Nil(t, db.Batch(b))
+	db.Close()
+
+	// only the first half of the slot is written
+	fp, err := os.OpenFile(db.Path, os.O_RDWR, 0644)
+	assert.Nil(t, err)
+	half := MASTER_SLOT_SIZE / 2
+	_, err = fp.WriteAt(old[half:], next+int64(half))
+	assert.Nil(t, err)
+	assert.Nil(t, fp.Close())
+
+	assert.Nil(t, db.Open())
+	assert.Equal(t, meta, saveMeta(db))
+	val, ok, err := db.Get([]byte("k0100"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "old", string(val))
+	report, err := db.Check()
+	assert.Nil(t, err, report.String())
+
+	// the torn slot is written again by the next update
+	assert.Nil(t, db.Set([]byte("k0100"), []byte("again")))
+	db.Close()
+	assert.Nil(t, db.Open())
+	val, _, err = db.Get([]byte("k0100"))
+	assert.Nil(t, err)
+	assert.Equal(t, "again", string(val))
+	report, err = db.Check()
+	assert.Nil(t, err, report.String())
+	db.Close()
+
+	// both slots are broken
+	fp, err = os.OpenFile(db.Path, os.O_RDWR, 0644)
+	assert.Nil(t, err)
+	for slot := 0; slot < 2; slot++ {
+		_, err = fp.WriteAt([]byte{0xff}, masterSlotPos(slot)+20)
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, fp.Close())
+	assert.NotNil(t, db.Open())
+}
+
+// the 1st update of a new file crashed before the master page is durable.
+func TestKVUnwrittenMaster(t *testing.T) {
+	for _, n := range []int{0, 5, 16, 60, MASTER_SLOT_SIZE - 4} {
+		db := newTestKV(t)
+		assert.Nil(t, db.Set([]byte("k"), []byte("v")))
+		db.Close()
+		// only a prefix of the 1st slot is written
+		data, err := os.ReadFile(db.Path)
+		assert.Nil(t, err)
+		clear(data[n:BTREE_PAGE_SIZE])
+		assert.Nil(t, os.WriteFile(db.Path, data, 0644))
+
+		assert.Nil(t, db.Open(), n)
+		count, err := db.Count(nil, nil)
+		assert.Nil(t, err)
+		assert.Equal(t, uint64(0), count)
+		assert.Nil(t, db.Set([]byte("k"), []byte("new")))
+		db.Close()
+		assert.Nil(t, db.Open())
+		val, _, err := db.Get([]byte("k"))
+		assert.Nil(t, err)
+		assert.Equal(t, "new", string(val))
+		report, err := db.Check()
+		assert.Nil(t, err, report.String())
+	}
+
+	// not a torn write
+	db := newTestKV(t)
+	assert.Nil(t, db.Set([]byte("k"), []byte("v")))
+	db.Close()
+	data, err := os.ReadFile(db.Path)
+	assert.Nil(t, err)
+	copy(data, "BuildYourOwnDB0X")
+	assert.Nil(t, os.WriteFile(db.Path, data, 0644))
+	assert.NotNil(t, db.Open())
+}
+
+func TestKVLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	open := func(opts Options) (*KV, error) {
+		db := &KV{Path: path}
+		err := db.OpenWith(opts)
+		if err == nil {
+			t.Cleanup(db.Close)
+		}
+		return db, err
+	}
+	// an exclusive lock for writing
+	w, err := open(Options{})
+	assert.Nil(t, err)
+	assert.Nil(t, w.Set([]byte("k"), []byte("v")))
+	_, err = open(Options{})
+	assert.ErrorIs(t, err, ErrLocked)
+	_, err = open(Options{ReadOnly: true})
+	assert.ErrorIs(t, err, ErrLocked)
+	other := &KV{Path: path, Pager: NewFilePager(0)}
+	assert.ErrorIs(t, other.Open(), ErrLocked)
+	w.Close()
+
+	// shared locks for reading
+	r1, err := open(Options{ReadOnly: true})
+	assert.Nil(t, err)
+	r2, err := open(Options{ReadOnly: true})
+	assert.Nil(t, err)
+	_, err = open(Options{})
+	assert.ErrorIs(t, err, ErrLocked)
+
+	// wait for the lock
+	start := time.Now()
+	_, err = open(Options{LockTimeout: 30 * time.Millisecond})
+	assert.ErrorIs(t, err, ErrLocked)
+	assert.True(t, time.Since(start) >= 30*time.Millisecond)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		r1.Close()
+		r2.Close()
+	}()
+	start = time.Now()
+	w, err = open(Options{LockTimeout: 5 * time.Second})
+	assert.Nil(t, err)
+	assert.True(t, time.Since(start) >= 50*time.Millisecond)
+	val, _, err := w.Get([]byte("k"))
+	assert.Nil(t, err)
+	assert.Equal(t, "v", string(val))
+}
+
+// the reads fail after Close() and before Open().
+func TestKVClosed(t *testing.T) {
+	db := &KV{Path: filepath.Join(t.TempDir(), "test.db")}
+	_, _, err := db.Get([]byte("k"))
+	assert.ErrorIs(t, err, ErrClosed)
+
+	assert.Nil(t, db.Open())
+	assert.Nil(t, db.Set([]byte("k"), []byte("v")))
+	db.Close()
+	db.Close() // no effect
+
+	_, _, err = db.Get([]byte("k"))
+	assert.ErrorIs(t, err, ErrClosed)
+	assert.ErrorIs(t, db.Scan(nil, nil, func(key, val []byte) bool { return true }), ErrClosed)
+	iter := db.Seek([]byte("k"), CMP_GE)
+	defer iter.Close()
+	assert.False(t, iter.Valid())
+	assert.ErrorIs(t, iter.Err(), ErrClosed)
+	selected := db.Select(0)
+	defer selected.Close()
+	assert.ErrorIs(t, selected.Err(), ErrClosed)
+	_, err = db.Count(nil, nil)
+	assert.ErrorIs(t, err, ErrClosed)
+	_, err = db.Rank([]byte("k"))
+	assert.ErrorIs(t, err, ErrClosed)
+	r := db.BeginRead()
+	_, _, err = r.Get([]byte("k"))
+	assert.ErrorIs(t, err, ErrClosed)
+	r.Close()
+	assert.Empty(t, db.readers)
+
+	assert.Nil(t, db.Open())
+	defer db.Close()
+	val, ok, err := db.Get([]byte("k"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "v", string(val))
+}
+
+// the updates fail after Close() instead of reading the unmapped pages.
+func TestKVClosedWrites(t *testing.T) {
+	for _, opts := range []Options{{}, {GroupCommit: true}, {WAL: true}} {
+		db := &KV{Path: filepath.Join(t.TempDir(), "test.db")}
+		assert.Nil(t, db.OpenWith(opts))
+		for i := 0; i < 100; i++ {
+			assert.Nil(t, db.Set([]byte(fmt.Sprintf("k%03d", i)), []byte("v")))
+		}
+		db.Close()
+
+		assert.ErrorIs(t, db.Set([]byte("k001"), []byte("new")), ErrClosed)
+		assert.ErrorIs(t, db.Update(&UpdateReq{Key: []byte("k001"), Val: []byte("new")}), ErrClosed)
+		_, err := db.Del([]byte("k001"))
+		assert.ErrorIs(t, err, ErrClosed)
+		_, err = db.DeleteRange(nil, nil)
+		assert.ErrorIs(t, err, ErrClosed)
+		b := &WriteBatch{}
+		b.Set([]byte("k001"), []byte("new"))
+		assert.ErrorIs(t, db.Batch(b), ErrClosed)
+		assert.ErrorIs(t, db.BulkLoad(&sliceIter{keys: []string{"a"}, vals: []string{"1"}}), ErrClosed)
+		_, err = db.Check()
+		assert.ErrorIs(t, err, ErrClosed)
+		assert.ErrorIs(t, db.Checkpoint(), ErrClosed)
+
+		tx := db.Begin()
+		assert.ErrorIs(t, tx.Set([]byte("k001"), []byte("new")), ErrClosed)
+		_, _, err = tx.Get([]byte("k001"))
+		assert.ErrorIs(t, err, ErrClosed)
+		assert.ErrorIs(t, tx.Commit(), ErrClosed)
+		tx.Abort() // no effect
+
+		// the writer lock is not held
+		assert.Nil(t, db.OpenWith(opts))
+		assert.Nil(t, db.Set([]byte("k001"), []byte("new")))
+		val, _, err := db.Get([]byte("k001"))
+		assert.Nil(t, err)
+		assert.Equal(t, "new", string(val))
+		db.Close()
+	}
+}
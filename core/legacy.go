@@ -0,0 +1,181 @@
+package core
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Before "BuildYourOwnDB07", leaf nodes and internal nodes used the same format:
+// | type | nkeys | checksum | pointers   | offsets    | key-values
+// | 2B   | 2B    | 4B       | nkeys * 8B | nkeys * 2B | ...
+// | klen | vlen | key | val |
+// | 2B   | 2B   | ... | ... |
+// "BuildYourOwnDB05" has no checksum, so its header is only 4 bytes.
+// "BuildYourOwnDB06" added the checksum and the overflow pages, a leaf with
+// a nonzero pointer stores the value size and the value is in the overflow pages.
+//
+// These formats are only read to upgrade an old file, see legacyUpgrade().
+var legacySigs = map[string]uint16{
+	"BuildYourOwnDB05": 4, // the header size
+	"BuildYourOwnDB06": 8,
+}
+
+// The nodes of "BuildYourOwnDB07" and "BuildYourOwnDB08" can be read by BNode,
+// but their internal nodes don't have the subtree counts.
+// "BuildYourOwnDB09" has the same tree, but its free list items have no version.
+// The tree is rebuilt with a new free list, see rebuildUpgrade().
+var rebuildSigs = map[string]bool{
+	"BuildYourOwnDB07": true,
+	"BuildYourOwnDB08": true,
+	"BuildYourOwnDB09": true,
+}
+
+// "BuildYourOwnDB10" is the current format with a single master slot without
+// the checksum, it's replaced by the 2 slots on the next update, see masterStore().
+const singleMasterSig = "BuildYourOwnDB10"
+
+// "BuildYourOwnDB11" is the current format without the COUNT_NO_OVERFLOW flag,
+// it's read as is, the counts without the flag only make DeleteRange() read the leaves.
+const noFlagsSig = "BuildYourOwnDB11"
+
+type legacyNode struct {
+	data   []byte
+	header uint16
+}
+
+func (node legacyNode) btype() uint16 {
+	return binary.LittleEndian.Uint16(node.data)
+}
+func (node legacyNode) nkeys() uint16 {
+	return binary.LittleEndian.Uint16(node.data[2:4])
+}
+func (node legacyNode) getPtr(idx uint16) uint64 {
+	pos := node.header + 8*idx
+	return binary.LittleEndian.Uint64(node.data[pos:])
+}
+func (node legacyNode) kvPos(idx uint16) uint16 {
+	offset := uint16(0)
+	if idx > 0 {
+		pos := node.header + 8*node.nkeys() + 2*(idx-1)
+		offset = binary.LittleEndian.Uint16(node.data[pos:])
+	}
+	return node.header + 10*node.nkeys() + offset
+}
+func (node legacyNode) getKey(idx uint16) []byte {
+	pos := node.kvPos(idx)
+	klen := binary.LittleEndian.Uint16(node.data[pos:])
+	return node.data[pos+4:][:klen]
+}
+func (node legacyNode) getVal(idx uint16) []byte {
+	pos := node.kvPos(idx)
+	klen := binary.LittleEndian.Uint16(node.data[pos+0:])
+	vlen := binary.LittleEndian.Uint16(node.data[pos+2:])
+	return node.data[pos+4+klen:][:vlen]
+}
+
+// read a page of an old file.
+func legacyGet(db *KV, ptr uint64, header uint16) (legacyNode, error) {
+	if ptr == 0 || ptr >= db.page.flushed {
+		return legacyNode{}, fmt.Errorf("%w: page %d in the old file", ErrBadPointer, ptr)
+	}
+	data, err := db.pager.Read(ptr)
+	if err != nil {
+		return legacyNode{}, err
+	}
+	if header == HEADER && !pageVerify(data) {
+		return legacyNode{}, ErrCorruptPage{Ptr: ptr}
+	}
+	return legacyNode{data: data, header: header}, nil
+}
+
+// call `fn` for every KV of the old tree in order, stop at the first error.
+func legacyScan(db *KV, ptr uint64, header uint16, fn func(key, val []byte) error) error {
+	node, err := legacyGet(db, ptr, header)
+	if err != nil {
+		return err
+	}
+	for i := uint16(0); i < node.nkeys(); i++ {
+		switch node.btype() {
+		case BNODE_LEAF:
+			val := node.getVal(i)
+			if vptr := node.getPtr(i); header == HEADER && vptr != 0 {
+				// the overflow pages have the same format as today
+				val, err = overflowRead(&db.tree, vptr, binary.LittleEndian.Uint64(val))
+				if err != nil {
+					return err
+				}
+			}
+			err = fn(node.getKey(i), val)
+		case BNODE_NODE:
+			err = legacyScan(db, node.getPtr(i), header, fn)
+		default:
+			err = ErrBadNode
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// convert an old file to the current format in place.
+func legacyUpgrade(db *KV, header uint16) error {
+	return upgradeTree(db, func(add func(key, val []byte) error) error {
+		if db.tree.root == 0 {
+			return nil
+		}
+		return legacyScan(db, db.tree.root, header, func(key, val []byte) error {
+			if len(key) == 0 {
+				return nil // the dummy key
+			}
+			return add(key, val)
+		})
+	})
+}
+
+// add the subtree counts to a "BuildYourOwnDB07" or "BuildYourOwnDB08" file.
+func rebuildUpgrade(db *KV) error {
+	return upgradeTree(db, func(add func(key, val []byte) error) error {
+		iter := db.tree.Seek(nil, CMP_GT)
+		for ; iter.Valid(); iter.Next() {
+			val := iter.Value()
+			if err := iter.Err(); err != nil {
+				return err
+			}
+			if err := add(iter.Key(), val); err != nil {
+				return err
+			}
+		}
+		return iter.Err()
+	})
+}
+
+// build a new tree from the KVs passed to `add` by `scan` in order.
+// the new tree is bulk loaded in appended pages, then all the old pages are freed
+// and the new master page is written by the same update. a crash before that
+// leaves the old file intact, and the upgrade is redone on the next open.
+func upgradeTree(db *KV, scan func(add func(key, val []byte) error) error) (err error) {
+	meta := saveMeta(db)
+	defer revertOnError(db, meta, &err)
+
+	tree := BTree{cmp: db.tree.cmp, get: db.pageGet, new: db.pageAppend, del: db.pageDel}
+	builder, err := newTreeBuilder(&tree, BULK_FILL_DEFAULT)
+	if err != nil {
+		return err
+	}
+	err = scan(func(key, val []byte) error {
+		return bulkAdd(db, builder, key, val)
+	})
+	if err != nil {
+		return err
+	}
+	if err = builder.finish(); err != nil {
+		return err
+	}
+	db.tree.root = tree.root
+	db.free.head = 0 // the old free list is freed with everything else
+	for ptr := uint64(1); ptr < meta.flushed; ptr++ {
+		db.page.updates[ptr] = nil
+	}
+	return flushPages(db)
+}
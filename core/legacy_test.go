@@ -0,0 +1,313 @@
+package core
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// encode a node in the format before "BuildYourOwnDB07".
+func legacyEncode(header uint16, btype uint16, ptrs []uint64, keys []string, vals []string) []byte {
+	page := make([]byte, BTREE_PAGE_SIZE)
+	n := uint16(len(keys))
+	binary.LittleEndian.PutUint16(page[0:2], btype)
+	binary.LittleEndian.PutUint16(page[2:4], n)
+	offset := uint16(0)
+	for i := uint16(0); i < n; i++ {
+		binary.LittleEndian.PutUint64(page[header+8*i:], ptrs[i])
+		pos := header + 10*n + offset
+		binary.LittleEndian.PutUint16(page[pos:], uint16(len(keys[i])))
+		binary.LittleEndian.PutUint16(page[pos+2:], uint16(len(vals[i])))
+		copy(page[pos+4:], keys[i])
+		copy(page[pos+4+uint16(len(keys[i])):], vals[i])
+		offset += 4 + uint16(len(keys[i])+len(vals[i]))
+		binary.LittleEndian.PutUint16(page[header+8*n+2*i:], offset)
+	}
+	return page
+}
+
+func writeLegacyFile(t *testing.T, sig string, root uint64, pages ...[]byte) string {
+	path := filepath.Join(t.TempDir(), "legacy.db")
+	master := make([]byte, BTREE_PAGE_SIZE)
+	copy(master, sig)
+	binary.LittleEndian.PutUint64(master[16:], root)
+	binary.LittleEndian.PutUint64(master[24:], uint64(len(pages)+1))
+	data := master
+	for _, page := range pages {
+		if sig != "BuildYourOwnDB05" {
+			pageSetChecksum(page)
+		}
+		data = append(data, page...)
+	}
+	assert.Nil(t, os.WriteFile(path, data, 0644))
+	return path
+}
+
+func TestUpgradeV05(t *testing.T) {
+	no := []uint64{0, 0, 0}
+	path := writeLegacyFile(t, "BuildYourOwnDB05", 3,
+		legacyEncode(4, BNODE_LEAF, no, []string{"", "a", "b"}, []string{"", "1", "2"}),
+		legacyEncode(4, BNODE_LEAF, no, []string{"m", "n"}, []string{"3", "4"}),
+		legacyEncode(4, BNODE_NODE, []uint64{1, 2}, []string{"", "m"}, []string{"", ""}),
+	)
+
+	db := &KV{Path: path}
+	assert.Nil(t, db.Open())
+	defer db.Close()
+	keys, vals := []string{}, []string{}
+	assert.Nil(t, db.Scan(nil, nil, func(key, val []byte) bool {
+		keys = append(keys, string(key))
+		vals = append(vals, string(val))
+		return true
+	}))
+	assert.Equal(t, []string{"a", "b", "m", "n"}, keys)
+	assert.Equal(t, []string{"1", "2", "3", "4"}, vals)
+	// the old pages are free
+	total, err := db.free.Total()
+	assert.Nil(t, err)
+	assert.True(t, total >= 3)
+
+	// upgraded in place
+	db.Close()
+	slots, valid := readMaster(t, path)
+	assert.True(t, valid[1])
+	assert.Equal(t, DB_SIG, slots[1].sig)
+	assert.Nil(t, db.Open())
+	val, ok, err := db.Get([]byte("m"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "3", string(val))
+}
+
+// a read-only open doesn't upgrade the file.
+func TestUpgradeReadOnly(t *testing.T) {
+	no := []uint64{0, 0}
+	path := writeLegacyFile(t, "BuildYourOwnDB05", 1,
+		legacyEncode(4, BNODE_LEAF, no, []string{"", "a"}, []string{"", "1"}),
+	)
+	data, err := os.ReadFile(path)
+	assert.Nil(t, err)
+
+	db := &KV{Path: path}
+	assert.ErrorIs(t, db.OpenWith(Options{ReadOnly: true}), ErrNeedUpgrade)
+	after, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, data, after)
+
+	// upgraded by a read-write open
+	assert.Nil(t, db.Open())
+	db.Close()
+	assert.Nil(t, db.OpenWith(Options{ReadOnly: true}))
+	defer db.Close()
+	val, ok, err := db.Get([]byte("a"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "1", string(val))
+}
+
+func TestUpgradeV06(t *testing.T) {
+	big := strings.Repeat("x", OVERFLOW_CAP+100)
+	size := make([]byte, 8)
+	binary.LittleEndian.PutUint64(size, uint64(len(big)))
+	ov1 := make([]byte, BTREE_PAGE_SIZE)
+	ovSetHeader(BNode{ov1}, 3)
+	copy(ov1[OVERFLOW_HEADER:], big)
+	ov2 := make([]byte, BTREE_PAGE_SIZE)
+	ovSetHeader(BNode{ov2}, 0)
+	copy(ov2[OVERFLOW_HEADER:], big[OVERFLOW_CAP:])
+	path := writeLegacyFile(t, "BuildYourOwnDB06", 1,
+		legacyEncode(8, BNODE_LEAF, []uint64{0, 2, 0}, []string{"", "big", "small"}, []string{"", string(size), "s"}),
+		ov1, ov2,
+	)
+
+	db := &KV{Path: path}
+	assert.Nil(t, db.Open())
+	defer db.Close()
+	val, ok, err := db.Get([]byte("big"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, big, string(val))
+	val, ok, err = db.Get([]byte("small"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "s", string(val))
+}
+
+// a leaf node, it has the same format since "BuildYourOwnDB08".
+func encodeLeaf(keys []string, vals []string) []byte {
+	node := BNode{make([]byte, BTREE_PAGE_SIZE)}
+	node.setHeader(BNODE_LEAF, uint16(len(keys)))
+	for i := range keys {
+		nodeAppendKV(node, uint16(i), 0, []byte(keys[i]), []byte(vals[i]))
+	}
+	return node.data
+}
+
+func TestUpgradeV08(t *testing.T) {
+	// an internal node without the subtree counts
+	node := make([]byte, BTREE_PAGE_SIZE)
+	binary.LittleEndian.PutUint16(node[0:2], BNODE_NODE|BNODE_PREFIX)
+	binary.LittleEndian.PutUint16(node[2:4], 2)
+	body := HEADER + 2
+	binary.LittleEndian.PutUint64(node[body:], 1)
+	binary.LittleEndian.PutUint64(node[body+8:], 2)
+	binary.LittleEndian.PutUint16(node[body+16:], 0) // the end of ""
+	binary.LittleEndian.PutUint16(node[body+18:], 1) // the end of "m"
+	copy(node[body+20:], "m")
+	path := writeLegacyFile(t, "BuildYourOwnDB08", 3,
+		encodeLeaf([]string{"", "a", "b"}, []string{"", "1", "2"}),
+		encodeLeaf([]string{"m", "n"}, []string{"3", "4"}),
+		node,
+	)
+	assert.Equal(t, []byte("m"), BNode{node}.getKey(1))
+
+	db := &KV{Path: path}
+	assert.Nil(t, db.Open())
+	defer db.Close()
+	keys := []string{}
+	assert.Nil(t, db.Scan(nil, nil, func(key, val []byte) bool {
+		keys = append(keys, string(key))
+		return true
+	}))
+	assert.Equal(t, []string{"a", "b", "m", "n"}, keys)
+	rank, err := db.Rank([]byte("m"))
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(2), rank)
+
+	db.Close()
+	slots, valid := readMaster(t, path)
+	assert.True(t, valid[1])
+	assert.Equal(t, DB_SIG, slots[1].sig)
+}
+
+func TestUpgradeV09(t *testing.T) {
+	// a free list node with 8-byte items
+	free := make([]byte, BTREE_PAGE_SIZE)
+	binary.LittleEndian.PutUint16(free[0:2], BNODE_FREE_LIST)
+	binary.LittleEndian.PutUint16(free[2:4], 1)
+	binary.LittleEndian.PutUint64(free[8:16], 1) // the total
+	binary.LittleEndian.PutUint64(free[FREE_LIST_HEADER:], 3)
+	path := writeLegacyFile(t, "BuildYourOwnDB09", 1,
+		encodeLeaf([]string{"", "A", "b"}, []string{"", "1", "2"}),
+		free,
+		encodeLeaf([]string{"", "x"}, []string{"", "x"}),
+	)
+	// the master page with the free list and the comparator
+	fp, err := os.OpenFile(path, os.O_RDWR, 0)
+	assert.Nil(t, err)
+	var meta [8 + 1 + 6]byte
+	binary.LittleEndian.PutUint64(meta[0:], 2)
+	meta[8] = 6
+	copy(meta[9:], "nocase")
+	_, err = fp.WriteAt(meta[:], 32)
+	assert.Nil(t, err)
+	assert.Nil(t, fp.Close())
+
+	db := &KV{Path: path}
+	assert.Nil(t, db.Open())
+	defer db.Close()
+	assert.Equal(t, CmpNoCase, db.tree.cmp)
+	val, ok, err := db.Get([]byte("a"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "1", string(val))
+	count, err := db.Count(nil, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(2), count)
+	report, err := db.Check()
+	assert.Nil(t, err, report.String())
+	assert.True(t, report.FreePages >= 3)
+
+	db.Close()
+	slots, valid := readMaster(t, path)
+	assert.True(t, valid[1])
+	assert.Equal(t, DB_SIG, slots[1].sig)
+}
+
+func TestUpgradeV10(t *testing.T) {
+	db := newTestKV(t)
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Set([]byte(fmt.Sprintf("k%03d", i)), []byte("v")))
+	}
+	meta := saveMeta(db)
+	db.Close()
+
+	// the single master page without the checksum
+	slots, _ := readMaster(t, db.Path)
+	cur := slots[db.master]
+	var data [BTREE_PAGE_SIZE]byte
+	copy(data[:16], singleMasterSig)
+	binary.LittleEndian.PutUint64(data[16:], cur.root)
+	binary.LittleEndian.PutUint64(data[24:], cur.used)
+	binary.LittleEndian.PutUint64(data[32:], cur.free)
+	binary.LittleEndian.PutUint64(data[41+COMPARATOR_MAX_NAME_SIZE:], cur.ver)
+	fp, err := os.OpenFile(db.Path, os.O_RDWR, 0)
+	assert.Nil(t, err)
+	_, err = fp.WriteAt(data[:], 0)
+	assert.Nil(t, err)
+	assert.Nil(t, fp.Close())
+
+	assert.Nil(t, db.Open())
+	assert.Equal(t, meta, saveMeta(db))
+	assert.Nil(t, db.Set([]byte("k000"), []byte("new")))
+	db.Close()
+	slots, valid := readMaster(t, db.Path)
+	assert.True(t, valid[0] && valid[1])
+	assert.Equal(t, singleMasterSig, slots[0].sig)
+	assert.Equal(t, DB_SIG, slots[1].sig)
+	assert.Equal(t, cur.ver+1, slots[1].ver)
+
+	assert.Nil(t, db.Open())
+	defer db.Close()
+	val, _, err := db.Get([]byte("k000"))
+	assert.Nil(t, err)
+	assert.Equal(t, "new", string(val))
+	report, err := db.Check()
+	assert.Nil(t, err, report.String())
+}
+
+// the counts without the COUNT_NO_OVERFLOW flag, the leaves are read to free the overflow pages.
+func TestUpgradeV11(t *testing.T) {
+	db := newTestKV(t)
+	for i := 0; i < 2000; i++ {
+		val := "v"
+		if i%100 == 0 {
+			val = strings.Repeat("x", BTREE_MAX_VAL_SIZE+1)
+		}
+		assert.Nil(t, db.Set([]byte(fmt.Sprintf("k%04d", i)), []byte(val)))
+	}
+	var clear func(ptr uint64)
+	clear = func(ptr uint64) {
+		node, err := db.tree.get(ptr)
+		assert.Nil(t, err)
+		if node.btype() != BNODE_NODE {
+			return
+		}
+		for i := uint16(0); i < node.nkeys(); i++ {
+			clear(node.getPtr(i))
+		}
+		patchPage(t, db, ptr, func(node BNode) {
+			for i := uint16(0); i < node.nkeys(); i++ {
+				node.setCount(i, node.getCount(i))
+			}
+		})
+	}
+	clear(db.tree.root)
+	db.Close()
+	patchMaster(t, db.Path, func(slot []byte) { copy(slot[:16], noFlagsSig) })
+
+	assert.Nil(t, db.Open())
+	deleted, err := db.DeleteRange([]byte("k0100"), []byte("k1900"))
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1800), deleted)
+	report, err := db.Check()
+	assert.Nil(t, err, report.String())
+	db.Close()
+	slots, _ := readMaster(t, db.Path)
+	assert.Equal(t, DB_SIG, slots[db.master].sig)
+}
@@ -0,0 +1,117 @@
+package core
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+// when the updates are synced to the disk, see Options.Sync.
+type SyncMode int
+
+const (
+	// fsync on every update, a successful update is durable.
+	SYNC_ALWAYS SyncMode = iota
+	// the updates are written without fsync and synced every Options.SyncInterval.
+	// the master page is only written when synced, so a crash loses the updates
+	// of the last interval, but the file is consistent.
+	SYNC_INTERVAL
+	// never fsync, the OS writes the pages back eventually. the file survives a crash
+	// of the process, but a crash of the system can corrupt it.
+	SYNC_NEVER
+)
+
+const SYNC_INTERVAL_DEFAULT = time.Second
+
+// the initial mmap size, it's doubled until the file fits.
+const MMAP_INIT_SIZE = 64 << 20
+
+// options for KV.OpenWith(), the zero value is the default.
+type Options struct {
+	Sync         SyncMode
+	SyncInterval time.Duration // for SYNC_INTERVAL, 0 means SYNC_INTERVAL_DEFAULT
+	// the file must exist, it's not written, and the updates fail with ErrReadOnly.
+	// a file in an old format fails with ErrNeedUpgrade.
+	// the file is locked with a shared lock, or an exclusive lock if it's not read-only.
+	ReadOnly bool
+	// how long to wait for the lock held by others, 0 means no waiting, see ErrLocked.
+	LockTimeout time.Duration
+	FileMode    os.FileMode // the permissions of a new file, 0 means 0644
+	// the mmap sizes, only for NewMmapPager().
+	MmapInitSize int // 0 means MMAP_INIT_SIZE
+	MmapMaxSize  int // the file can't grow beyond it, 0 means no limit
+	// the concurrent updates share a single commit, see commitGroup.
+	GroupCommit bool
+	// the updates are appended to a log file and only the log is synced,
+	// the pages are written by the checkpoints, see wal.go.
+	// Sync is ignored, the log is synced by every update.
+	WAL bool
+	// a checkpoint is made when the log is larger than it, 0 means WAL_CHECKPOINT_SIZE.
+	CheckpointSize int
+	// the new file size in pages when it's extended for `needed` pages,
+	// nil is GrowDefault. KV.OpenWith() fails if it doesn't extend the file.
+	Grow func(pages int, needed int) int
+}
+
+// the file size is increased exponentially,
+// so that we don't have to extend the file for every update.
+func GrowDefault(pages int, needed int) int {
+	for pages < needed {
+		inc := pages / 8
+		if inc < 1 {
+			inc = 1
+		}
+		pages += inc
+	}
+	return pages
+}
+
+// extend the file by a multiple of `step` pages.
+// a step that isn't positive doesn't extend the file, KV.OpenWith() rejects it.
+func GrowStep(step int) func(pages int, needed int) int {
+	return func(pages int, needed int) int {
+		for step > 0 && pages < needed {
+			pages += step
+		}
+		return pages
+	}
+}
+
+// check the options that can't be normalized.
+func (opts Options) check() error {
+	if opts.Grow != nil && opts.Grow(1, 2) < 2 {
+		return errors.New("bad Options.Grow: it doesn't extend the file")
+	}
+	return nil
+}
+
+// fill in the defaults.
+func (opts Options) normalize() Options {
+	if opts.SyncInterval <= 0 {
+		opts.SyncInterval = SYNC_INTERVAL_DEFAULT
+	}
+	if opts.FileMode == 0 {
+		opts.FileMode = 0644
+	}
+	if opts.MmapInitSize <= 0 {
+		opts.MmapInitSize = MMAP_INIT_SIZE
+	}
+	// the mmap offsets are aligned to pages
+	opts.MmapInitSize = (opts.MmapInitSize + BTREE_PAGE_SIZE - 1) / BTREE_PAGE_SIZE * BTREE_PAGE_SIZE
+	opts.MmapMaxSize = opts.MmapMaxSize / BTREE_PAGE_SIZE * BTREE_PAGE_SIZE
+	if opts.CheckpointSize <= 0 {
+		opts.CheckpointSize = WAL_CHECKPOINT_SIZE
+	}
+	if opts.Grow == nil {
+		opts.Grow = GrowDefault
+	}
+	return opts
+}
+
+// the arguments of FS.OpenFile().
+func (opts Options) openFlag() int {
+	if opts.ReadOnly {
+		return os.O_RDONLY
+	}
+	return os.O_RDWR | os.O_CREATE
+}
@@ -0,0 +1,232 @@
+package core
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// counts the fsync calls.
+type syncCountFS struct {
+	syncs atomic.Int64
+	delay time.Duration // a slow fsync
+}
+
+type syncCountFile struct {
+	File
+	fs *syncCountFS
+}
+
+func (fs *syncCountFS) OpenFile(path string, flag int, perm os.FileMode) (File, error) {
+	fp, err := osFS{}.OpenFile(path, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return syncCountFile{fp, fs}, nil
+}
+
+func (f syncCountFile) Sync() error {
+	f.fs.syncs.Add(1)
+	time.Sleep(f.fs.delay)
+	return f.File.Sync()
+}
+
+func TestOptionsSync(t *testing.T) {
+	fs := &syncCountFS{}
+	db := &KV{Path: filepath.Join(t.TempDir(), "test.db"), FS: fs}
+	open := func(opts Options) {
+		assert.Nil(t, db.OpenWith(opts))
+		fs.syncs.Store(0)
+	}
+	set := func(key, val string) {
+		assert.Nil(t, db.Set([]byte(key), []byte(val)))
+	}
+	get := func(key string) string {
+		val, _, err := db.Get([]byte(key))
+		assert.Nil(t, err)
+		return string(val)
+	}
+
+	// the default
+	open(Options{})
+	set("k", "1")
+	assert.Equal(t, int64(2), fs.syncs.Load())
+	db.Close()
+
+	open(Options{Sync: SYNC_NEVER})
+	set("k", "2")
+	assert.Equal(t, int64(0), fs.syncs.Load())
+	db.Close()
+	assert.Equal(t, int64(0), fs.syncs.Load())
+	open(Options{})
+	assert.Equal(t, "2", get("k"))
+	db.Close()
+
+	// synced by Close()
+	open(Options{Sync: SYNC_INTERVAL, SyncInterval: time.Hour})
+	for i := 0; i < 10; i++ {
+		set("k", fmt.Sprint(i))
+	}
+	assert.Equal(t, int64(0), fs.syncs.Load())
+	assert.Equal(t, "9", get("k"))
+	db.Close()
+	assert.Equal(t, int64(2), fs.syncs.Load())
+	open(Options{})
+	assert.Equal(t, "9", get("k"))
+	db.Close()
+
+	// synced by the timer
+	open(Options{Sync: SYNC_INTERVAL, SyncInterval: 10 * time.Millisecond})
+	set("k", "a")
+	set("k", "b")
+	assert.Eventually(t, func() bool {
+		slots, valid := readMaster(t, db.Path)
+		return fs.syncs.Load() == 2 && valid[1] && slots[1].ver == db.ver
+	}, time.Second, time.Millisecond)
+	db.Close()
+	assert.Equal(t, int64(2), fs.syncs.Load())
+}
+
+// a crash with SYNC_INTERVAL loses the updates after the last sync,
+// but the pages of the synced version are not reused before the next sync.
+func TestOptionsSyncIntervalCrash(t *testing.T) {
+	fs := &FaultFS{Rand: rand.New(rand.NewSource(1))}
+	db := &KV{Path: filepath.Join(t.TempDir(), "test.db"), FS: fs}
+	assert.Nil(t, db.Open())
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, db.Set([]byte(fmt.Sprintf("k%04d", i)), []byte("old")))
+	}
+	synced := kvDump(t, db)
+	db.Close()
+
+	assert.Nil(t, db.OpenWith(Options{Sync: SYNC_INTERVAL, SyncInterval: time.Hour}))
+	for n := 0; n < 20; n++ {
+		for i := n; i < 500; i += 20 {
+			assert.Nil(t, db.Set([]byte(fmt.Sprintf("k%04d", i)), []byte(fmt.Sprint(n))))
+		}
+		_, err := db.Del([]byte(fmt.Sprintf("k%04d", n)))
+		assert.Nil(t, err)
+	}
+	// crash without syncing
+	db.timer.Stop()
+	assert.Nil(t, db.pager.Close())
+	db.pager = nil
+	assert.Nil(t, fs.Crash())
+
+	assert.Nil(t, db.Open())
+	defer db.Close()
+	assert.Equal(t, synced, kvDump(t, db))
+	report, err := db.Check()
+	assert.Nil(t, err, report.String())
+}
+
+func TestOptionsReadOnly(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := &KV{Path: path}
+	assert.ErrorIs(t, db.OpenWith(Options{ReadOnly: true}), os.ErrNotExist)
+	assert.Nil(t, db.Open())
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Set([]byte(fmt.Sprintf("k%03d", i)), []byte("v")))
+	}
+	db.Close()
+	data, err := os.ReadFile(path)
+	assert.Nil(t, err)
+
+	for name, newPager := range testPagers() {
+		if name == "mem" {
+			continue
+		}
+		db := &KV{Path: path, Pager: newPager()}
+		assert.Nil(t, db.OpenWith(Options{ReadOnly: true}))
+		count, err := db.Count(nil, nil)
+		assert.Nil(t, err)
+		assert.Equal(t, uint64(100), count)
+		report, err := db.Check()
+		assert.Nil(t, err, report.String())
+
+		assert.ErrorIs(t, db.Set([]byte("k000"), []byte("new")), ErrReadOnly)
+		_, err = db.Del([]byte("k000"))
+		assert.ErrorIs(t, err, ErrReadOnly)
+		b := &WriteBatch{}
+		b.Set([]byte("a"), []byte("b"))
+		assert.ErrorIs(t, db.Batch(b), ErrReadOnly)
+		tx := db.Begin()
+		assert.Nil(t, tx.Set([]byte("a"), []byte("b")))
+		assert.ErrorIs(t, tx.Commit(), ErrReadOnly)
+		val, _, err := db.Get([]byte("k000"))
+		assert.Nil(t, err)
+		assert.Equal(t, "v", string(val))
+		db.Close()
+
+		after, err := os.ReadFile(path)
+		assert.Nil(t, err)
+		assert.Equal(t, data, after, name)
+	}
+}
+
+func TestOptionsFileMode(t *testing.T) {
+	db := &KV{Path: filepath.Join(t.TempDir(), "test.db")}
+	assert.Nil(t, db.OpenWith(Options{FileMode: 0600}))
+	defer db.Close()
+	fi, err := os.Stat(db.Path)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+}
+
+func TestOptionsMmapSize(t *testing.T) {
+	db := &KV{Path: filepath.Join(t.TempDir(), "test.db")}
+	opts := Options{MmapInitSize: 16 * BTREE_PAGE_SIZE, MmapMaxSize: 100 * BTREE_PAGE_SIZE}
+	assert.Nil(t, db.OpenWith(opts))
+	var err error
+	n := 0
+	for ; err == nil; n++ {
+		err = db.Set([]byte(fmt.Sprintf("k%06d", n)), make([]byte, 1000))
+	}
+	assert.ErrorIs(t, err, ErrMapFull)
+	pager := db.pager.(*mmapPager)
+	assert.True(t, len(pager.chunks) > 1)
+	assert.True(t, pager.total <= opts.MmapMaxSize)
+	assert.True(t, db.size <= opts.MmapMaxSize)
+	count, err := db.Count(nil, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(n-1), count)
+	db.Close()
+
+	assert.Nil(t, db.OpenWith(opts))
+	count, err = db.Count(nil, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(n-1), count)
+	report, err := db.Check()
+	assert.Nil(t, err, report.String())
+	db.Close()
+
+	// the file is larger than the max
+	opts.MmapMaxSize = 10 * BTREE_PAGE_SIZE
+	assert.ErrorIs(t, db.OpenWith(opts), ErrMapFull)
+}
+
+func TestOptionsGrow(t *testing.T) {
+	assert.Equal(t, 1, GrowDefault(0, 1))
+	assert.Equal(t, 18, GrowDefault(16, 17))
+	assert.Equal(t, 30, GrowStep(10)(0, 25))
+	for _, step := range []int{0, -1} {
+		db := &KV{Path: filepath.Join(t.TempDir(), "test.db")}
+		assert.NotNil(t, db.OpenWith(Options{Grow: GrowStep(step)}))
+	}
+
+	db := &KV{Path: filepath.Join(t.TempDir(), "test.db")}
+	assert.Nil(t, db.OpenWith(Options{Grow: GrowStep(10)}))
+	defer db.Close()
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Set([]byte(fmt.Sprintf("k%04d", i)), make([]byte, 100)))
+		fi, err := os.Stat(db.Path)
+		assert.Nil(t, err)
+		assert.Equal(t, int64(0), fi.Size()%(10*BTREE_PAGE_SIZE))
+	}
+}
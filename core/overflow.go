@@ -0,0 +1,146 @@
+package core
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const BNODE_OVERFLOW = 4
+const OVERFLOW_HEADER = 4 + 4 + 8
+
+// OVERFLOW_CAP 表示一个溢出页面可以存放的 value 字节数
+const OVERFLOW_CAP = BTREE_PAGE_SIZE - OVERFLOW_HEADER
+
+// the flag in the klen of a leaf KV, key sizes never reach it.
+const LEAF_VAL_OVERFLOW = 1 << 15
+
+// 超过 BTREE_MAX_VAL_SIZE 的 value 放不进叶子节点，需要存到一串溢出页面里。
+// 叶子节点的 klen 的最高位标记这个 value 存在溢出页面里，
+// 这时叶子节点里的 value 只存 value 的总长度和溢出页面链表的第一个页面。
+// | size | first page |
+// | 8B   | 8B         |
+//
+// the format of an overflow page, the data size of each page is derived from the total size.
+// | type | unused | checksum | next pointer | data |
+// | 2B   | 2B     | 4B       | 8B           | ...  |
+
+func ovNext(node BNode) uint64 {
+	return binary.LittleEndian.Uint64(node.data[8:16])
+}
+
+func ovSetHeader(node BNode, next uint64) {
+	binary.LittleEndian.PutUint16(node.data[0:2], BNODE_OVERFLOW)
+	binary.LittleEndian.PutUint64(node.data[8:16], next)
+}
+
+func ovData(node BNode) []byte {
+	return node.data[OVERFLOW_HEADER:BTREE_PAGE_SIZE]
+}
+
+func leafIsOverflow(node BNode, idx uint16) bool {
+	pos := node.kvPos(idx)
+	return binary.LittleEndian.Uint16(node.data[pos:])&LEAF_VAL_OVERFLOW != 0
+}
+
+// mark a KV that was just appended with the value returned by leafValue().
+func leafSetOverflow(node BNode, idx uint16) {
+	pos := node.kvPos(idx)
+	klen := binary.LittleEndian.Uint16(node.data[pos:])
+	binary.LittleEndian.PutUint16(node.data[pos:], klen|LEAF_VAL_OVERFLOW)
+}
+
+// the value to be stored in a leaf. big values are written to overflow pages.
+// returns whether the value is stored in overflow pages and the inline value.
+func leafValue(tree *BTree, val []byte) (bool, []byte, error) {
+	if len(val) <= BTREE_MAX_VAL_SIZE {
+		return false, val, nil
+	}
+	ptr, err := overflowWrite(tree, val)
+	if err != nil {
+		return false, nil, err
+	}
+	ref := make([]byte, 16)
+	binary.LittleEndian.PutUint64(ref[0:8], uint64(len(val)))
+	binary.LittleEndian.PutUint64(ref[8:16], ptr)
+	return true, ref, nil
+}
+
+// read the value of a leaf KV, following the overflow pages if there are any.
+func leafGetVal(tree *BTree, node BNode, idx uint16) ([]byte, error) {
+	val := node.getVal(idx)
+	if !leafIsOverflow(node, idx) {
+		return val, nil
+	}
+	size := binary.LittleEndian.Uint64(val[0:8])
+	return overflowRead(tree, binary.LittleEndian.Uint64(val[8:16]), size)
+}
+
+// deallocate the overflow pages of a leaf KV that is being replaced or removed.
+func leafFreeVal(tree *BTree, node BNode, idx uint16) error {
+	if !leafIsOverflow(node, idx) {
+		return nil
+	}
+	return overflowFree(tree, binary.LittleEndian.Uint64(node.getVal(idx)[8:16]))
+}
+
+// write the value to a chain of new pages, returns the first page.
+// the pages are allocated backward so that each page knows its next page
+// when it's handed to `tree.new`.
+func overflowWrite(tree *BTree, val []byte) (uint64, error) {
+	npages := (len(val) + OVERFLOW_CAP - 1) / OVERFLOW_CAP
+	next := uint64(0)
+	for i := npages - 1; i >= 0; i-- {
+		node := BNode{make([]byte, BTREE_PAGE_SIZE)}
+		ovSetHeader(node, next)
+		copy(ovData(node), val[i*OVERFLOW_CAP:])
+		ptr, err := tree.new(node)
+		if err != nil {
+			return 0, err
+		}
+		next = ptr
+	}
+	return next, nil
+}
+
+func overflowRead(tree *BTree, ptr uint64, size uint64) ([]byte, error) {
+	if size > BTREE_MAX_OVERFLOW_SIZE {
+		return nil, ErrValueTooLarge // don't trust a bad size
+	}
+	val := make([]byte, 0, size)
+	for ptr != 0 && uint64(len(val)) < size {
+		node, err := tree.get(ptr)
+		if err != nil {
+			return nil, err
+		}
+		if node.btype() != BNODE_OVERFLOW {
+			return nil, ErrBadNode
+		}
+		data := ovData(node)
+		if remain := size - uint64(len(val)); uint64(len(data)) > remain {
+			data = data[:remain]
+		}
+		val = append(val, data...)
+		ptr = ovNext(node)
+	}
+	if uint64(len(val)) < size {
+		return nil, fmt.Errorf("%w: the overflow pages end at %d of %d bytes", ErrBadNode, len(val), size)
+	}
+	return val, nil
+}
+
+func overflowFree(tree *BTree, ptr uint64) error {
+	for ptr != 0 {
+		node, err := tree.get(ptr)
+		if err != nil {
+			return err
+		}
+		if node.btype() != BNODE_OVERFLOW {
+			return ErrBadNode
+		}
+		if err := tree.del(ptr); err != nil {
+			return err
+		}
+		ptr = ovNext(node)
+	}
+	return nil
+}
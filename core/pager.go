@@ -0,0 +1,196 @@
+package core
+
+import (
+	"fmt"
+	"sync"
+)
+
+// how the pages are read from and written to the file, see KV.Pager.
+// NewMmapPager() is the default, NewFilePager() reads the file with a bounded
+// page cache, NewMemPager() keeps the pages in memory for testing.
+type Pager interface {
+	// open or create the file, returns its size in bytes.
+	Open(fs FS, path string, opts Options) (int, error)
+	// a page in the file, it must not be modified.
+	// the readers call it concurrently with the writer,
+	// which doesn't write the pages that the readers can reach.
+	Read(ptr uint64) ([]byte, error)
+	// write a page, it's not durable until Sync().
+	Write(ptr uint64, page []byte) error
+	// write a part of the master page in place, see masterStore().
+	WriteMaster(offset int64, data []byte) error
+	// extend the file to `size` bytes.
+	Truncate(size int) error
+	Sync() error
+	Close() error
+}
+
+// the pages are read and written via the mmap.
+type mmapPager struct {
+	fp    File
+	mu    sync.RWMutex // protects `chunks` for the readers
+	total int          // mmap size, can be larger than the file size
+	max   int          // Options.MmapMaxSize
+	// multiple mmaps, can be non-continuous.
+	// the chunks are never unmapped before Close().
+	chunks [][]byte
+}
+
+func NewMmapPager() Pager {
+	return &mmapPager{}
+}
+
+// create the initial mmap that covers the whole file.
+func (p *mmapPager) Open(fs FS, path string, opts Options) (int, error) {
+	opts = opts.normalize()
+	fp, size, err := openFile(fs, path, opts)
+	if err != nil {
+		return 0, err
+	}
+	p.max = opts.MmapMaxSize
+	if p.max > 0 && size > p.max {
+		_ = fp.Close()
+		return 0, fmt.Errorf("%w: %d bytes", ErrMapFull, size)
+	}
+	mmapSize := opts.MmapInitSize
+	for mmapSize < size {
+		mmapSize *= 2
+	}
+	if p.max > 0 {
+		mmapSize = min(mmapSize, p.max)
+	}
+
+	chunk, err := fp.Mmap(0, mmapSize)
+	if err != nil {
+		_ = fp.Close()
+		return 0, fmt.Errorf("mmap: %w", err)
+	}
+	p.fp = fp
+	p.total = len(chunk)
+	p.chunks = [][]byte{chunk}
+	return size, nil
+}
+
+/*
+让我用一个具体的例子来解释：
+
+假设：
+- BTREE_PAGE_SIZE = 4096（每页4KB）
+- 有两个内存映射块(chunks)：
+  - chunk[0]: 16KB (可以存4页)
+  - chunk[1]: 16KB (可以存4页)
+
+那么：
+
+chunk[0]对应的页面编号：0,1,2,3
+chunk[1]对应的页面编号：4,5,6,7
+
+当要获取第6页（ptr=6）时：
+1. 第一次循环：
+  - start = 0
+  - end = 4（16KB/4KB = 4页）
+  - ptr(6) >= end(4)，继续下一个chunk
+
+2. 第二次循环：
+  - start = 4（上一个chunk的end）
+  - end = 8
+  - ptr(6) < end(8)，找到了目标chunk
+  - offset = 4096 * (6 - 4)
+  - = 4096 * 2
+  - = 8192
+
+所以`offset = BTREE_PAGE_SIZE * (ptr - start)`就是在计算：
+- 目标页面在当前chunk中是第几页(ptr - start)
+- 乘以页面大小，得到字节偏移量
+
+这样就能精确定位到目标页面在chunk中的具体位置。
+*/
+func (p *mmapPager) page(ptr uint64) ([]byte, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	start := uint64(0)
+	for _, chunk := range p.chunks {
+		end := start + uint64(len(chunk))/BTREE_PAGE_SIZE
+		if ptr < end {
+			offset := BTREE_PAGE_SIZE * (ptr - start)
+			return chunk[offset : offset+BTREE_PAGE_SIZE], nil
+		}
+		start = end
+	}
+	return nil, fmt.Errorf("%w: page %d is not mapped", ErrBadPointer, ptr)
+}
+
+func (p *mmapPager) Read(ptr uint64) ([]byte, error) {
+	return p.page(ptr)
+}
+
+func (p *mmapPager) Write(ptr uint64, page []byte) error {
+	data, err := p.page(ptr)
+	if err != nil {
+		return err
+	}
+	copy(data, page)
+	return nil
+}
+
+// NOTE: Updating the page via mmap is not atomic.
+// Use the `pwrite()` syscall instead.
+func (p *mmapPager) WriteMaster(offset int64, data []byte) error {
+	_, err := p.fp.WriteAt(data, offset)
+	return err
+}
+
+// extend the file and the mmap.
+func (p *mmapPager) Truncate(size int) error {
+	if p.max > 0 && size > p.max {
+		return fmt.Errorf("%w: %d bytes", ErrMapFull, size)
+	}
+	if err := p.fp.Truncate(int64(size)); err != nil {
+		return err
+	}
+	// 一个大的 value 可能一次追加很多页面，所以要循环直到映射空间足够
+	for p.total < size {
+		if err := p.extendOnce(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// double the address space, up to the max size.
+func (p *mmapPager) extendOnce() error {
+	length := p.total
+	if p.max > 0 {
+		length = min(length, p.max-p.total)
+	}
+	// offset：从文件的哪个位置开始映射，length: 要映射的长度
+	chunk, err := p.fp.Mmap(int64(p.total), length)
+	if err != nil {
+		return fmt.Errorf("mmap: %w", err)
+	}
+
+	// 更新数据库的内存映射信息
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.total += length                  // 总大小翻倍
+	p.chunks = append(p.chunks, chunk) // 保存新的映射块
+	return nil
+}
+
+func (p *mmapPager) Sync() error {
+	return p.fp.Sync()
+}
+
+func (p *mmapPager) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, chunk := range p.chunks {
+		err := p.fp.Munmap(chunk)
+		if err != nil {
+			panic(fmt.Sprintf("db close failed,err %+v", err))
+		}
+	}
+	p.chunks = nil
+	p.total = 0
+	return p.fp.Close()
+}
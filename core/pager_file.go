@@ -0,0 +1,125 @@
+package core
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+)
+
+// the default cache size of NewFilePager(), in pages.
+const PAGER_CACHE_DEFAULT = 1024
+
+// the pages are read and written with pread() and pwrite(),
+// the recently used pages are kept in a LRU cache.
+type filePager struct {
+	fp    File
+	limit int // the max number of cached pages
+	mu    sync.Mutex
+	lru   *list.List // of cachedPage, the most recently used first
+	cache map[uint64]*list.Element
+}
+
+type cachedPage struct {
+	ptr  uint64
+	data []byte
+}
+
+// a pager that caches at most `limit` pages, 0 is PAGER_CACHE_DEFAULT.
+func NewFilePager(limit int) Pager {
+	if limit <= 0 {
+		limit = PAGER_CACHE_DEFAULT
+	}
+	return &filePager{limit: limit}
+}
+
+func (p *filePager) Open(fs FS, path string, opts Options) (int, error) {
+	opts = opts.normalize()
+	fp, size, err := openFile(fs, path, opts)
+	if err != nil {
+		return 0, err
+	}
+	p.fp = fp
+	p.lru = list.New()
+	p.cache = map[uint64]*list.Element{}
+	return size, nil
+}
+
+func (p *filePager) get(ptr uint64) []byte {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if elem, ok := p.cache[ptr]; ok {
+		p.lru.MoveToFront(elem)
+		return elem.Value.(cachedPage).data
+	}
+	return nil
+}
+
+// the cached pages are never modified, a write replaces the cached one.
+func (p *filePager) put(ptr uint64, data []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if elem, ok := p.cache[ptr]; ok {
+		elem.Value = cachedPage{ptr, data}
+		p.lru.MoveToFront(elem)
+		return
+	}
+	p.cache[ptr] = p.lru.PushFront(cachedPage{ptr, data})
+	for p.lru.Len() > p.limit {
+		last := p.lru.Back()
+		delete(p.cache, last.Value.(cachedPage).ptr)
+		p.lru.Remove(last)
+	}
+}
+
+func (p *filePager) Read(ptr uint64) ([]byte, error) {
+	if data := p.get(ptr); data != nil {
+		return data, nil
+	}
+	data := make([]byte, BTREE_PAGE_SIZE)
+	if _, err := p.fp.ReadAt(data, int64(ptr)*BTREE_PAGE_SIZE); err != nil {
+		return nil, fmt.Errorf("%w: read page %d: %v", ErrBadPointer, ptr, err)
+	}
+	p.put(ptr, data)
+	return data, nil
+}
+
+func (p *filePager) Write(ptr uint64, page []byte) error {
+	data := append([]byte(nil), page[:BTREE_PAGE_SIZE]...)
+	if _, err := p.fp.WriteAt(data, int64(ptr)*BTREE_PAGE_SIZE); err != nil {
+		p.invalidate(ptr)
+		return err
+	}
+	p.put(ptr, data)
+	return nil
+}
+
+func (p *filePager) WriteMaster(offset int64, data []byte) error {
+	p.invalidate(0)
+	_, err := p.fp.WriteAt(data, offset)
+	return err
+}
+
+// the page is unknown after a failed write.
+func (p *filePager) invalidate(ptr uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if elem, ok := p.cache[ptr]; ok {
+		delete(p.cache, ptr)
+		p.lru.Remove(elem)
+	}
+}
+
+func (p *filePager) Truncate(size int) error {
+	return p.fp.Truncate(int64(size))
+}
+
+func (p *filePager) Sync() error {
+	return p.fp.Sync()
+}
+
+func (p *filePager) Close() error {
+	p.mu.Lock()
+	p.lru, p.cache = list.New(), map[uint64]*list.Element{}
+	p.mu.Unlock()
+	return p.fp.Close()
+}
@@ -0,0 +1,74 @@
+package core
+
+import (
+	"fmt"
+	"sync"
+)
+
+// the pages are only in memory, there is no file. the writes are durable
+// immediately, and the pages are kept after Close(), so the KV can be reopened
+// with the same pager. it's for testing.
+type memPager struct {
+	mu    sync.RWMutex
+	pages [][]byte // a write replaces the page, the old one is unchanged for the readers
+}
+
+func NewMemPager() Pager {
+	return &memPager{}
+}
+
+func (p *memPager) Open(fs FS, path string, opts Options) (int, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return len(p.pages) * BTREE_PAGE_SIZE, nil
+}
+
+func (p *memPager) Read(ptr uint64) ([]byte, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if ptr >= uint64(len(p.pages)) {
+		return nil, fmt.Errorf("%w: page %d is out of the file", ErrBadPointer, ptr)
+	}
+	return p.pages[ptr], nil
+}
+
+func (p *memPager) Write(ptr uint64, page []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if ptr >= uint64(len(p.pages)) {
+		return fmt.Errorf("%w: page %d is out of the file", ErrBadPointer, ptr)
+	}
+	p.pages[ptr] = append([]byte(nil), page[:BTREE_PAGE_SIZE]...)
+	return nil
+}
+
+func (p *memPager) WriteMaster(offset int64, data []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.pages) == 0 {
+		return fmt.Errorf("%w: no master page", ErrBadPointer)
+	}
+	page := append([]byte(nil), p.pages[0]...)
+	copy(page[offset:], data)
+	p.pages[0] = page
+	return nil
+}
+
+func (p *memPager) Truncate(size int) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	npages := size / BTREE_PAGE_SIZE
+	for len(p.pages) < npages {
+		p.pages = append(p.pages, make([]byte, BTREE_PAGE_SIZE))
+	}
+	p.pages = p.pages[:npages]
+	return nil
+}
+
+func (p *memPager) Sync() error {
+	return nil
+}
+
+func (p *memPager) Close() error {
+	return nil
+}
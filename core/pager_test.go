@@ -0,0 +1,122 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testPagers() map[string]func() Pager {
+	return map[string]func() Pager{
+		"mmap": NewMmapPager,
+		"file": func() Pager { return NewFilePager(8) },
+		"mem":  NewMemPager,
+	}
+}
+
+func TestPager(t *testing.T) {
+	for name, newPager := range testPagers() {
+		t.Run(name, func(t *testing.T) {
+			p := newPager()
+			path := filepath.Join(t.TempDir(), "test.db")
+			size, err := p.Open(osFS{}, path, Options{})
+			assert.Nil(t, err)
+			assert.Equal(t, 0, size)
+			assert.Nil(t, p.Truncate(3*BTREE_PAGE_SIZE))
+
+			page := bytes.Repeat([]byte("a"), BTREE_PAGE_SIZE)
+			assert.Nil(t, p.Write(1, page))
+			old, err := p.Read(1)
+			assert.Nil(t, err)
+			assert.Equal(t, page, old)
+			page[0] = 'b' // the written page is copied
+			assert.Nil(t, p.Write(2, page))
+			assert.Nil(t, p.WriteMaster(10, []byte("master")))
+			master, err := p.Read(0)
+			assert.Nil(t, err)
+			assert.Equal(t, "master", string(master[10:16]))
+			_, err = p.Read(1 << 30)
+			assert.ErrorIs(t, err, ErrBadPointer)
+
+			assert.Nil(t, p.Sync())
+			assert.Nil(t, p.Close())
+			size, err = p.Open(osFS{}, path, Options{})
+			assert.Nil(t, err)
+			assert.Equal(t, 3*BTREE_PAGE_SIZE, size)
+			data, err := p.Read(2)
+			assert.Nil(t, err)
+			assert.Equal(t, page, data)
+			assert.Nil(t, p.Close())
+		})
+	}
+}
+
+func TestFilePagerCache(t *testing.T) {
+	p := NewFilePager(4).(*filePager)
+	_, err := p.Open(osFS{}, filepath.Join(t.TempDir(), "test.db"), Options{})
+	assert.Nil(t, err)
+	defer p.Close()
+	assert.Nil(t, p.Truncate(10*BTREE_PAGE_SIZE))
+	for ptr := uint64(0); ptr < 10; ptr++ {
+		assert.Nil(t, p.Write(ptr, bytes.Repeat([]byte{byte(ptr)}, BTREE_PAGE_SIZE)))
+	}
+	assert.Equal(t, 4, p.lru.Len())
+	assert.Equal(t, 4, len(p.cache))
+	// the evicted pages are read from the file
+	for ptr := uint64(0); ptr < 10; ptr++ {
+		data, err := p.Read(ptr)
+		assert.Nil(t, err)
+		assert.Equal(t, bytes.Repeat([]byte{byte(ptr)}, BTREE_PAGE_SIZE), data)
+	}
+	assert.Equal(t, 4, p.lru.Len())
+
+	// a write doesn't change the page returned before
+	old, err := p.Read(9)
+	assert.Nil(t, err)
+	assert.Nil(t, p.Write(9, make([]byte, BTREE_PAGE_SIZE)))
+	assert.Equal(t, byte(9), old[0])
+	data, err := p.Read(9)
+	assert.Nil(t, err)
+	assert.Equal(t, byte(0), data[0])
+}
+
+func newPagerKV(t *testing.T, pager Pager) *KV {
+	db := &KV{Path: filepath.Join(t.TempDir(), "test.db"), Pager: pager}
+	assert.Nil(t, db.Open())
+	t.Cleanup(db.Close)
+	return db
+}
+
+func TestKVPagers(t *testing.T) {
+	for name, newPager := range testPagers() {
+		t.Run(name, func(t *testing.T) {
+			db := newPagerKV(t, newPager())
+			for i := 0; i < 1000; i++ {
+				val := fmt.Sprintf("v%d", i)
+				if i%300 == 0 {
+					val = string(bytes.Repeat([]byte("big"), 3000)) // overflow pages
+				}
+				assert.Nil(t, db.Set([]byte(fmt.Sprintf("k%04d", i)), []byte(val)))
+			}
+			_, err := db.DeleteRange([]byte("k0200"), []byte("k0500"))
+			assert.Nil(t, err)
+			db.Close()
+
+			assert.Nil(t, db.Open())
+			count, err := db.Count(nil, nil)
+			assert.Nil(t, err)
+			assert.Equal(t, uint64(700), count)
+			val, ok, err := db.Get([]byte("k0999"))
+			assert.Nil(t, err)
+			assert.True(t, ok)
+			assert.Equal(t, "v999", string(val))
+			report, err := db.Check()
+			assert.Nil(t, err, report.String())
+
+			testConcurrentReaders(t, newPagerKV(t, newPager()))
+		})
+	}
+}
@@ -0,0 +1,207 @@
+package core
+
+import "fmt"
+
+// KVTX is a read-write transaction. the updates are applied to the
+// copy-on-write tree as they are made, so the transaction reads its own writes,
+// and they are only published by Commit(). it holds the writer lock of the KV,
+// the other updates wait until it's finished. a KVTX is used by one goroutine.
+type KVTX struct {
+	db   *KV
+	meta kvMeta // the states before the transaction, for Abort()
+	rec  *walRecord
+	err  error // ErrTxDone after Commit() or Abort(), or ErrClosed
+}
+
+// start a read-write transaction, it must be finished by Commit() or Abort().
+// its methods fail with ErrClosed if the KV isn't open.
+func (db *KV) Begin() *KVTX {
+	db.writer.Lock()
+	if !db.opened {
+		db.writer.Unlock()
+		return &KVTX{db: db, err: ErrClosed}
+	}
+	return &KVTX{db: db, meta: saveMeta(db), rec: newWalRecord(db)}
+}
+
+func (tx *KVTX) Get(key []byte) ([]byte, bool, error) {
+	if tx.err != nil {
+		return nil, false, tx.err
+	}
+	return tx.db.tree.Get(key)
+}
+
+// like KV.Scan(), the pending updates are visible.
+func (tx *KVTX) Scan(start, end []byte, fn func(key, val []byte) bool) error {
+	if tx.err != nil {
+		return tx.err
+	}
+	return treeScan(&tx.db.tree, start, end, ScanOptions{}, fn)
+}
+
+func (tx *KVTX) Set(key []byte, val []byte) error {
+	return tx.Update(&UpdateReq{Key: key, Val: val})
+}
+
+// like KV.Update(). a bad request is rejected without side effects,
+// any other error aborts the transaction, the tree might be half updated.
+func (tx *KVTX) Update(req *UpdateReq) (err error) {
+	if tx.err != nil {
+		return tx.err
+	}
+	if err := req.check(); err != nil {
+		return err
+	}
+	defer tx.abortOnError(&err)
+	if err := tx.db.tree.Update(req); err != nil || !req.Updated {
+		return err
+	}
+	tx.rec.set(req.Key, req.Val)
+	return nil
+}
+
+// like Update(), an error other than a bad key aborts the transaction.
+func (tx *KVTX) Del(key []byte) (deleted bool, err error) {
+	if tx.err != nil {
+		return false, tx.err
+	}
+	if err := checkKey(key); err != nil {
+		return false, err
+	}
+	defer tx.abortOnError(&err)
+	if deleted, err = tx.db.tree.Delete(key); err != nil || !deleted {
+		return false, err
+	}
+	tx.rec.del(key)
+	return true, nil
+}
+
+// publish the updates with a single writePages() and syncPages().
+// the transaction is aborted if it fails.
+func (tx *KVTX) Commit() (err error) {
+	if tx.err != nil {
+		return tx.err
+	}
+	tx.err = ErrTxDone
+	defer tx.db.writer.Unlock()
+	if len(tx.db.page.updates) == 0 {
+		return nil // read-only
+	}
+	defer revertOnError(tx.db, tx.meta, &err)
+	return commitPages(tx.db, tx.rec)
+}
+
+// discard the updates. it does nothing if the transaction is already finished.
+func (tx *KVTX) Abort() {
+	if tx.err != nil {
+		return
+	}
+	tx.err = ErrTxDone
+	rollback(tx.db, tx.meta)
+	tx.db.writer.Unlock()
+}
+
+func (tx *KVTX) abortOnError(err *error) {
+	if *err != nil {
+		tx.Abort()
+	}
+}
+
+// KVReader is a read-only transaction on the version committed when it began.
+// it doesn't block and isn't affected by the writer, the pages of its version are
+// not reused until it's closed, see KV.oldest(). a KVReader is used by one goroutine,
+// and the iterators from it are valid until Close().
+type KVReader struct {
+	db      *KV
+	tree    BTree
+	version kvVersion
+	err     error // ErrTxDone after Close(), or ErrClosed
+}
+
+// start a read-only transaction, it must be closed by Close().
+// its reads fail with ErrClosed if the KV isn't open.
+func (db *KV) BeginRead() *KVReader {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if !db.opened {
+		return &KVReader{db: db, err: ErrClosed}
+	}
+	db.readers[db.version.ver]++
+	return newReader(db, db.version)
+}
+
+func newReader(db *KV, version kvVersion) *KVReader {
+	r := &KVReader{db: db, version: version}
+	r.tree = BTree{root: version.root, cmp: db.tree.cmp, get: r.pageGet}
+	return r
+}
+
+// only the pages of the version can be read.
+func (r *KVReader) pageGet(ptr uint64) (BNode, error) {
+	if page, ok := r.version.pages.get(ptr); ok {
+		return BNode{page}, nil
+	}
+	if ptr == 0 || ptr >= r.version.flushed {
+		return BNode{}, fmt.Errorf("%w: page %d", ErrBadPointer, ptr)
+	}
+	return pagerGet(r.db.pager, ptr)
+}
+
+func (r *KVReader) Close() {
+	if r.err != nil {
+		return
+	}
+	r.err = ErrTxDone
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+	ver := r.version.ver
+	if r.db.readers[ver]--; r.db.readers[ver] == 0 {
+		delete(r.db.readers, ver)
+	}
+}
+
+func (r *KVReader) Get(key []byte) ([]byte, bool, error) {
+	if r.err != nil {
+		return nil, false, r.err
+	}
+	return r.tree.Get(key)
+}
+
+func (r *KVReader) Scan(start, end []byte, fn func(key, val []byte) bool) error {
+	return r.ScanRange(start, end, ScanOptions{}, fn)
+}
+
+func (r *KVReader) ScanRange(start, end []byte, opts ScanOptions, fn func(key, val []byte) bool) error {
+	if r.err != nil {
+		return r.err
+	}
+	return treeScan(&r.tree, start, end, opts, fn)
+}
+
+func (r *KVReader) Seek(key []byte, cmp int) *BIter {
+	if r.err != nil {
+		return &BIter{tree: &r.tree, err: r.err}
+	}
+	return r.tree.Seek(key, cmp)
+}
+
+func (r *KVReader) Select(i uint64) *BIter {
+	if r.err != nil {
+		return &BIter{tree: &r.tree, err: r.err}
+	}
+	return r.tree.Select(i)
+}
+
+func (r *KVReader) Rank(key []byte) (uint64, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	return r.tree.Rank(key)
+}
+
+func (r *KVReader) Count(start, end []byte) (uint64, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	return r.tree.Count(start, end)
+}
@@ -0,0 +1,340 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func txGet(t *testing.T, tx *KVTX, key string) (string, bool) {
+	val, ok, err := tx.Get([]byte(key))
+	assert.Nil(t, err)
+	return string(val), ok
+}
+
+func TestKVTXCommit(t *testing.T) {
+	db := newTestKV(t)
+	assert.Nil(t, db.Set([]byte("a"), []byte("1")))
+
+	tx := db.Begin()
+	for i := 0; i < 300; i++ {
+		assert.Nil(t, tx.Set([]byte(fmt.Sprintf("k%04d", i)), []byte(fmt.Sprintf("v%d", i))))
+	}
+	deleted, err := tx.Del([]byte("a"))
+	assert.Nil(t, err)
+	assert.True(t, deleted)
+	// reads its own writes
+	val, ok := txGet(t, tx, "k0100")
+	assert.True(t, ok)
+	assert.Equal(t, "v100", val)
+	_, ok = txGet(t, tx, "a")
+	assert.False(t, ok)
+	keys := []string{}
+	assert.Nil(t, tx.Scan([]byte("k0010"), []byte("k0013"), func(key, val []byte) bool {
+		keys = append(keys, string(key))
+		return true
+	}))
+	assert.Equal(t, []string{"k0010", "k0011", "k0012"}, keys)
+	// bad input doesn't abort the transaction
+	assert.ErrorIs(t, tx.Set(nil, []byte("x")), ErrEmptyKey)
+	_, err = tx.Del(nil)
+	assert.ErrorIs(t, err, ErrEmptyKey)
+
+	flushed := db.page.flushed
+	assert.Nil(t, tx.Commit())
+	assert.True(t, db.page.flushed > flushed)
+	assert.Empty(t, db.page.updates)
+	assert.ErrorIs(t, tx.Commit(), ErrTxDone)
+	assert.ErrorIs(t, tx.Set([]byte("b"), nil), ErrTxDone)
+	tx.Abort() // no effect
+
+	db.Close()
+	assert.Nil(t, db.Open())
+	count, err := db.Count(nil, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(300), count)
+	report, err := db.Check()
+	assert.Nil(t, err, report.String())
+
+	// nothing to commit
+	tx = db.Begin()
+	_, ok = txGet(t, tx, "k0000")
+	assert.True(t, ok)
+	assert.Nil(t, tx.Commit())
+	assert.Equal(t, report.Pages, db.page.flushed)
+}
+
+func TestKVTXAbort(t *testing.T) {
+	db := newTestKV(t)
+	b := &WriteBatch{}
+	for i := 0; i < 1000; i++ {
+		b.Set([]byte(fmt.Sprintf("k%04d", i)), []byte("old"))
+	}
+	assert.Nil(t, db.Batch(b))
+	meta := saveMeta(db)
+
+	tx := db.Begin()
+	for i := 500; i < 1500; i++ {
+		assert.Nil(t, tx.Set([]byte(fmt.Sprintf("k%04d", i)), []byte("new")))
+	}
+	_, err := tx.Del([]byte("k0000"))
+	assert.Nil(t, err)
+	tx.Abort()
+	assert.Equal(t, meta, saveMeta(db))
+	assert.Empty(t, db.page.updates)
+	_, _, err = tx.Get([]byte("k0001"))
+	assert.ErrorIs(t, err, ErrTxDone)
+	assert.ErrorIs(t, tx.Commit(), ErrTxDone)
+
+	val, ok, err := db.Get([]byte("k0000"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "old", string(val))
+	count, err := db.Count(nil, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1000), count)
+	report, err := db.Check()
+	assert.Nil(t, err, report.String())
+
+	// an error from the tree aborts the transaction
+	tx = db.Begin()
+	assert.Nil(t, tx.Set([]byte("k0000"), []byte("new")))
+	root, err := pageGetWritten(db, meta.root) // deallocated by the transaction
+	assert.Nil(t, err)
+	leaf := root.getPtr(root.nkeys() - 1)
+	corruptPage(t, db, leaf)
+	err = tx.Set([]byte("k0999"), []byte("new"))
+	assert.True(t, errors.As(err, &ErrCorruptPage{}), err)
+	assert.ErrorIs(t, tx.err, ErrTxDone)
+	assert.Equal(t, meta, saveMeta(db))
+	assert.Empty(t, db.page.updates)
+}
+
+func TestKVReaderSnapshot(t *testing.T) {
+	db := newTestKV(t)
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, db.Set([]byte(fmt.Sprintf("k%04d", i)), []byte("v0")))
+	}
+	r := db.BeginRead()
+	// the pages of the reader's version are not reused
+	for n := 1; n <= 20; n++ {
+		b := &WriteBatch{}
+		for i := 0; i < 500; i++ {
+			b.Set([]byte(fmt.Sprintf("k%04d", i)), []byte(fmt.Sprintf("v%d", n)))
+		}
+		assert.Nil(t, db.Batch(b))
+	}
+	_, err := db.Del([]byte("k0000"))
+	assert.Nil(t, err)
+	count := 0
+	assert.Nil(t, r.Scan(nil, nil, func(key, val []byte) bool {
+		assert.Equal(t, "v0", string(val))
+		count++
+		return true
+	}))
+	assert.Equal(t, 500, count)
+	val, ok, err := r.Get([]byte("k0000"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "v0", string(val))
+	val, _, err = db.Get([]byte("k0001"))
+	assert.Nil(t, err)
+	assert.Equal(t, "v20", string(val))
+
+	r.Close()
+	r.Close() // no effect
+	_, _, err = r.Get([]byte("k0001"))
+	assert.ErrorIs(t, err, ErrTxDone)
+	iter := r.Seek([]byte("k0001"), CMP_GE)
+	assert.False(t, iter.Valid())
+	assert.ErrorIs(t, iter.Err(), ErrTxDone)
+	assert.ErrorIs(t, r.Select(0).Err(), ErrTxDone)
+
+	// the free pages are reused without readers
+	b := &WriteBatch{}
+	for i := 1; i < 500; i++ {
+		b.Set([]byte(fmt.Sprintf("k%04d", i)), []byte("v21"))
+	}
+	assert.Nil(t, db.Batch(b))
+	flushed := db.page.flushed
+	for n := 22; n < 40; n++ {
+		assert.Nil(t, db.Batch(b))
+	}
+	assert.Equal(t, flushed, db.page.flushed)
+	report, err := db.Check()
+	assert.Nil(t, err, report.String())
+}
+
+// the pages freed before a reader began are reused while it's open.
+func TestKVReaderLongRunning(t *testing.T) {
+	db := newTestKV(t)
+	b := &WriteBatch{}
+	for i := 0; i < 2000; i++ {
+		b.Set([]byte(fmt.Sprintf("k%04d", i)), []byte(strings.Repeat("v", 500)))
+	}
+	assert.Nil(t, db.Batch(b))
+	_, err := db.DeleteRange([]byte("k1000"), nil)
+	assert.Nil(t, err)
+
+	r := db.BeginRead()
+	flushed := db.page.flushed
+	for i := 0; i < 30; i++ {
+		assert.Nil(t, db.Set([]byte(fmt.Sprintf("k%04d", i)), []byte("new")))
+	}
+	assert.Equal(t, flushed, db.page.flushed)
+	// the pages freed after it began are not reused
+	_, err = db.DeleteRange(nil, nil)
+	assert.Nil(t, err)
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Set([]byte(fmt.Sprintf("x%04d", i)), []byte(strings.Repeat("x", 500))))
+	}
+	count := 0
+	assert.Nil(t, r.Scan(nil, nil, func(key, val []byte) bool {
+		assert.Equal(t, strings.Repeat("v", 500), string(val))
+		count++
+		return true
+	}))
+	assert.Equal(t, 1000, count)
+	r.Close()
+
+	report, err := db.Check()
+	assert.Nil(t, err, report.String())
+}
+
+// the iterators of KV.Seek() and KV.Select() hold their version while the keys are rewritten.
+func TestKVIterWhileWriting(t *testing.T) {
+	db := newTestKV(t)
+	b := &WriteBatch{}
+	for i := 0; i < 2000; i++ {
+		b.Set([]byte(fmt.Sprintf("k%04d", i)), []byte(fmt.Sprintf("v%d", i)))
+	}
+	assert.Nil(t, db.Batch(b))
+
+	iter := db.Seek([]byte("k0000"), CMP_GE)
+	defer iter.Close()
+	last := db.Select(1999)
+	defer last.Close()
+	for i := 0; i < 2000; i++ {
+		key := []byte(fmt.Sprintf("k%04d", i))
+		if i%2 == 0 {
+			_, err := db.Del(key)
+			assert.Nil(t, err)
+		} else {
+			assert.Nil(t, db.Set(key, []byte(strings.Repeat("x", 300))))
+		}
+	}
+	for i := 0; i < 2000; i++ {
+		assert.True(t, iter.Valid(), i)
+		assert.Equal(t, fmt.Sprintf("k%04d", i), string(iter.Key()))
+		assert.Equal(t, fmt.Sprintf("v%d", i), string(iter.Value()))
+		iter.Next()
+	}
+	assert.False(t, iter.Valid())
+	assert.Nil(t, iter.Err())
+	assert.True(t, last.Valid())
+	assert.Equal(t, "v1999", string(last.Value()))
+
+	iter.Close()
+	last.Close()
+	assert.False(t, last.Valid())
+	assert.Empty(t, db.readers)
+	report, err := db.Check()
+	assert.Nil(t, err, report.String())
+}
+
+// the pages are reused again after the iterator of KV.Seek() is closed.
+func TestKVIterPageReuse(t *testing.T) {
+	db := newTestKV(t)
+	b := &WriteBatch{}
+	for i := 0; i < 500; i++ {
+		b.Set([]byte(fmt.Sprintf("k%04d", i)), []byte("v0"))
+	}
+	assert.Nil(t, db.Batch(b))
+
+	iter := db.Seek(nil, CMP_GE)
+	defer iter.Close()
+	flushed := db.page.flushed
+	for n := 1; n <= 5; n++ {
+		assert.Nil(t, db.Batch(b))
+	}
+	assert.True(t, db.page.flushed > flushed) // the file grows while it's open
+
+	iter.Close()
+	assert.Empty(t, db.readers)
+	assert.Nil(t, db.Batch(b))
+	flushed = db.page.flushed
+	for n := 1; n <= 20; n++ {
+		assert.Nil(t, db.Batch(b))
+	}
+	assert.Equal(t, flushed, db.page.flushed)
+}
+
+// a writer keeps all the keys at the same value, the readers must never see a mix.
+func TestKVConcurrentReaders(t *testing.T) {
+	testConcurrentReaders(t, newTestKV(t))
+}
+
+// the readers see the whole committed versions in order while the writer updates.
+func testConcurrentReaders(t *testing.T, db *KV) {
+	const nkeys = 200
+	write := func(n int) {
+		b := &WriteBatch{}
+		for i := 0; i < nkeys; i++ {
+			b.Set([]byte(fmt.Sprintf("k%04d", i)), []byte(fmt.Sprintf("%06d", n)))
+		}
+		assert.Nil(t, db.Batch(b))
+	}
+	write(0)
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			last := ""
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				r := db.BeginRead()
+				vals := map[string]bool{}
+				count := 0
+				err := r.Scan(nil, nil, func(key, val []byte) bool {
+					vals[string(val)] = true
+					count++
+					return true
+				})
+				r.Close()
+				assert.Nil(t, err)
+				assert.Equal(t, nkeys, count)
+				assert.Equal(t, 1, len(vals), vals)
+				for val := range vals {
+					assert.True(t, val >= last)
+					last = val
+				}
+			}
+		}()
+	}
+	for n := 1; n <= 100; n++ {
+		if n%2 == 0 {
+			write(n)
+			continue
+		}
+		tx := db.Begin()
+		for i := 0; i < nkeys; i++ {
+			assert.Nil(t, tx.Set([]byte(fmt.Sprintf("k%04d", i)), []byte(fmt.Sprintf("%06d", n))))
+		}
+		assert.Nil(t, tx.Commit())
+	}
+	close(stop)
+	wg.Wait()
+	report, err := db.Check()
+	assert.Nil(t, err, report.String())
+}
@@ -0,0 +1,385 @@
+package core
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"sync"
+)
+
+// the WAL mode, see Options.WAL.
+// an update is applied to the tree in memory, and only a compact record of it is
+// appended to the log and synced, instead of writing the copied pages of the tree.
+// the pages are kept in memory until a checkpoint writes them to the file,
+// together with the master page, then the log starts over.
+// KV.Open() replays the records after the version of the master page.
+//
+// the log format:
+// | header | record | record | ...
+// the header:
+// | sig | base_version | checksum |
+// | 16B | 8B           | 4B       |
+// the base version is the version of the master page when the log was started,
+// the log is stale if it's different, since the checkpoint has the records.
+// a record is the updates of a commit:
+// | size | checksum | op | op | ...
+// | 4B   | 4B       | ...
+// an op:
+// | type | key_len | key | val_len | val |
+// | 1B   | uvarint | ... | uvarint | ... |
+// the checksums are CRC32C, a torn record at the end is ignored.
+const WAL_SIG = "BuildYourOwnWAL1"
+
+const WAL_HEADER_SIZE = 16 + 8 + 4
+
+// the log file is the database file with the suffix.
+const WAL_SUFFIX = "-wal"
+
+// a checkpoint is made when the log is larger than it, see Options.CheckpointSize.
+const WAL_CHECKPOINT_SIZE = 1 << 20
+
+// the op types of the log records.
+const (
+	WAL_SET       = 1 // key, val
+	WAL_DEL       = 2 // key
+	WAL_DEL_RANGE = 3 // [key, val)
+	WAL_DEL_FROM  = 4 // [key, +inf)
+)
+
+type kvWAL struct {
+	fp    File
+	size  int64     // the end of the last record
+	pages *walPages // the pages updated since the last checkpoint
+	freed []uint64  // the pages deallocated since the last checkpoint
+	// the pages in `pages` that are deallocated by each version,
+	// they are dropped when no reader can reach them.
+	dead []walDead
+}
+
+type walDead struct {
+	ptr uint64
+	ver uint64
+}
+
+// the unwritten pages, shared by the writer and the readers.
+// a page is never modified after it's added.
+type walPages struct {
+	mu    sync.RWMutex
+	pages map[uint64][]byte
+}
+
+func newWalPages() *walPages {
+	return &walPages{pages: map[uint64][]byte{}}
+}
+
+// nil is an empty one.
+func (p *walPages) get(ptr uint64) ([]byte, bool) {
+	if p == nil {
+		return nil, false
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	page, ok := p.pages[ptr]
+	return page, ok
+}
+
+// the logical updates of a commit, nil without the WAL mode.
+type walRecord struct {
+	data []byte
+}
+
+func newWalRecord(db *KV) *walRecord {
+	if db.wal == nil {
+		return nil
+	}
+	return &walRecord{}
+}
+
+func (rec *walRecord) add(op byte, key []byte, val []byte) {
+	if rec == nil {
+		return
+	}
+	rec.data = append(rec.data, op)
+	rec.data = binary.AppendUvarint(rec.data, uint64(len(key)))
+	rec.data = append(rec.data, key...)
+	rec.data = binary.AppendUvarint(rec.data, uint64(len(val)))
+	rec.data = append(rec.data, val...)
+}
+
+func (rec *walRecord) set(key []byte, val []byte) {
+	rec.add(WAL_SET, key, val)
+}
+
+func (rec *walRecord) del(key []byte) {
+	rec.add(WAL_DEL, key, nil)
+}
+
+func (rec *walRecord) delRange(start, end []byte) {
+	if end == nil {
+		rec.add(WAL_DEL_FROM, start, nil)
+	} else {
+		rec.add(WAL_DEL_RANGE, start, end)
+	}
+}
+
+// apply the ops of a record to the tree.
+func walApply(db *KV, data []byte) error {
+	field := func() ([]byte, bool) {
+		n, size := binary.Uvarint(data)
+		if size <= 0 || n > uint64(len(data)-size) {
+			return nil, false
+		}
+		out := data[size:][:n]
+		data = data[size+int(n):]
+		return out, true
+	}
+	for len(data) > 0 {
+		op := data[0]
+		data = data[1:]
+		key, ok1 := field()
+		val, ok2 := field()
+		if !ok1 || !ok2 {
+			return errors.New("bad log record")
+		}
+		var err error
+		switch op {
+		case WAL_SET:
+			err = db.tree.Update(&UpdateReq{Key: key, Val: val})
+		case WAL_DEL:
+			_, err = db.tree.Delete(key)
+		case WAL_DEL_RANGE:
+			_, err = db.tree.DeleteRange(key, val)
+		case WAL_DEL_FROM:
+			_, err = db.tree.DeleteRange(key, nil)
+		default:
+			err = fmt.Errorf("bad log op %d", op)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// open the log and replay it. without the WAL mode, the log of an earlier
+// WAL mode is replayed and checkpointed if it exists, then it's closed.
+func walOpen(db *KV, fs FS) error {
+	flag := os.O_RDWR
+	if db.opts.WAL {
+		flag |= os.O_CREATE
+	}
+	if db.opts.ReadOnly {
+		flag = os.O_RDONLY
+	}
+	fp, err := fs.OpenFile(db.Path+WAL_SUFFIX, flag, db.opts.FileMode)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil // no log
+	}
+	if err != nil {
+		return fmt.Errorf("open log: %w", err)
+	}
+	db.wal = &kvWAL{fp: fp, pages: newWalPages()}
+	publish(db)
+	err = walReplay(db)
+	if err == nil && !db.opts.ReadOnly {
+		err = checkpoint(db)
+	}
+	if err != nil || !(db.opts.WAL || db.opts.ReadOnly) {
+		_ = fp.Close()
+		db.wal = nil
+		publish(db)
+	}
+	return err
+}
+
+func walReplay(db *KV) error {
+	w := db.wal
+	size, err := w.fp.Size()
+	if err != nil {
+		return err
+	}
+	data := make([]byte, size)
+	if _, err := w.fp.ReadAt(data, 0); err != nil {
+		return fmt.Errorf("read log: %w", err)
+	}
+	if len(data) < WAL_HEADER_SIZE || string(data[:16]) != WAL_SIG {
+		return nil // empty or torn
+	}
+	sum := binary.LittleEndian.Uint32(data[WAL_HEADER_SIZE-4:])
+	if sum != crc32.Checksum(data[:WAL_HEADER_SIZE-4], crc32c) {
+		return nil // torn
+	}
+	if binary.LittleEndian.Uint64(data[16:]) != db.ver {
+		return nil // stale
+	}
+	pos := WAL_HEADER_SIZE
+	for pos+8 <= len(data) {
+		size := int(binary.LittleEndian.Uint32(data[pos:]))
+		sum := binary.LittleEndian.Uint32(data[pos+4:])
+		if size > len(data)-pos-8 || sum != crc32.Checksum(data[pos+8:][:size], crc32c) {
+			break // torn
+		}
+		if err := walApply(db, data[pos+8:][:size]); err != nil {
+			return fmt.Errorf("replay log at %d: %w", pos, err)
+		}
+		walPublish(db)
+		pos += 8 + size
+	}
+	w.size = int64(pos)
+	return nil
+}
+
+// start a new log after the version of the master page.
+// the log would be replayed on a wrong version if it fails.
+func walReset(db *KV) error {
+	var header [WAL_HEADER_SIZE]byte
+	copy(header[:16], WAL_SIG)
+	binary.LittleEndian.PutUint64(header[16:], db.ver)
+	sum := crc32.Checksum(header[:WAL_HEADER_SIZE-4], crc32c)
+	binary.LittleEndian.PutUint32(header[WAL_HEADER_SIZE-4:], sum)
+
+	w := db.wal
+	err := w.fp.Truncate(0)
+	if err == nil {
+		_, err = w.fp.WriteAt(header[:], 0)
+	}
+	if err == nil {
+		err = w.fp.Sync()
+	}
+	if err != nil {
+		db.failed = fmt.Errorf("%w: reset log: %v", ErrNeedReopen, err)
+		return db.failed
+	}
+	w.size = WAL_HEADER_SIZE
+	return nil
+}
+
+// commit the updates by appending a record to the log,
+// the pages are written by a later checkpoint.
+func walCommit(db *KV, rec *walRecord) error {
+	if db.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	if db.failed != nil {
+		return db.failed
+	}
+	w := db.wal
+	data := make([]byte, 8+len(rec.data))
+	binary.LittleEndian.PutUint32(data[0:], uint32(len(rec.data)))
+	binary.LittleEndian.PutUint32(data[4:], crc32.Checksum(rec.data, crc32c))
+	copy(data[8:], rec.data)
+	// a partially written record may become durable later,
+	// so it's unknown whether the update is committed.
+	if _, err := w.fp.WriteAt(data, w.size); err != nil {
+		db.failed = fmt.Errorf("%w: write log: %v", ErrNeedReopen, err)
+		return db.failed
+	}
+	if err := w.fp.Sync(); err != nil {
+		db.failed = fmt.Errorf("%w: fsync log: %v", ErrNeedReopen, err)
+		return db.failed
+	}
+	w.size += int64(len(data))
+	walPublish(db)
+	if w.size >= int64(db.opts.CheckpointSize) {
+		// the update is durable, a failed checkpoint is retried by the next one
+		_ = checkpoint(db)
+	}
+	return nil
+}
+
+// move the pending pages to the shared ones and publish the version.
+func walPublish(db *KV) {
+	w := db.wal
+	db.ver++
+	w.pages.mu.Lock()
+	for ptr, page := range db.page.updates {
+		if page != nil {
+			pageSetChecksum(page)
+			w.pages.pages[ptr] = page
+			continue
+		}
+		w.freed = append(w.freed, ptr)
+		if _, ok := w.pages.pages[ptr]; ok {
+			w.dead = append(w.dead, walDead{ptr: ptr, ver: db.ver})
+		}
+	}
+	w.pages.mu.Unlock()
+	db.page.flushed += uint64(db.page.nappend)
+	db.page.nappend = 0
+	db.page.updates = map[uint64][]byte{}
+	publish(db)
+
+	// drop the deallocated pages that no reader can reach
+	oldest := db.oldestRead()
+	n := 0
+	for n < len(w.dead) && w.dead[n].ver <= oldest {
+		n++
+	}
+	w.pages.mu.Lock()
+	for _, dead := range w.dead[:n] {
+		delete(w.pages.pages, dead.ptr)
+	}
+	w.pages.mu.Unlock()
+	w.dead = w.dead[n:]
+}
+
+// write the pages of the logged updates and the master page, then start a new log.
+// the readers of the earlier versions keep the old pages in memory.
+func checkpoint(db *KV) error {
+	if db.ver != db.durable {
+		if err := checkpointPages(db); err != nil {
+			return err
+		}
+	}
+	return walReset(db)
+}
+
+func checkpointPages(db *KV) (err error) {
+	w := db.wal
+	meta, pages := saveMeta(db), w.pages
+	defer func() {
+		if err != nil {
+			rollback(db, meta)
+			w.pages = pages
+		}
+	}()
+	// the free list takes the deallocated pages
+	for _, ptr := range w.freed {
+		db.page.updates[ptr] = nil
+	}
+	if err := writePages(db); err != nil {
+		return err
+	}
+	for ptr, page := range pages.pages {
+		if _, ok := db.page.updates[ptr]; ok {
+			continue // deallocated
+		}
+		if err := db.pager.Write(ptr, page); err != nil {
+			return fmt.Errorf("write page %d: %w", ptr, err)
+		}
+	}
+	w.pages = newWalPages()
+	if err := syncPages(db); err != nil {
+		return err
+	}
+	w.freed, w.dead = nil, nil
+	return nil
+}
+
+// write the pages of the logged updates, it does nothing without Options.WAL.
+func (db *KV) Checkpoint() error {
+	db.writer.Lock()
+	defer db.writer.Unlock()
+	if !db.opened {
+		return ErrClosed
+	}
+	if db.wal == nil {
+		return nil
+	}
+	if db.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	return checkpoint(db)
+}
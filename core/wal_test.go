@@ -0,0 +1,193 @@
+package core
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// close the files without a checkpoint, as if the process died.
+func walAbandon(t *testing.T, db *KV) {
+	assert.Nil(t, db.wal.fp.Close())
+	db.wal = nil
+	assert.Nil(t, db.pager.Close())
+	db.pager = nil
+}
+
+func TestWAL(t *testing.T) {
+	fs := &syncCountFS{}
+	db := &KV{Path: filepath.Join(t.TempDir(), "test.db"), FS: fs}
+	assert.Nil(t, db.OpenWith(Options{WAL: true}))
+	fi, err := os.Stat(db.Path)
+	assert.Nil(t, err)
+	size := fi.Size()
+	fs.syncs.Store(0)
+
+	// only the log is written
+	expect := map[string]string{}
+	for i := 0; i < 300; i++ {
+		key := fmt.Sprintf("k%03d", i)
+		assert.Nil(t, db.Set([]byte(key), []byte(fmt.Sprint(i))))
+		expect[key] = fmt.Sprint(i)
+	}
+	assert.Equal(t, int64(300), fs.syncs.Load())
+	fi, err = os.Stat(db.Path)
+	assert.Nil(t, err)
+	assert.Equal(t, size, fi.Size())
+
+	deleted, err := db.Del([]byte("k000"))
+	assert.Nil(t, err)
+	assert.True(t, deleted)
+	delete(expect, "k000")
+	n, err := db.DeleteRange([]byte("k100"), []byte("k200"))
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(100), n)
+	n, err = db.DeleteRange([]byte("k290"), nil)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(10), n)
+	for i := 100; i < 200; i++ {
+		delete(expect, fmt.Sprintf("k%03d", i))
+	}
+	for i := 290; i < 300; i++ {
+		delete(expect, fmt.Sprintf("k%03d", i))
+	}
+	b := &WriteBatch{}
+	b.Set([]byte("a"), []byte("batch"))
+	b.Del([]byte("k001"))
+	assert.Nil(t, db.Batch(b))
+	expect["a"] = "batch"
+	delete(expect, "k001")
+	tx := db.Begin()
+	assert.Nil(t, tx.Set([]byte("b"), []byte("tx")))
+	_, err = tx.Del([]byte("k002"))
+	assert.Nil(t, err)
+	assert.Nil(t, tx.Commit())
+	expect["b"] = "tx"
+	delete(expect, "k002")
+	tx = db.Begin()
+	assert.Nil(t, tx.Set([]byte("c"), []byte("aborted")))
+	tx.Abort()
+
+	assert.Equal(t, expect, kvDump(t, db))
+	report, err := db.Check()
+	assert.Nil(t, err, report.String())
+
+	// replayed without the WAL mode
+	walAbandon(t, db)
+	assert.Nil(t, db.Open())
+	assert.Equal(t, expect, kvDump(t, db))
+	report, err = db.Check()
+	assert.Nil(t, err, report.String())
+	assert.Nil(t, db.Set([]byte("d"), []byte("no log")))
+	expect["d"] = "no log"
+	db.Close()
+
+	// the old log is not replayed again
+	assert.Nil(t, db.OpenWith(Options{WAL: true}))
+	assert.Equal(t, expect, kvDump(t, db))
+	db.Close()
+}
+
+func TestWALCheckpoint(t *testing.T) {
+	db := &KV{Path: filepath.Join(t.TempDir(), "test.db")}
+	opts := Options{WAL: true, CheckpointSize: 4096}
+	assert.Nil(t, db.OpenWith(opts))
+	expect := map[string]string{}
+	for i := 0; i < 2000; i++ {
+		key := fmt.Sprintf("k%03d", i%500)
+		val := fmt.Sprint(i)
+		if i%7 == 0 {
+			_, err := db.Del([]byte(key))
+			assert.Nil(t, err)
+			delete(expect, key)
+			continue
+		}
+		assert.Nil(t, db.Set([]byte(key), []byte(val)))
+		expect[key] = val
+		fi, err := os.Stat(db.Path + WAL_SUFFIX)
+		assert.Nil(t, err)
+		assert.Less(t, fi.Size(), int64(4096+100))
+	}
+	assert.True(t, db.durable > 1000)
+	// the pages freed before the last checkpoint are reused
+	report, err := db.Check()
+	assert.Nil(t, err, report.String())
+	assert.Less(t, report.Pages, uint64(1000))
+
+	walAbandon(t, db)
+	assert.Nil(t, db.OpenWith(opts))
+	defer db.Close()
+	assert.Equal(t, expect, kvDump(t, db))
+	report, err = db.Check()
+	assert.Nil(t, err, report.String())
+}
+
+// the log is replayed in memory, the files are not written.
+func TestWALReadOnly(t *testing.T) {
+	db := &KV{Path: filepath.Join(t.TempDir(), "test.db")}
+	assert.Nil(t, db.OpenWith(Options{WAL: true}))
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Set([]byte(fmt.Sprintf("k%03d", i)), []byte("v")))
+	}
+	expect := kvDump(t, db)
+	walAbandon(t, db)
+	data, err := os.ReadFile(db.Path)
+	assert.Nil(t, err)
+	log, err := os.ReadFile(db.Path + WAL_SUFFIX)
+	assert.Nil(t, err)
+
+	assert.Nil(t, db.OpenWith(Options{ReadOnly: true}))
+	assert.Equal(t, expect, kvDump(t, db))
+	report, err := db.Check()
+	assert.Nil(t, err, report.String())
+	assert.ErrorIs(t, db.Set([]byte("k"), []byte("v")), ErrReadOnly)
+	assert.ErrorIs(t, db.Checkpoint(), ErrReadOnly)
+	db.Close()
+
+	after, err := os.ReadFile(db.Path)
+	assert.Nil(t, err)
+	assert.Equal(t, data, after)
+	after, err = os.ReadFile(db.Path + WAL_SUFFIX)
+	assert.Nil(t, err)
+	assert.Equal(t, log, after)
+}
+
+func TestWALReaders(t *testing.T) {
+	db := &KV{Path: filepath.Join(t.TempDir(), "test.db")}
+	assert.Nil(t, db.OpenWith(Options{WAL: true, CheckpointSize: 64 << 10}))
+	defer db.Close()
+	testConcurrentReaders(t, db)
+	report, err := db.Check()
+	assert.Nil(t, err, report.String())
+}
+
+func TestWALGroupCommit(t *testing.T) {
+	fs := &syncCountFS{}
+	db := &KV{Path: filepath.Join(t.TempDir(), "test.db"), FS: fs}
+	assert.Nil(t, db.OpenWith(Options{WAL: true, GroupCommit: true}))
+	defer db.Close()
+	fs.syncs.Store(0)
+	fs.delay = 5 * time.Millisecond
+	runConcurrently(100, func(i int) {
+		assert.Nil(t, db.Set([]byte(fmt.Sprintf("k%03d", i)), []byte("v")))
+	})
+	assert.Less(t, fs.syncs.Load(), int64(100))
+	count, err := db.Count(nil, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(100), count)
+}
+
+func TestWALCrash(t *testing.T) {
+	for seed := int64(1); seed <= 5; seed++ {
+		t.Run(fmt.Sprint(seed), func(t *testing.T) {
+			testKVCrash(t, seed, NewMmapPager(), Options{WAL: true, CheckpointSize: 8 << 10})
+		})
+		t.Run(fmt.Sprintf("file pager %d", seed), func(t *testing.T) {
+			testKVCrash(t, seed, NewFilePager(16), Options{WAL: true, CheckpointSize: 8 << 10})
+		})
+	}
+}